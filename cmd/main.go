@@ -21,6 +21,12 @@ func main() {
 		log.Fatalf("❌ Failed to initialize database: %v", err)
 	}
 	websocket.RegisterMetrics()
+	websocket.StartCertRenewalMonitor()
+	websocket.StartTaskRetryWorker()
+	websocket.StartOfflinePurger()
+	if err := server.StartClusterSync(); err != nil {
+		log.Fatalf("❌ Failed to start cluster sync: %v", err)
+	}
 
 	// Primary HTTP server (your existing server.NewServer())
 	s := server.NewServer()
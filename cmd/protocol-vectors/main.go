@@ -0,0 +1,45 @@
+// Command protocol-vectors writes the agent protocol known-answer vectors.
+//
+// The agent repository consumes the JSON file to check its canonical strings
+// and signatures. Run with -check in CI to fail when the committed file no
+// longer matches the gateway's registry.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"ultahost-ai-gateway/internal/websocket"
+)
+
+func main() {
+	out := flag.String("o", "internal/websocket/testdata/protocol_vectors.json", "output file")
+	check := flag.Bool("check", false, "compare with the existing file instead of writing it")
+	flag.Parse()
+
+	data, err := json.MarshalIndent(websocket.ProtocolTestVectors(), "", "  ")
+	if err != nil {
+		log.Fatalf("❌ marshal vectors: %v", err)
+	}
+	data = append(data, '\n')
+
+	if *check {
+		existing, err := os.ReadFile(*out)
+		if err != nil {
+			log.Fatalf("❌ read %s: %v", *out, err)
+		}
+		if !bytes.Equal(existing, data) {
+			log.Fatalf("❌ %s is out of date; rerun without -check and share it with the agent", *out)
+		}
+		log.Printf("✅ %s matches the protocol registry", *out)
+		return
+	}
+
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		log.Fatalf("❌ write %s: %v", *out, err)
+	}
+	log.Printf("✅ wrote %s", *out)
+}
@@ -0,0 +1,50 @@
+// Command rekey re-wraps envelope-encrypted agent secrets, task-signing keys,
+// queued offline messages and the args of retried and dead-lettered tasks under
+// the active KEK.
+//
+// Rotation: add the new key to KEK_FILE ("kid:base64key"), set KEK_ACTIVE_ID to
+// it, run this command, restart the gateway, then drop the old key line.
+package main
+
+import (
+	"log"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/db"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+)
+
+func main() {
+	config.LoadConfig()
+	if err := utils.LoadKeyring(); err != nil {
+		log.Fatalf("❌ Failed to load KEK keyring: %v", err)
+	}
+	if err := db.Connect(config.AppConfig.DatabaseURL); err != nil {
+		log.Fatalf("❌ Failed to connect database: %v", err)
+	}
+
+	n, err := models.RekeyAgentKeyRecords()
+	if err != nil {
+		log.Fatalf("❌ Rekey stopped after %d row(s): %v", n, err)
+	}
+	log.Printf("✅ Re-encrypted %d agent secret(s) under KEK %s", n, utils.ActiveKeyID())
+
+	n, err = models.RekeyTaskSigningKeys()
+	if err != nil {
+		log.Fatalf("❌ Task signing key rekey stopped after %d key(s): %v", n, err)
+	}
+	log.Printf("✅ Re-encrypted %d task signing key(s) under KEK %s", n, utils.ActiveKeyID())
+
+	n, err = models.RekeyOfflineMessages()
+	if err != nil {
+		log.Fatalf("❌ Offline message rekey stopped after %d message(s): %v", n, err)
+	}
+	log.Printf("✅ Re-encrypted %d offline message(s) under KEK %s", n, utils.ActiveKeyID())
+
+	n, err = models.RekeyTaskArgs()
+	if err != nil {
+		log.Fatalf("❌ Task args rekey stopped after %d row(s): %v", n, err)
+	}
+	log.Printf("✅ Re-encrypted the args of %d retried or dead-lettered task(s) under KEK %s", n, utils.ActiveKeyID())
+}
@@ -2,7 +2,10 @@
 package agents
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"ultahost-ai-gateway/internal/ai"
@@ -10,7 +13,13 @@ import (
 	"ultahost-ai-gateway/internal/websocket"
 )
 
-func HandleVPS(req *models.ChatRequest, functionList []string) (string, error) {
+// HandleVPS runs the agent task matching the request. Tasks are cancelled if
+// ctx ends (the chat client disconnected) before the result arrives. Chat never
+// queues behind other operations on the VPS; the user is told to retry.
+func HandleVPS(ctx context.Context, req *models.ChatRequest, functionList []string) (string, error) {
+	if len(functionList) == 0 {
+		return "The agent on this VPS does not support any of the available actions; please update it.", nil
+	}
 	functionName, err := ai.ClassifyFunctionWithinAgent(req.Message, functionList)
 	if err != nil {
 		return "", err
@@ -27,8 +36,11 @@ func HandleVPS(req *models.ChatRequest, functionList []string) (string, error) {
 
 	switch functionName {
 	case "checkuptime":
-		res, err := websocket.SendSignedTaskAndWait(vpsId, "check_uptime", req.Args, waitTimeout)
+		res, err := websocket.SendSignedTaskAndWaitWith(ctx, vpsId, "check_uptime", req.Args, waitTimeout, websocket.SendOptions{NoQueue: true})
 		if err != nil {
+			if msg, ok := busyReply(err); ok {
+				return msg, nil
+			}
 			return "", fmt.Errorf("dispatch/check_uptime failed: %w", err)
 		}
 		if res.ExitCode == 0 {
@@ -37,8 +49,11 @@ func HandleVPS(req *models.ChatRequest, functionList []string) (string, error) {
 		return fmt.Sprintf("Command failed (exit=%d): %s", res.ExitCode, res.Stderr), nil
 
 	case "checkdiskspace":
-		res, err := websocket.SendSignedTaskAndWait(vpsId, "check_diskspace", req.Args, waitTimeout)
+		res, err := websocket.SendSignedTaskAndWaitWith(ctx, vpsId, "check_diskspace", req.Args, waitTimeout, websocket.SendOptions{NoQueue: true})
 		if err != nil {
+			if msg, ok := busyReply(err); ok {
+				return msg, nil
+			}
 			return "", fmt.Errorf("dispatch/check_diskspace failed: %w", err)
 		}
 		if res.ExitCode == 0 {
@@ -49,8 +64,11 @@ func HandleVPS(req *models.ChatRequest, functionList []string) (string, error) {
 	case "installwordpress", "install_wordpress":
 		// install can take longer; choose a longer wait (adjust as needed)
 		installWait := 10 * time.Minute
-		res, err := websocket.SendSignedTaskAndWait(vpsId, "install_wordpress", req.Args, installWait)
+		res, err := websocket.SendSignedTaskAndWaitWith(ctx, vpsId, "install_wordpress", req.Args, installWait, websocket.SendOptions{NoQueue: true})
 		if err != nil {
+			if msg, ok := busyReply(err); ok {
+				return msg, nil
+			}
 			return "", fmt.Errorf("dispatch/install_wordpress failed: %w", err)
 		}
 		if res.ExitCode == 0 {
@@ -62,3 +80,20 @@ func HandleVPS(req *models.ChatRequest, functionList []string) (string, error) {
 		return "I couldn't match your request to a known VPS function.", nil
 	}
 }
+
+// busyReply explains a task refused because the VPS is busy.
+func busyReply(err error) (string, bool) {
+	var running *websocket.OperationRunningError
+	switch {
+	case errors.As(err, &running):
+		msg := fmt.Sprintf("Another operation is running on this VPS (%s). Please try again once it has finished.",
+			strings.Join(running.Running, ", "))
+		if running.Waiting > 0 {
+			msg += fmt.Sprintf(" %d more operation(s) are queued.", running.Waiting)
+		}
+		return msg, true
+	case errors.Is(err, websocket.ErrTaskQueueFull):
+		return "Too many operations are queued on this VPS. Please try again later.", true
+	}
+	return "", false
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"ultahost-ai-gateway/internal/ai"
 	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/websocket"
 )
 
 // List of all available VPS functions
@@ -13,6 +14,27 @@ var VPSFunctionList = []string{
 	"installWordPress",
 }
 
+// Agent task each VPS function dispatches
+var VPSFunctionTasks = map[string]string{
+	"checkUptime":      "check_uptime",
+	"checkDiskSpace":   "check_diskspace",
+	"installWordPress": "install_wordpress",
+}
+
+// SupportedVPSFunctions filters VPSFunctionList by the tasks the agent on vpsId advertised in its hello.
+func SupportedVPSFunctions(vpsId string) []string {
+	if vpsId == "" {
+		return VPSFunctionList
+	}
+	out := []string{}
+	for _, fn := range VPSFunctionList {
+		if websocket.AgentSupportsTask(vpsId, VPSFunctionTasks[fn]) {
+			out = append(out, fn)
+		}
+	}
+	return out
+}
+
 // Function to check system uptime
 func checkUptime(req *models.ChatRequest) (string, error) {
 	rawOutput := "Uptime: 5 days 3 hours"
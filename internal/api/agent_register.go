@@ -2,27 +2,31 @@ package api
 
 import (
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
-	"fmt"
-	"math/big"
 	"net/http"
 	"time"
+	"ultahost-ai-gateway/internal/pkg/models"
 	"ultahost-ai-gateway/internal/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 type AgentRegisterRequest struct {
 	InstallToken string `json:"install_token" binding:"required"`
 	VPSID        string `json:"vps_id" binding:"required"`
-}
+	CSR          string `json:"csr"` // PEM CSR, CN must be Agent_<vps_id>
+
+	// PayloadVersion selects the response encryption; EncPub is the agent's
+	// ephemeral X25519 public key (base64) for version 2.
+	PayloadVersion int    `json:"payload_version"`
+	EncPub         string `json:"enc_pub"`
 
+	// Task signature algorithms the agent can verify; "ed25519" opts in to gateway-key signing.
+	TaskSigAlgs []string `json:"task_sig_algs"`
+}
 
 func generateSecret(length int) string {
 	bytes := make([]byte, length)
@@ -30,33 +34,16 @@ func generateSecret(length int) string {
 	return hex.EncodeToString(bytes)
 }
 
-func generateSelfSignedCert() (certPEM []byte, keyPEM []byte, err error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	tmpl := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"UltaHost Agent"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
-
-	certDER, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
-	if err != nil {
-		return nil, nil, err
+// negotiateTaskSigAlg picks Ed25519 when the installer supports it and a gateway key exists.
+func negotiateTaskSigAlg(offered []string) string {
+	for _, alg := range offered {
+		if alg == utils.TaskSigEd25519 {
+			if _, ok := utils.ActiveTaskSigningKey(); ok {
+				return utils.TaskSigEd25519
+			}
+		}
 	}
-
-	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-
-	return certPEM, keyPEM, nil
+	return utils.TaskSigHMAC
 }
 
 func HandleAgentRegister(c *gin.Context) {
@@ -67,17 +54,52 @@ func HandleAgentRegister(c *gin.Context) {
 	}
 	td := tokenData.(utils.TokenData)
 
-	fmt.Printf(" td: %+v \n", td)
-	fmt.Printf(" TOKENDDATA: %+v \n", tokenData)
+	var req AgentRegisterRequest
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.PayloadVersion != EnrollPayloadVersion || req.EncPub == "" {
+		// Installers using the retired static-key format cannot decrypt anything we send.
+		c.JSON(http.StatusUpgradeRequired, gin.H{
+			"error":                      "unsupported enrollment payload version: upgrade the installer",
+			"supported_payload_versions": []int{EnrollPayloadVersion},
+		})
+		return
+	}
+	// Checked before anything is issued or stored: a response the agent cannot
+	// decrypt must not replace its current keys.
+	encPub, err := parseEnrollPub(req.EncPub)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid enc_pub", "details": err.Error()})
+		return
+	}
+	if req.CSR == "" {
+		// Pre-CSR installers expect the gateway to generate their key; refuse clearly.
+		c.JSON(http.StatusBadRequest, gin.H{"error": "csr is required: this gateway no longer generates agent keys, upgrade the installer"})
+		return
+	}
+
+	if _, err := utils.ParseAgentCSR([]byte(req.CSR), "Agent_"+td.VPSID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSR rejected", "details": err.Error()})
+		return
+	}
 
-	identityToken := generateSecret(32)
-	signatureSecret := generateSecret(32)
-	keys, clientCertPEM, clientKeyPEM, err := ProceedCerts(td.VPSID)
+	// Single use: a concurrent request with the same token loses here
+	if _, ok := utils.ConsumeInstallToken(req.InstallToken); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	clientCertPEM, err := IssueAgentCert(td.VPSID, []byte(req.CSR))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate cert"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSR rejected", "details": err.Error()})
 		return
 	}
 
+	identityToken := generateSecret(32)
+	signatureSecret := generateSecret(32)
+
 	cert, err := GetCrt()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cert"})
@@ -88,21 +110,41 @@ func HandleAgentRegister(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "fingerprint calc failed"})
 		return
 	}
-	fmt.Println("--------- fingerprin: ", fingerprint)
 
 	time.Sleep(50 * time.Millisecond)
-	utils.SaveAgentKeys("Agent_"+td.VPSID, utils.AgentKeys{
+	agentKeys := utils.AgentKeys{
 		IdentityToken:     identityToken,
 		SignatureSecret:   signatureSecret,
 		Certificate:       base64.StdEncoding.EncodeToString(clientCertPEM),
-		PrivateKey:        base64.StdEncoding.EncodeToString(clientKeyPEM),
 		FingerprintSHA256: fingerprint,
+		TaskSigAlg:        negotiateTaskSigAlg(req.TaskSigAlgs),
+	}
+	if err := models.SaveAgentKeyRecord("Agent_"+td.VPSID, agentKeys); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to persist agent keys"})
+		return
+	}
+	utils.SaveAgentKeys("Agent_"+td.VPSID, agentKeys)
+
+	models.RecordAudit(models.AuditEntry{
+		UserID:   models.AuditEntityID(td.UserID),
+		Action:   "agent_enrolled",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(td.VPSID),
+		Details:  "fingerprint=" + fingerprint + " task_sig_alg=" + agentKeys.TaskSigAlgorithm(),
 	})
 
-	keys["IdentityToken"] = identityToken
-	keys["SignatureSecret"] = signatureSecret
-	keys["FingerprintSHA256"] = fingerprint
-	keys["Cert"] = string(cert)
+	// Only the signed certificate goes back; the private key never left the VPS.
+	keys := map[string]interface{}{
+		"cert":              string(clientCertPEM),
+		"IdentityToken":     identityToken,
+		"SignatureSecret":   signatureSecret,
+		"FingerprintSHA256": fingerprint,
+		"Cert":              string(cert),
+		"TaskSigAlg":        agentKeys.TaskSigAlgorithm(),
+	}
+	if agentKeys.TaskSigAlgorithm() == utils.TaskSigEd25519 {
+		keys["TaskSigningKeys"] = utils.PublishedTaskSigningKeys()
+	}
 
 	payload, err := json.Marshal(keys)
 	if err != nil {
@@ -110,11 +152,11 @@ func HandleAgentRegister(c *gin.Context) {
 		return
 	}
 
-	encryptedPayload, err := encryptAESGCM(encryptionKey, payload)
+	envelope, err := sealEnrollmentPayload(encPub, req.InstallToken, td.VPSID, payload)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "encryption failed"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "encryption failed", "details": err.Error()})
 		return
 	}
 
-	c.Data(http.StatusOK, "application/octet-stream", encryptedPayload)
+	c.JSON(http.StatusOK, envelope)
 }
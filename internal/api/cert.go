@@ -3,134 +3,109 @@ package api
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
-	"math/big"
+	"log"
 	"os"
-	"time"
+	"ultahost-ai-gateway/internal/utils"
+
+	"golang.org/x/crypto/hkdf"
 )
 
-// symmetric key for AES (32 bytes for AES-256)
-// In production, generate securely and share via secure channel
-var encryptionKey = []byte("0123456789abcdef0123456789abcdef")
+// Enrollment payload format. Version 2 replaces the static AES key of version 1
+// with an ephemeral X25519 agreement against a key the agent generates per install.
+const (
+	EnrollPayloadVersion = 2
+	enrollPayloadAlg     = "X25519-HKDF-SHA256-A256GCM"
+	enrollInfoPrefix     = "ultaai-enroll-v2|"
+)
 
-func loadCA(keyPathth, certPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
-	caCertPEM, err := os.ReadFile(certPath + "/ca.crt")
-	if err != nil {
-		return nil, nil, err
-	}
-	caKeyPEM, err := os.ReadFile(keyPathth + "/ca.key")
-	if err != nil {
-		return nil, nil, err
-	}
+// EnrollmentEnvelope is the JSON body returned by /agent/register.
+type EnrollmentEnvelope struct {
+	Version    int    `json:"version"`
+	Alg        string `json:"alg"`
+	EPK        string `json:"epk"`        // gateway ephemeral X25519 public key, base64
+	Nonce      string `json:"nonce"`      // base64
+	Ciphertext string `json:"ciphertext"` // base64 AES-256-GCM, AAD = info string
+}
 
-	block, _ := pem.Decode(caCertPEM)
-	if block == nil {
-		return nil, nil, fmt.Errorf("failed to parse CA cert PEM")
-	}
-	caCert, err := x509.ParseCertificate(block.Bytes)
+// parseEnrollPub decodes the agent's base64 X25519 public key (enc_pub).
+func parseEnrollPub(agentPubB64 string) (*ecdh.PublicKey, error) {
+	agentPubRaw, err := base64.StdEncoding.DecodeString(agentPubB64)
 	if err != nil {
-		return nil, nil, err
-	}
-
-	block, _ = pem.Decode(caKeyPEM)
-	if block == nil {
-		return nil, nil, fmt.Errorf("failed to parse CA key PEM")
+		return nil, fmt.Errorf("enc_pub is not base64: %w", err)
 	}
-
-	// Try to parse PKCS#8 private key
-	keyInterface, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	agentPub, err := ecdh.X25519().NewPublicKey(agentPubRaw)
 	if err != nil {
-		// fallback: try PKCS#1 parsing
-		caKey, err2 := x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err2 != nil {
-			return nil, nil, fmt.Errorf("failed to parse private key: %v / %v", err, err2)
-		}
-		return caCert, caKey, nil
-	}
-
-	caKey, ok := keyInterface.(*rsa.PrivateKey)
-	if !ok {
-		return nil, nil, fmt.Errorf("private key is not RSA")
+		return nil, fmt.Errorf("enc_pub is not an X25519 key: %w", err)
 	}
-
-	return caCert, caKey, nil
+	return agentPub, nil
 }
 
-// Generate a client cert + private key signed by CA
-func generateClientCert(caCert *x509.Certificate, caKey *rsa.PrivateKey, commonName string) ([]byte, []byte, error) {
-	// Generate client private key
-	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// sealEnrollmentPayload encrypts plaintext to the agent's X25519 public key.
+// The AES key is HKDF-SHA256(ECDH, salt=SHA256(install token), info="ultaai-enroll-v2|<vps_id>"),
+// so the response is only usable by the holder of both the ephemeral key and the token.
+func sealEnrollmentPayload(agentPub *ecdh.PublicKey, installToken, vpsID string, plaintext []byte) (EnrollmentEnvelope, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
 	if err != nil {
-		return nil, nil, err
-	}
-
-	clientCertTmpl := &x509.Certificate{
-		SerialNumber: big.NewInt(time.Now().UnixNano()),
-		Subject: pkix.Name{
-			CommonName: commonName,
-		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(365 * 24 * time.Hour), // 1 year validity
-
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
+		return EnrollmentEnvelope{}, err
 	}
-
-	certDER, err := x509.CreateCertificate(rand.Reader, clientCertTmpl, caCert, &clientKey.PublicKey, caKey)
+	shared, err := eph.ECDH(agentPub)
 	if err != nil {
-		return nil, nil, err
+		return EnrollmentEnvelope{}, err
 	}
 
-	// Encode private key to PEM
-	keyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(clientKey),
-	})
-
-	// Encode cert to PEM
-	certPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certDER,
-	})
+	info := []byte(enrollInfoPrefix + vpsID)
+	salt := sha256.Sum256([]byte(installToken))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt[:], info), key); err != nil {
+		return EnrollmentEnvelope{}, err
+	}
 
-	return certPEM, keyPEM, nil
+	sealed, err := encryptAESGCM(key, plaintext, info)
+	if err != nil {
+		return EnrollmentEnvelope{}, err
+	}
+	nonceSize := 12 // AES-GCM standard nonce, prefixed by encryptAESGCM
+	return EnrollmentEnvelope{
+		Version:    EnrollPayloadVersion,
+		Alg:        enrollPayloadAlg,
+		EPK:        base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes()),
+		Nonce:      base64.StdEncoding.EncodeToString(sealed[:nonceSize]),
+		Ciphertext: base64.StdEncoding.EncodeToString(sealed[nonceSize:]),
+	}, nil
 }
 
-func ProceedCerts(vpsID string) (map[string]string, []byte, []byte, error) {
+// IssueAgentCert signs the agent's CSR with the gateway CA. The CSR must carry
+// CN "Agent_<vpsID>" and satisfy the key policy; the agent keeps its private key.
+func IssueAgentCert(vpsID string, csrPEM []byte) ([]byte, error) {
 	path := "./certs"
-	caCert, caKey, err := loadCA(path, path)
+	caCert, caKey, err := utils.LoadCA(path, path)
 	if err != nil {
-		fmt.Println("Error: ", err)
-		// panic(err)
+		return nil, fmt.Errorf("load CA: %w", err)
 	}
 
 	clientCN := "Agent_" + vpsID
-
-	clientCertPEM, clientKeyPEM, err := generateClientCert(caCert, caKey, clientCN)
+	csr, err := utils.ParseAgentCSR(csrPEM, clientCN)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	fmt.Println("Generated client certificate and key for:", clientCN)
-
-	keys := map[string]string{
-		"cert": string(clientCertPEM),
-		"key":  string(clientKeyPEM),
+	certPEM, _, err := utils.SignAgentCSR(caCert, caKey, csr)
+	if err != nil {
+		return nil, fmt.Errorf("sign CSR: %w", err)
 	}
 
-	return keys, clientCertPEM, clientKeyPEM, nil
-
+	log.Printf("Issued client certificate from CSR for: %s", clientCN)
+	return certPEM, nil
 }
 
-// Encrypt data with AES-GCM symmetric key
-func encryptAESGCM(key, plaintext []byte) ([]byte, error) {
+// Encrypt data with AES-GCM symmetric key; output is nonce||ciphertext
+func encryptAESGCM(key, plaintext, aad []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -146,7 +121,7 @@ func encryptAESGCM(key, plaintext []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, aad)
 	return ciphertext, nil
 }
 
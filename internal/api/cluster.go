@@ -0,0 +1,80 @@
+// internal/api/cluster.go
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/utils"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxClusterBody = 2 << 20
+
+// ClusterMiddleware admits only requests signed by another gateway node with
+// CLUSTER_SECRET. The internal endpoints are disabled on a single node.
+func ClusterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.AppConfig.Clustered() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "cluster endpoints disabled"})
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxClusterBody))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read body"})
+			return
+		}
+		node := c.GetHeader(utils.ClusterNodeHeader)
+		err = utils.VerifyClusterRequest(config.AppConfig.ClusterSecret, node,
+			c.GetHeader(utils.ClusterTimestampHeader), c.Request.Method, c.Request.URL.Path,
+			body, c.GetHeader(utils.ClusterSignatureHeader))
+		if err != nil {
+			log.Printf("cluster request from %q rejected: %v", node, err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid cluster signature"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Set("cluster_node", node)
+		c.Next()
+	}
+}
+
+// HandleClusterDeliver queues a message forwarded by the node that received it.
+// 409 tells the sender the agent is no longer here so it buffers the message itself.
+func HandleClusterDeliver(c *gin.Context) {
+	var req websocket.ClusterDelivery
+	if err := c.ShouldBindJSON(&req); err != nil || req.CommonName == "" || len(req.Payload) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "common_name and payload are required"})
+		return
+	}
+	if err := websocket.DeliverLocal(req); err != nil {
+		if errors.Is(err, websocket.ErrAgentNotHere) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "queued"})
+}
+
+// HandleClusterTaskResult wakes the local waiter of a result the agent returned
+// to another node. That node has already checked the sender and signature.
+func HandleClusterTaskResult(c *gin.Context) {
+	var tr websocket.TaskResult
+	if err := json.NewDecoder(c.Request.Body).Decode(&tr); err != nil || tr.TaskID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid task_result"})
+		return
+	}
+	if !websocket.ResolveForwardedResult(tr) {
+		c.JSON(http.StatusConflict, gin.H{"error": "no pending task " + tr.TaskID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "delivered"})
+}
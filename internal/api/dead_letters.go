@@ -0,0 +1,78 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleListDeadLetters lists tasks that used up their retries, newest first.
+// Args may hold secrets and are left out; only their count is shown. Query: vps_id, include_redriven (1 to include re-driven ones), limit (<=1000).
+func HandleListDeadLetters(c *gin.Context) {
+	f := models.DeadLetterFilter{
+		VPSID:           c.Query("vps_id"),
+		IncludeRedriven: c.Query("include_redriven") == "1",
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		f.Limit = n
+	}
+
+	letters, err := models.ListDeadLetters(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load dead letters"})
+		return
+	}
+
+	out := make([]gin.H, 0, len(letters))
+	for _, d := range letters {
+		entry := gin.H{
+			"id":           d.ID,
+			"root_task_id": d.RootTaskID,
+			"task_id":      d.TaskID,
+			"vps_id":       d.VPSID,
+			"task":         d.TaskName,
+			"arg_count":    len(d.Args),
+			"attempts":     d.Attempts,
+			"exit_code":    d.ExitCode,
+			"last_error":   d.LastError,
+			"created_at":   d.CreatedAt.UTC(),
+		}
+		if !d.RedrivenAt.IsZero() {
+			entry["redriven_at"] = d.RedrivenAt.UTC()
+			entry["redriven_task_id"] = d.RedrivenTaskID
+		}
+		out = append(out, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"dead_letters": out})
+}
+
+// HandleRedriveDeadLetter sends a dead-lettered task again as a new task.
+func HandleRedriveDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	taskID, err := websocket.RedriveDeadLetter(id)
+	switch {
+	case errors.Is(err, websocket.ErrDeadLetterNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, websocket.ErrDeadLetterRedriven):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "task_id": taskID})
+}
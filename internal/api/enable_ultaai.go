@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+	"ultahost-ai-gateway/internal/pkg/models"
 	"ultahost-ai-gateway/internal/utils"
 
 	"github.com/gin-gonic/gin"
@@ -42,6 +43,12 @@ func HandleEnableUltaAI(c *gin.Context) {
 	fmt.Println("------------------")
 
 	utils.SaveInstallToken(token, req.UserID, req.VPSID, 15*time.Minute)
+	models.RecordAudit(models.AuditEntry{
+		UserID:   models.AuditEntityID(req.UserID),
+		Action:   "install_token_issued",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(req.VPSID),
+	})
 
 	curlCmd := fmt.Sprintf(
 		`curl -s https://193.109.193.72/install.sh | bash -s -- --token=%s`,
@@ -46,7 +46,7 @@ func HandleChat(c *gin.Context) {
 	switch category {
 	case "vps", "vm_command", "server_metrics", "wordpress":
 		
-		resp, err := agents.HandleVPS(req, agents.VPSFunctionList)
+		resp, err := agents.HandleVPS(c.Request.Context(), req, agents.SupportedVPSFunctions(req.VPSID))
 		if err != nil {
 			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
 			return
@@ -0,0 +1,43 @@
+// internal/api/middleware_admin.go
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"ultahost-ai-gateway/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminMiddleware guards operator endpoints (audit, security, PKI admin)
+// with the static ADMIN_TOKEN. If no token is configured the endpoints are disabled.
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expected := config.AppConfig.AdminToken
+		if expected == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "admin endpoints disabled"})
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			token = c.GetHeader("X-Admin-Token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+
+		c.Set("admin", true)
+		c.Next()
+	}
+}
+
+// adminActor names the operator behind an admin request for audit records.
+func adminActor(c *gin.Context) string {
+	if who := c.GetHeader("X-Admin-User"); who != "" {
+		return who
+	}
+	return "admin"
+}
@@ -6,6 +6,7 @@ import (
 	"ultahost-ai-gateway/internal/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 // InstallTokenMiddleware checks install token validity
@@ -18,20 +19,27 @@ func InstallTokenMiddleware() gin.HandlerFunc {
 
 		var body utils.TokenData
 
-		// Parse JSON body first
-		if err := c.ShouldBindJSON(&body); err != nil {
+		// Parse JSON body first (kept in the context so the handler can bind it again)
+		if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid install_token"})
 			c.Abort()
 			return
 		}
 
-		// Verify & consume token
-		_, ok := utils.ConsumeInstallToken(body.Token)
+		// Verify token; the handler consumes it once the CSR is accepted
+		stored, ok := utils.LookupInstallToken(body.Token)
 		if !ok {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 			c.Abort()
 			return
 		}
+		// The token is bound to the VPS it was issued for; the CSR CN is checked against it.
+		if stored.VPSID != body.VPSID {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "install token not issued for this vps_id"})
+			c.Abort()
+			return
+		}
+		body.UserID = stored.UserID
 
 		// fmt.Println("----vpsid: ", tokenData.VPSID)
 		// Store data for handler use
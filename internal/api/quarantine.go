@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleListQuarantine lists quarantined agent identities.
+func HandleListQuarantine(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"quarantined": websocket.QuarantineList()})
+}
+
+// HandleQuarantineAgent quarantines an agent manually.
+func HandleQuarantineAgent(c *gin.Context) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	_ = c.ShouldBindJSON(&body)
+	if body.Reason == "" {
+		body.Reason = "manual quarantine"
+	}
+
+	vpsId := c.Param("vpsId")
+	if err := websocket.QuarantineAgent("Agent_"+vpsId, body.Reason, c.ClientIP()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	models.RecordAudit(models.AuditEntry{
+		Action:   "agent_quarantined",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(vpsId),
+		Details:  "by=" + adminActor(c) + " reason=" + body.Reason,
+	})
+	c.JSON(http.StatusOK, gin.H{"status": "quarantined"})
+}
+
+// HandleReleaseQuarantine lifts a quarantine; held messages are delivered on the next connect.
+func HandleReleaseQuarantine(c *gin.Context) {
+	vpsId := c.Param("vpsId")
+	actor := adminActor(c)
+	if err := websocket.ReleaseQuarantine("Agent_"+vpsId, actor); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	models.RecordAudit(models.AuditEntry{
+		Action:   "agent_quarantine_released",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(vpsId),
+		Details:  "by=" + actor,
+	})
+	c.JSON(http.StatusOK, gin.H{"status": "released"})
+}
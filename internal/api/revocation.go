@@ -0,0 +1,225 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+const crlPath = "./certs/ca.crl"
+
+var (
+	crlMu     sync.Mutex
+	crlPEM    []byte
+	crlExpiry time.Time
+)
+
+type RevokeRequest struct {
+	VPSID       string `json:"vps_id"`
+	Serial      string `json:"serial"`
+	Fingerprint string `json:"fingerprint"`
+	Reason      string `json:"reason"`
+}
+
+// LoadRevocations restores the certificate deny-list from the database at startup.
+func LoadRevocations() error {
+	rows, err := models.ListRevokedCertificates()
+	if err != nil {
+		return err
+	}
+	for _, rc := range rows {
+		utils.RevokeCert(utils.RevokedCert{
+			Serial:            rc.Serial,
+			FingerprintSHA256: rc.FingerprintSHA256,
+			CommonName:        rc.CommonName,
+			Reason:            rc.Reason,
+			RevokedAt:         rc.RevokedAt,
+		})
+	}
+	return nil
+}
+
+// SyncRevocations adopts revocations recorded by another node: the deny-list is
+// re-read, the CRL regenerated and the revoked agent's connection here dropped.
+func SyncRevocations(cn string) error {
+	if err := LoadRevocations(); err != nil {
+		return err
+	}
+	invalidateCRL()
+	if cn != "" {
+		websocket.DisconnectAgent(cn)
+	}
+	return nil
+}
+
+// certIdentity extracts serial (hex) and fingerprint from a base64-encoded PEM as kept in AgentKeys.
+func certIdentity(certB64 string) (serial, fingerprint string, err error) {
+	certPEM, err := base64.StdEncoding.DecodeString(certB64)
+	if err != nil {
+		return "", "", err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", "", fmt.Errorf("invalid cert PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return cert.SerialNumber.Text(16), hex.EncodeToString(sum[:]), nil
+}
+
+// HandleRevokeCert revokes an agent certificate by VPS ID, serial or fingerprint,
+// drops the live connection and regenerates the CRL.
+func HandleRevokeCert(c *gin.Context) {
+	var req RevokeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.VPSID == "" && req.Serial == "" && req.Fingerprint == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "one of vps_id, serial or fingerprint is required"})
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "unspecified"
+	}
+
+	rc := utils.RevokedCert{
+		Serial:            utils.NormalizeSerial(req.Serial),
+		FingerprintSHA256: strings.ToLower(req.Fingerprint),
+		Reason:            req.Reason,
+		RevokedAt:         time.Now().UTC(),
+	}
+
+	// Resolve the enrolled certificate so both serial and fingerprint are denied.
+	cn, keys, found := utils.FindAgentKeys(func(cn string, k utils.AgentKeys) bool {
+		switch {
+		case req.VPSID != "":
+			return cn == "Agent_"+req.VPSID
+		case rc.FingerprintSHA256 != "":
+			return k.FingerprintSHA256 == rc.FingerprintSHA256
+		default:
+			serial, _, err := certIdentity(k.Certificate)
+			return err == nil && utils.NormalizeSerial(serial) == rc.Serial
+		}
+	})
+	if req.VPSID != "" && !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no enrolled certificate for vps_id"})
+		return
+	}
+	if found {
+		rc.CommonName = cn
+		if serial, fp, err := certIdentity(keys.Certificate); err == nil {
+			rc.Serial, rc.FingerprintSHA256 = utils.NormalizeSerial(serial), fp
+		}
+	}
+
+	if err := models.InsertRevokedCertificate(models.RevokedCertificate{
+		Serial:            rc.Serial,
+		FingerprintSHA256: rc.FingerprintSHA256,
+		CommonName:        rc.CommonName,
+		Reason:            rc.Reason,
+		RevokedAt:         rc.RevokedAt,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to persist revocation"})
+		return
+	}
+	utils.RevokeCert(rc)
+	invalidateCRL()
+
+	if rc.CommonName != "" {
+		websocket.DisconnectAgent(rc.CommonName)
+	}
+	models.RecordAudit(models.AuditEntry{
+		Action:   "certificate_revoked",
+		Entity:   "certificate",
+		EntityID: models.AuditEntityID(strings.TrimPrefix(rc.CommonName, "Agent_")),
+		Details:  fmt.Sprintf("by=%s cn=%s serial=%s fingerprint=%s reason=%s", adminActor(c), rc.CommonName, rc.Serial, rc.FingerprintSHA256, rc.Reason),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked", "revocation": rc})
+}
+
+// HandleListRevoked lists the deny-list.
+func HandleListRevoked(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"revoked": utils.ListRevokedCerts()})
+}
+
+// HandleCRL serves the CA-signed CRL (PEM). Public: agents and proxies fetch it unauthenticated.
+func HandleCRL(c *gin.Context) {
+	crl, err := currentCRL()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate CRL", "details": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/pkix-crl", crl)
+}
+
+func invalidateCRL() {
+	crlMu.Lock()
+	crlPEM = nil
+	crlMu.Unlock()
+	if _, err := currentCRL(); err != nil {
+		log.Printf("CRL regeneration failed: %v", err)
+	}
+}
+
+// currentCRL returns the cached CRL, regenerating it when invalidated or close to NextUpdate.
+func currentCRL() ([]byte, error) {
+	crlMu.Lock()
+	defer crlMu.Unlock()
+	if crlPEM != nil && time.Until(crlExpiry) > time.Hour {
+		return crlPEM, nil
+	}
+
+	caCert, caKey, err := utils.LoadCA("./certs", "./certs")
+	if err != nil {
+		return nil, err
+	}
+	if caCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		// The listener deny-list still applies; only CRL publication needs the bit.
+		return nil, fmt.Errorf("CA certificate lacks the cRLSign key usage; reissue certs/ca.crt with keyUsage=keyCertSign,cRLSign to publish a CRL")
+	}
+
+	now := time.Now().UTC()
+	var entries []x509.RevocationListEntry
+	for _, rc := range utils.ListRevokedCerts() {
+		serial, ok := new(big.Int).SetString(rc.Serial, 16)
+		if !ok {
+			continue // fingerprint-only entries are enforced by the listener, not the CRL
+		}
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: rc.RevokedAt})
+	}
+
+	tmpl := &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(24 * time.Hour),
+		RevokedCertificateEntries: entries,
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	crlPEM = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	crlExpiry = tmpl.NextUpdate
+	if err := os.WriteFile(crlPath, crlPEM, 0644); err != nil {
+		log.Printf("CRL write failed: %v", err)
+	}
+	return crlPEM, nil
+}
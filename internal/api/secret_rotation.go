@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+type rotateSecretRequest struct {
+	Reason string `json:"reason"`
+}
+
+// HandleRotateAgentSecret rotates one agent's signature secret. Offline agents rotate on their next connect.
+func HandleRotateAgentSecret(c *gin.Context) {
+	var body rotateSecretRequest
+	_ = c.ShouldBindJSON(&body)
+	if body.Reason == "" {
+		body.Reason = "manual rotation"
+	}
+
+	vpsId := c.Param("vpsId")
+	if _, ok := utils.GetAgentKeys("Agent_" + vpsId); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "agent not enrolled"})
+		return
+	}
+	sent, err := websocket.RotateAgentSecret("Agent_"+vpsId, body.Reason)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	models.RecordAudit(models.AuditEntry{
+		Action:   "secret_rotation_requested",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(vpsId),
+		Details:  "by=" + adminActor(c) + " reason=" + body.Reason,
+	})
+
+	status := "rotating"
+	if !sent {
+		status = "pending_connect"
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": status})
+}
+
+// HandleRotateAllSecrets forces a rotation of every enrolled agent, e.g. after an incident.
+func HandleRotateAllSecrets(c *gin.Context) {
+	var body rotateSecretRequest
+	_ = c.ShouldBindJSON(&body)
+	if body.Reason == "" {
+		body.Reason = "fleet-wide rotation"
+	}
+
+	rotating, deferred := 0, 0
+	failed := map[string]string{}
+	for _, cn := range utils.AgentCommonNames() {
+		sent, err := websocket.RotateAgentSecret(cn, body.Reason)
+		switch {
+		case err != nil:
+			failed[cn] = err.Error()
+		case sent:
+			rotating++
+		default:
+			deferred++
+		}
+	}
+	models.RecordAudit(models.AuditEntry{
+		Action:  "secret_rotation_fleet",
+		Entity:  "fleet",
+		Details: "by=" + adminActor(c) + " reason=" + body.Reason,
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"rotating": rotating, "pending_connect": deferred, "failed": failed})
+}
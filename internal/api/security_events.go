@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleListSecurityEvents lists recorded security events, newest first.
+// Query: type, severity, agent (CN or vps id), since (RFC3339), limit (<=1000).
+func HandleListSecurityEvents(c *gin.Context) {
+	f := models.SecurityEventFilter{
+		EventType: c.Query("type"),
+		Severity:  c.Query("severity"),
+		AgentName: c.Query("agent"),
+	}
+	if _, err := strconv.Atoi(f.AgentName); err == nil {
+		f.AgentName = "Agent_" + f.AgentName
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be RFC3339"})
+			return
+		}
+		f.Since = t
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		f.Limit = n
+	}
+
+	events, err := models.ListSecurityEvents(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load security events"})
+		return
+	}
+
+	out := make([]gin.H, 0, len(events))
+	for _, ev := range events {
+		out = append(out, gin.H{
+			"id":          ev.ID,
+			"type":        ev.EventType,
+			"severity":    ev.Severity,
+			"agent":       ev.AgentName,
+			"remote_addr": ev.RemoteAddr,
+			"description": ev.Description,
+			"timestamp":   ev.Timestamp.UTC(),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"events": out})
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+var taskKeyRotateMu sync.Mutex
+
+// LoadTaskSigningKeys restores the gateway task-signing keys, creating the first one on a fresh install.
+func LoadTaskSigningKeys() error {
+	keys, err := models.LoadTaskSigningKeys()
+	if err != nil {
+		return err
+	}
+	utils.SetTaskSigningKeys(keys)
+	if _, ok := utils.ActiveTaskSigningKey(); ok {
+		return nil
+	}
+
+	k, err := utils.GenerateTaskSigningKey()
+	if err != nil {
+		return err
+	}
+	if err := models.SaveTaskSigningKey(k); err != nil {
+		return err
+	}
+	utils.SetTaskSigningKeys(append(keys, k))
+	log.Printf("Generated task signing key %s", k.KeyID)
+	models.RecordAudit(models.AuditEntry{
+		Action:  "task_signing_key_generated",
+		Entity:  "pki",
+		Details: "kid=" + k.KeyID,
+	})
+	return nil
+}
+
+// HandleTaskSigningKeys publishes the task-signing public keys. Public, like the CRL:
+// agents verify them against the set received at enrollment.
+func HandleTaskSigningKeys(c *gin.Context) {
+	active, _ := utils.ActiveTaskSigningKey()
+	c.JSON(http.StatusOK, gin.H{"active_kid": active.KeyID, "keys": utils.PublishedTaskSigningKeys()})
+}
+
+// HandleRotateTaskSigningKey creates a new active key and retires the previous one.
+// The retired key stays published for the overlap window so queued tasks still verify.
+func HandleRotateTaskSigningKey(c *gin.Context) {
+	taskKeyRotateMu.Lock()
+	defer taskKeyRotateMu.Unlock()
+
+	next, err := utils.GenerateTaskSigningKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.SaveTaskSigningKey(next); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to persist signing key"})
+		return
+	}
+
+	now := time.Now().UTC()
+	keys := utils.TaskSigningKeys()
+	var retired []string
+	for i := range keys {
+		if keys[i].RetiredAt.IsZero() {
+			keys[i].RetiredAt = now
+			if err := models.SaveTaskSigningKey(keys[i]); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retire signing key " + keys[i].KeyID})
+				return
+			}
+			retired = append(retired, keys[i].KeyID)
+		}
+	}
+	utils.SetTaskSigningKeys(append(keys, next))
+	notified := websocket.BroadcastTaskSigningKeys()
+
+	models.RecordAudit(models.AuditEntry{
+		Action:  "task_signing_key_rotated",
+		Entity:  "pki",
+		Details: fmt.Sprintf("by=%s kid=%s retired=%v notified=%d", adminActor(c), next.KeyID, retired, notified),
+	})
+	c.JSON(http.StatusOK, gin.H{"active_kid": next.KeyID, "retired": retired, "agents_notified": notified})
+}
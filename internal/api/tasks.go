@@ -0,0 +1,48 @@
+// internal/api/tasks.go
+package api
+
+import (
+	"errors"
+	"net/http"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleCancelTask cancels a dispatched task. 200 with status "cancelled" means
+// it never reached the agent; "cancel_requested" means the agent was asked to
+// stop it and the task record turns "cancelled" when the agent confirms.
+// Admin only: task records carry no owner to check a customer against.
+func HandleCancelTask(c *gin.Context) {
+	taskID := c.Param("taskId")
+	reason := c.DefaultQuery("reason", "cancelled by "+adminActor(c))
+	status, err := websocket.CancelTask(taskID, reason)
+	switch {
+	case errors.Is(err, websocket.ErrTaskNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, websocket.ErrTaskFinished), errors.Is(err, websocket.ErrCancelUnsupported):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"task_id": taskID, "status": status})
+}
+
+// HandleTaskQueue lists the tasks running or waiting on an agent across the
+// cluster; waiting tasks carry their position in the queue. Admin only, like
+// HandleCancelTask.
+func HandleTaskQueue(c *gin.Context) {
+	vpsId := c.Param("vpsId")
+	tasks, err := websocket.AgentTaskQueue(vpsId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tasks == nil {
+		tasks = []websocket.QueuedTask{}
+	}
+	c.JSON(http.StatusOK, gin.H{"vps_id": vpsId, "tasks": tasks})
+}
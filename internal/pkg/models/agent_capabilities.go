@@ -0,0 +1,59 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+)
+
+// SaveAgentCapabilities upserts what an agent reported in its last hello.
+func SaveAgentCapabilities(ac AgentCapabilities) error {
+	caps, err := json.Marshal(ac.Capabilities)
+	if err != nil {
+		return err
+	}
+	tasks, err := json.Marshal(ac.Tasks)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec(`INSERT INTO agent_capabilities (common_name, agent_version, os, arch, protocol_version,
+			capabilities, tasks, chroot, cgroup, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (common_name) DO UPDATE SET
+			agent_version = EXCLUDED.agent_version,
+			os = EXCLUDED.os,
+			arch = EXCLUDED.arch,
+			protocol_version = EXCLUDED.protocol_version,
+			capabilities = EXCLUDED.capabilities,
+			tasks = EXCLUDED.tasks,
+			chroot = EXCLUDED.chroot,
+			cgroup = EXCLUDED.cgroup,
+			updated_at = EXCLUDED.updated_at`,
+		ac.CommonName, ac.AgentVersion, ac.OS, ac.Arch, ac.ProtocolVersion,
+		string(caps), string(tasks), ac.Chroot, ac.Cgroup, time.Now().UTC())
+	return err
+}
+
+// GetAgentCapabilities returns the last hello of an agent; ok is false if it never sent one.
+func GetAgentCapabilities(commonName string) (ac AgentCapabilities, ok bool, err error) {
+	var caps, tasks string
+	err = db.DB.QueryRow(`SELECT common_name, agent_version, os, arch, protocol_version,
+			capabilities, tasks, chroot, cgroup, updated_at
+		FROM agent_capabilities WHERE common_name = $1`, commonName).
+		Scan(&ac.CommonName, &ac.AgentVersion, &ac.OS, &ac.Arch, &ac.ProtocolVersion,
+			&caps, &tasks, &ac.Chroot, &ac.Cgroup, &ac.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ac, false, nil
+	}
+	if err != nil {
+		return ac, false, err
+	}
+	if err := json.Unmarshal([]byte(caps), &ac.Capabilities); err != nil {
+		return ac, false, err
+	}
+	if err := json.Unmarshal([]byte(tasks), &ac.Tasks); err != nil {
+		return ac, false, err
+	}
+	return ac, true, nil
+}
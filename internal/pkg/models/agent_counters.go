@@ -0,0 +1,62 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+)
+
+// GetAgentHighWater returns the highest envelope sequence accepted from an agent (0 if none yet).
+func GetAgentHighWater(commonName string) (uint64, error) {
+	var hw int64
+	err := db.DB.QueryRow(`SELECT high_water FROM agent_counters WHERE common_name = $1`, commonName).Scan(&hw)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return uint64(hw), err
+}
+
+// AdvanceAgentHighWater moves the counter to seq only if seq is higher, atomically,
+// so two gateway processes cannot both accept the same sequence number.
+// advanced is false when seq was not above the stored value.
+func AdvanceAgentHighWater(commonName string, seq uint64) (advanced bool, err error) {
+	var hw int64
+	err = db.DB.QueryRow(`INSERT INTO agent_counters (common_name, high_water, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (common_name) DO UPDATE
+		SET high_water = EXCLUDED.high_water, updated_at = EXCLUDED.updated_at
+		WHERE agent_counters.high_water < EXCLUDED.high_water
+		RETURNING high_water`,
+		commonName, int64(seq), time.Now().UTC()).Scan(&hw)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NextDeliverySeq allocates the next delivery sequence number for an agent. The
+// epoch is fixed when the agent's counter row is created; a new epoch (the row
+// was recreated) tells the agent to forget the sequence numbers it has seen.
+func NextDeliverySeq(commonName, newEpoch string) (epoch string, seq uint64, err error) {
+	var n int64
+	err = db.DB.QueryRow(`INSERT INTO agent_counters (common_name, high_water, delivery_epoch, delivery_seq, updated_at)
+		VALUES ($1, 0, $2, 1, $3)
+		ON CONFLICT (common_name) DO UPDATE
+		SET delivery_seq = agent_counters.delivery_seq + 1,
+			delivery_epoch = COALESCE(agent_counters.delivery_epoch, EXCLUDED.delivery_epoch),
+			updated_at = EXCLUDED.updated_at
+		RETURNING delivery_epoch, delivery_seq`,
+		commonName, newEpoch, time.Now().UTC()).Scan(&epoch, &n)
+	return epoch, uint64(n), err
+}
+
+// CurrentDeliverySeq returns the last delivery sequence number allocated for an
+// agent (0 if none yet).
+func CurrentDeliverySeq(commonName string) (uint64, error) {
+	var n sql.NullInt64
+	err := db.DB.QueryRow(`SELECT delivery_seq FROM agent_counters WHERE common_name = $1`, commonName).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return uint64(n.Int64), err
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+	"ultahost-ai-gateway/internal/utils"
+)
+
+// secretAAD binds a sealed column value to its row and column.
+func secretAAD(commonName, column string) string {
+	return "agent_keys|" + commonName + "|" + column
+}
+
+// SaveAgentKeyRecord upserts an agent's keys; the signature secret is sealed
+// with the active KEK and never written in plaintext.
+func SaveAgentKeyRecord(commonName string, k utils.AgentKeys) error {
+	sealed, err := utils.SealSecret([]byte(k.SignatureSecret), secretAAD(commonName, "signature_secret"))
+	if err != nil {
+		return fmt.Errorf("seal signature secret: %w", err)
+	}
+
+	var sealedPending string
+	if k.PendingSignatureSecret != "" {
+		sealedPending, err = utils.SealSecret([]byte(k.PendingSignatureSecret), secretAAD(commonName, "pending_signature_secret"))
+		if err != nil {
+			return fmt.Errorf("seal pending secret: %w", err)
+		}
+	}
+
+	_, err = db.DB.Exec(`INSERT INTO agent_keys (common_name, identity_token, signature_secret, fingerprint_sha256,
+			certificate, previous_fingerprint, previous_fingerprint_until, key_id,
+			pending_signature_secret, pending_rotation_id, pending_secret_until, rotate_on_connect, task_sig_alg, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (common_name) DO UPDATE SET
+			identity_token = EXCLUDED.identity_token,
+			signature_secret = EXCLUDED.signature_secret,
+			fingerprint_sha256 = EXCLUDED.fingerprint_sha256,
+			certificate = EXCLUDED.certificate,
+			previous_fingerprint = EXCLUDED.previous_fingerprint,
+			previous_fingerprint_until = EXCLUDED.previous_fingerprint_until,
+			key_id = EXCLUDED.key_id,
+			pending_signature_secret = EXCLUDED.pending_signature_secret,
+			pending_rotation_id = EXCLUDED.pending_rotation_id,
+			pending_secret_until = EXCLUDED.pending_secret_until,
+			rotate_on_connect = EXCLUDED.rotate_on_connect,
+			task_sig_alg = EXCLUDED.task_sig_alg,
+			updated_at = EXCLUDED.updated_at`,
+		commonName, k.IdentityToken, sealed, k.FingerprintSHA256,
+		k.Certificate, k.PreviousFingerprintSHA256, nullTime(k.PreviousFingerprintUntil), utils.ActiveKeyID(),
+		sealedPending, k.PendingRotationID, nullTime(k.PendingSecretUntil), k.RotateOnConnect, k.TaskSigAlgorithm(), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return NotifyCluster(ChannelAgentKeys, commonName)
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// LoadAgentKeyRecords reads and decrypts every persisted agent identity.
+func LoadAgentKeyRecords() (map[string]utils.AgentKeys, error) {
+	return loadAgentKeyRecords(`common_name IS NOT NULL`)
+}
+
+// LoadAgentKeyRecord reads one identity, e.g. one enrolled or rotated on another gateway node.
+func LoadAgentKeyRecord(commonName string) (utils.AgentKeys, bool, error) {
+	out, err := loadAgentKeyRecords(`common_name = $1`, commonName)
+	if err != nil {
+		return utils.AgentKeys{}, false, err
+	}
+	k, ok := out[commonName]
+	return k, ok, nil
+}
+
+func loadAgentKeyRecords(where string, args ...interface{}) (map[string]utils.AgentKeys, error) {
+	rows, err := db.DB.Query(`SELECT common_name, identity_token, signature_secret, fingerprint_sha256,
+			COALESCE(certificate, ''), COALESCE(previous_fingerprint, ''), previous_fingerprint_until,
+			COALESCE(pending_signature_secret, ''), COALESCE(pending_rotation_id, ''), pending_secret_until,
+			COALESCE(rotate_on_connect, FALSE), COALESCE(task_sig_alg, '')
+		FROM agent_keys WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]utils.AgentKeys{}
+	for rows.Next() {
+		var (
+			cn, sealed, sealedPending string
+			k                         utils.AgentKeys
+			prevUntil, pendingUntil   sql.NullTime
+		)
+		if err := rows.Scan(&cn, &k.IdentityToken, &sealed, &k.FingerprintSHA256,
+			&k.Certificate, &k.PreviousFingerprintSHA256, &prevUntil,
+			&sealedPending, &k.PendingRotationID, &pendingUntil, &k.RotateOnConnect, &k.TaskSigAlg); err != nil {
+			return nil, err
+		}
+		secret, err := utils.OpenSecret(sealed, secretAAD(cn, "signature_secret"))
+		if err != nil {
+			return nil, fmt.Errorf("open signature secret of %s: %w", cn, err)
+		}
+		k.SignatureSecret = string(secret)
+		if sealedPending != "" {
+			pending, err := utils.OpenSecret(sealedPending, secretAAD(cn, "pending_signature_secret"))
+			if err != nil {
+				return nil, fmt.Errorf("open pending secret of %s: %w", cn, err)
+			}
+			k.PendingSignatureSecret = string(pending)
+		}
+		k.PreviousFingerprintUntil = prevUntil.Time
+		k.PendingSecretUntil = pendingUntil.Time
+		out[cn] = k
+	}
+	return out, rows.Err()
+}
+
+// RekeyAgentKeyRecords re-wraps every sealed secret under the active KEK and
+// seals any legacy plaintext values. It returns the number of rows rewritten.
+func RekeyAgentKeyRecords() (int, error) {
+	rows, err := db.DB.Query(`SELECT common_name, signature_secret, COALESCE(pending_signature_secret, '')
+		FROM agent_keys WHERE common_name IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	type row struct{ cn, secret, pending string }
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.cn, &r.secret, &r.pending); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, r := range all {
+		secret, changed, err := resealColumn(r.secret, secretAAD(r.cn, "signature_secret"))
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", r.cn, err)
+		}
+		pending, pendingChanged, err := resealColumn(r.pending, secretAAD(r.cn, "pending_signature_secret"))
+		if err != nil {
+			return n, fmt.Errorf("%s pending: %w", r.cn, err)
+		}
+		if !changed && !pendingChanged {
+			continue
+		}
+		if _, err := db.DB.Exec(`UPDATE agent_keys SET signature_secret = $2, pending_signature_secret = $3, key_id = $4, updated_at = $5
+			WHERE common_name = $1`,
+			r.cn, secret, pending, utils.ActiveKeyID(), time.Now().UTC()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// resealColumn moves one stored value under the active KEK (sealing legacy plaintext).
+func resealColumn(v, aad string) (string, bool, error) {
+	if v == "" {
+		return "", false, nil
+	}
+	if utils.IsSealed(v) {
+		return utils.ResealSecret(v)
+	}
+	sealed, err := utils.SealSecret([]byte(v), aad)
+	return sealed, err == nil, err
+}
@@ -18,6 +18,9 @@ type AgentKey struct {
 	IdentityToken     string    `db:"identity_token"` // UNIQUE
 	SignatureSecret   string    `db:"signature_secret"`
 	FingerprintSHA256 string    `db:"fingerprint_sha256"` // UNIQUE
+	CommonName        string    `db:"common_name"`        // certificate CN, Agent_<vpsId>
+	Certificate       string    `db:"certificate"`        // base64 PEM of the current client cert
+	KeyID             string    `db:"key_id"`             // KEK id sealing signature_secret
 	CreatedAt         time.Time `db:"created_at"`
 	UpdatedAt         time.Time `db:"updated_at"` // in case of rotation
 }
@@ -41,3 +44,17 @@ type AgentHeartbeat struct {
 	Valid     bool      `db:"valid"`     // optional, if you want to mark invalid heartbeats
 	CreatedAt time.Time `db:"created_at"`
 }
+
+// Agent self-description from the hello handshake
+type AgentCapabilities struct {
+	CommonName      string    `db:"common_name"`
+	AgentVersion    string    `db:"agent_version"`
+	OS              string    `db:"os"`
+	Arch            string    `db:"arch"`
+	ProtocolVersion int       `db:"protocol_version"`
+	Capabilities    []string  `db:"capabilities"` // stored as JSON
+	Tasks           []string  `db:"tasks"`        // stored as JSON; allowlist names the agent can run
+	Chroot          bool      `db:"chroot"`
+	Cgroup          bool      `db:"cgroup"`
+	UpdatedAt       time.Time `db:"updated_at"`
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+)
+
+// auditChainLock is the pg advisory lock key serialising appends to the chain,
+// so concurrent writers (or gateway replicas) never fork it.
+const auditChainLock = 0x756c7461 // "ulta"
+
+// AuditEntry is what callers supply; seq, timestamp and hashes are assigned on append.
+type AuditEntry struct {
+	UserID   int
+	Action   string
+	Entity   string
+	EntityID int
+	Details  string
+}
+
+// AuditChainProblem describes one broken link found by VerifyAuditChain.
+type AuditChainProblem struct {
+	ID      int    `json:"id"`
+	Seq     int64  `json:"seq"`
+	Problem string `json:"problem"`
+}
+
+// AuditChainReport is the result of walking the whole chain.
+type AuditChainReport struct {
+	OK       bool                `json:"ok"`
+	Checked  int                 `json:"checked"`
+	HeadSeq  int64               `json:"head_seq"`
+	HeadHash string              `json:"head_hash"`
+	Problems []AuditChainProblem `json:"problems,omitempty"`
+}
+
+// auditHash is the canonical hash of an entry. Changing this breaks every existing chain.
+func auditHash(seq int64, userID int, action, entity string, entityID int, ts time.Time, details, prevHash string) string {
+	canon := strings.Join([]string{
+		"audit-v1",
+		strconv.FormatInt(seq, 10),
+		strconv.Itoa(userID),
+		action,
+		entity,
+		strconv.Itoa(entityID),
+		ts.UTC().Format(time.RFC3339Nano),
+		details,
+		prevHash,
+	}, "|")
+	sum := sha256.Sum256([]byte(canon))
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendAuditLog appends an entry to the hash-chained audit trail.
+func AppendAuditLog(e AuditEntry) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, auditChainLock); err != nil {
+		return err
+	}
+
+	var (
+		lastSeq  int64
+		prevHash string
+	)
+	err = tx.QueryRow(`SELECT seq, hash FROM audit_logs WHERE seq IS NOT NULL ORDER BY seq DESC LIMIT 1`).Scan(&lastSeq, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	seq := lastSeq + 1
+	// Postgres TIMESTAMP keeps microseconds; truncate so the hash survives a round trip.
+	ts := time.Now().UTC().Truncate(time.Microsecond)
+	hash := auditHash(seq, e.UserID, e.Action, e.Entity, e.EntityID, ts, e.Details, prevHash)
+
+	_, err = tx.Exec(`INSERT INTO audit_logs (user_id, action, entity, entity_id, timestamp, details, seq, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		e.UserID, e.Action, e.Entity, e.EntityID, ts, e.Details, seq, prevHash, hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordAudit is a best-effort wrapper for request paths that must not fail on audit errors.
+func RecordAudit(e AuditEntry) {
+	if err := AppendAuditLog(e); err != nil {
+		log.Printf("audit append failed (%s): %v", e.Action, err)
+	}
+}
+
+// AuditEntityID converts string ids (VPS ids arrive as strings) to entity_id; non-numeric ids map to 0.
+func AuditEntityID(id string) int {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ForEachAuditLog streams chained entries in order, starting after sinceSeq.
+func ForEachAuditLog(sinceSeq int64, fn func(AuditLog) error) error {
+	rows, err := db.DB.Query(`SELECT id, COALESCE(user_id, 0), action, COALESCE(entity, ''), COALESCE(entity_id, 0),
+			timestamp, COALESCE(details, ''), seq, COALESCE(prev_hash, ''), COALESCE(hash, '')
+		FROM audit_logs WHERE seq IS NOT NULL AND seq > $1 ORDER BY seq`, sinceSeq)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l AuditLog
+		if err := rows.Scan(&l.ID, &l.UserID, &l.Action, &l.Entity, &l.EntityID,
+			&l.Timestamp, &l.Details, &l.Seq, &l.PrevHash, &l.Hash); err != nil {
+			return err
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// VerifyAuditChain recomputes every hash and checks the links between entries.
+// A modified row fails its own hash; a deleted row shows up as a seq gap and a
+// prev_hash mismatch on its successor. Truncating the tail is only detectable
+// against an externally kept HeadHash, which is why it is reported.
+func VerifyAuditChain() (AuditChainReport, error) {
+	var (
+		report   AuditChainReport
+		expected int64 = 1
+		prevHash string
+	)
+
+	err := ForEachAuditLog(0, func(l AuditLog) error {
+		report.Checked++
+		if l.Seq != expected {
+			report.Problems = append(report.Problems, AuditChainProblem{
+				ID: l.ID, Seq: l.Seq,
+				Problem: fmt.Sprintf("sequence gap: expected %d (entries deleted)", expected),
+			})
+		}
+		if l.PrevHash != prevHash {
+			report.Problems = append(report.Problems, AuditChainProblem{
+				ID: l.ID, Seq: l.Seq, Problem: "prev_hash does not match previous entry",
+			})
+		}
+		if auditHash(l.Seq, l.UserID, l.Action, l.Entity, l.EntityID, l.Timestamp, l.Details, l.PrevHash) != l.Hash {
+			report.Problems = append(report.Problems, AuditChainProblem{
+				ID: l.ID, Seq: l.Seq, Problem: "hash mismatch (entry modified)",
+			})
+		}
+		expected = l.Seq + 1
+		prevHash = l.Hash
+		report.HeadSeq = l.Seq
+		report.HeadHash = l.Hash
+		return nil
+	})
+	if err != nil {
+		return AuditChainReport{}, err
+	}
+
+	report.OK = len(report.Problems) == 0
+	return report, nil
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/db"
+)
+
+// LISTEN/NOTIFY channels used to keep gateway replicas in sync.
+const (
+	ChannelAgentKeys         = "ultaai_agent_keys"         // payload: origin node | common name
+	ChannelTaskSigningKeys   = "ultaai_task_signing_keys"  // payload: origin node | kid
+	ChannelRevocations       = "ultaai_revocations"        // payload: origin node | common name (may be empty)
+	ChannelQuarantine        = "ultaai_quarantine"         // payload: origin node | agent name
+	ChannelQuarantineRelease = "ultaai_quarantine_release" // payload: origin node | agent name
+)
+
+// Which gateway node holds an agent's live connection
+type AgentConnection struct {
+	CommonName  string    `db:"common_name"`
+	NodeID      string    `db:"node_id"`
+	NodeAddr    string    `db:"node_addr"`
+	ConnectedAt time.Time `db:"connected_at"`
+	UpdatedAt   time.Time `db:"updated_at"` // refreshed while the node is alive
+}
+
+// Node that dispatched a task and is waiting for its result
+type TaskRoute struct {
+	TaskID     string    `db:"task_id"`
+	CommonName string    `db:"common_name"` // agent the task was sent to
+	NodeID     string    `db:"node_id"`
+	NodeAddr   string    `db:"node_addr"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// Agent slot leased by a node for a task it runs, so concurrency limits and
+// template locks hold across nodes
+type TaskSlotLease struct {
+	TaskID    string    `db:"task_id"`
+	VPSID     string    `db:"vps_id"`
+	Task      string    `db:"task"`
+	LockName  string    `db:"lock_name"`
+	NodeID    string    `db:"node_id"`
+	ExpiresAt time.Time `db:"expires_at"` // lease of a node that died lapses here
+	StartedAt time.Time `db:"started_at"` // set on the first claim
+}
+
+// NotifyCluster publishes a change to other replicas; the payload is prefixed
+// with this node's ID so the sender can ignore its own notification. No-op on
+// a single node.
+func NotifyCluster(channel, payload string) error {
+	if !config.AppConfig.Clustered() {
+		return nil
+	}
+	_, err := db.DB.Exec(`SELECT pg_notify($1, $2)`, channel, config.AppConfig.NodeID+"|"+payload)
+	return err
+}
+
+// ParseClusterNotification splits a NotifyCluster payload.
+func ParseClusterNotification(extra string) (node, payload string) {
+	node, payload, _ = strings.Cut(extra, "|")
+	return node, payload
+}
+
+// UpsertAgentConnection records that nodeID now holds the agent's connection.
+func UpsertAgentConnection(ac AgentConnection) error {
+	_, err := db.DB.Exec(`INSERT INTO agent_connections (common_name, node_id, node_addr, connected_at, updated_at)
+		VALUES ($1, $2, $3, $4, $4)
+		ON CONFLICT (common_name) DO UPDATE SET
+			node_id = EXCLUDED.node_id,
+			node_addr = EXCLUDED.node_addr,
+			connected_at = EXCLUDED.connected_at,
+			updated_at = EXCLUDED.updated_at`,
+		ac.CommonName, ac.NodeID, ac.NodeAddr, ac.ConnectedAt.UTC())
+	return err
+}
+
+// DeleteAgentConnection removes the entry only if it still describes this
+// connection, so a reconnect to another node is never erased.
+func DeleteAgentConnection(commonName, nodeID string, connectedAt time.Time) error {
+	_, err := db.DB.Exec(`DELETE FROM agent_connections WHERE common_name = $1 AND node_id = $2 AND connected_at = $3`,
+		commonName, nodeID, connectedAt.UTC())
+	return err
+}
+
+// TouchNodeConnections marks every entry of nodeID as fresh.
+func TouchNodeConnections(nodeID string) error {
+	_, err := db.DB.Exec(`UPDATE agent_connections SET updated_at = $2 WHERE node_id = $1`, nodeID, time.Now().UTC())
+	return err
+}
+
+// DeleteNodeConnections drops the entries of nodeID (startup after a crash).
+func DeleteNodeConnections(nodeID string) error {
+	_, err := db.DB.Exec(`DELETE FROM agent_connections WHERE node_id = $1`, nodeID)
+	return err
+}
+
+// LookupAgentConnection returns the holder of an agent's connection, ignoring
+// entries not refreshed within maxAge (their node is presumed dead).
+func LookupAgentConnection(commonName string, maxAge time.Duration) (AgentConnection, bool, error) {
+	var ac AgentConnection
+	err := db.DB.QueryRow(`SELECT common_name, node_id, node_addr, connected_at, updated_at
+		FROM agent_connections WHERE common_name = $1 AND updated_at > $2`,
+		commonName, time.Now().UTC().Add(-maxAge)).
+		Scan(&ac.CommonName, &ac.NodeID, &ac.NodeAddr, &ac.ConnectedAt, &ac.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ac, false, nil
+	}
+	return ac, err == nil, err
+}
+
+// InsertTaskRoute remembers which node waits for a task's result.
+func InsertTaskRoute(tr TaskRoute) error {
+	_, err := db.DB.Exec(`INSERT INTO task_routes (task_id, common_name, node_id, node_addr, created_at)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (task_id) DO NOTHING`,
+		tr.TaskID, tr.CommonName, tr.NodeID, tr.NodeAddr, time.Now().UTC())
+	return err
+}
+
+// GetTaskRoute looks up the waiting node of a task.
+func GetTaskRoute(taskID string) (TaskRoute, bool, error) {
+	var tr TaskRoute
+	err := db.DB.QueryRow(`SELECT task_id, common_name, node_id, node_addr, created_at
+		FROM task_routes WHERE task_id = $1`, taskID).
+		Scan(&tr.TaskID, &tr.CommonName, &tr.NodeID, &tr.NodeAddr, &tr.CreatedAt)
+	if err == sql.ErrNoRows {
+		return tr, false, nil
+	}
+	return tr, err == nil, err
+}
+
+// DeleteTaskRoute forgets a task once its result arrived or its waiter gave up.
+func DeleteTaskRoute(taskID string) error {
+	_, err := db.DB.Exec(`DELETE FROM task_routes WHERE task_id = $1`, taskID)
+	return err
+}
+
+// PurgeTaskRoutes removes routes older than maxAge.
+func PurgeTaskRoutes(maxAge time.Duration) error {
+	_, err := db.DB.Exec(`DELETE FROM task_routes WHERE created_at < $1`, time.Now().UTC().Add(-maxAge))
+	return err
+}
+
+// ClaimTaskSlot leases a slot on the agent for l unless max leases (0: no
+// limit) are live or one holds the same lock. Claims on one agent are
+// serialized by an advisory lock; holders names the tasks in the way.
+func ClaimTaskSlot(l TaskSlotLease, max int) (ok bool, holders []string, err error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return false, nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('task_slots|' || $1))`, l.VPSID); err != nil {
+		return false, nil, err
+	}
+	if _, err = tx.Exec(`DELETE FROM task_slots WHERE vps_id = $1 AND expires_at <= $2`, l.VPSID, time.Now().UTC()); err != nil {
+		return false, nil, err
+	}
+	rows, err := tx.Query(`SELECT task, lock_name FROM task_slots WHERE vps_id = $1 AND task_id <> $2`, l.VPSID, l.TaskID)
+	if err != nil {
+		return false, nil, err
+	}
+	var all, locked []string
+	for rows.Next() {
+		var task, lock string
+		if err = rows.Scan(&task, &lock); err != nil {
+			rows.Close()
+			return false, nil, err
+		}
+		all = append(all, task)
+		if l.LockName != "" && lock == l.LockName {
+			locked = append(locked, task)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, nil, err
+	}
+	if max > 0 && len(all) >= max {
+		return false, all, nil
+	}
+	if len(locked) > 0 {
+		return false, locked, nil
+	}
+
+	if _, err = tx.Exec(`INSERT INTO task_slots (task_id, vps_id, task, lock_name, node_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (task_id) DO UPDATE SET node_id = EXCLUDED.node_id, expires_at = EXCLUDED.expires_at`,
+		l.TaskID, l.VPSID, l.Task, l.LockName, l.NodeID, l.ExpiresAt.UTC()); err != nil {
+		return false, nil, err
+	}
+	return true, nil, tx.Commit()
+}
+
+// ExtendTaskSlot moves the end of a task's lease.
+func ExtendTaskSlot(taskID string, expiresAt time.Time) error {
+	_, err := db.DB.Exec(`UPDATE task_slots SET expires_at = $2 WHERE task_id = $1`, taskID, expiresAt.UTC())
+	return err
+}
+
+// DeleteTaskSlot gives up a task's lease.
+func DeleteTaskSlot(taskID string) error {
+	_, err := db.DB.Exec(`DELETE FROM task_slots WHERE task_id = $1`, taskID)
+	return err
+}
+
+// DeleteNodeTaskSlots drops the leases of nodeID (startup after a crash).
+func DeleteNodeTaskSlots(nodeID string) error {
+	_, err := db.DB.Exec(`DELETE FROM task_slots WHERE node_id = $1`, nodeID)
+	return err
+}
+
+// ListTaskSlots returns the live leases on an agent, oldest first.
+func ListTaskSlots(vpsId string) ([]TaskSlotLease, error) {
+	rows, err := db.DB.Query(`SELECT task_id, vps_id, task, lock_name, node_id, expires_at, COALESCE(started_at, NOW())
+		FROM task_slots WHERE vps_id = $1 AND expires_at > $2 ORDER BY started_at, task_id`,
+		vpsId, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leases []TaskSlotLease
+	for rows.Next() {
+		var l TaskSlotLease
+		if err := rows.Scan(&l.TaskID, &l.VPSID, &l.Task, &l.LockName, &l.NodeID, &l.ExpiresAt, &l.StartedAt); err != nil {
+			return nil, err
+		}
+		leases = append(leases, l)
+	}
+	return leases, rows.Err()
+}
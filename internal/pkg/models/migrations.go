@@ -65,6 +65,65 @@ func MigrateAgentTables() error {
 			fingerprint_sha256 TEXT NOT NULL,
 			created_at TIMESTAMP DEFAULT NOW()
 		)`,
+		// Persisted gateway-side agent identity; signature_secret is envelope-encrypted
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS common_name TEXT`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS certificate TEXT`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS previous_fingerprint TEXT`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS previous_fingerprint_until TIMESTAMP`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS key_id TEXT`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS pending_signature_secret TEXT`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS pending_rotation_id TEXT`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS pending_secret_until TIMESTAMP`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS rotate_on_connect BOOLEAN DEFAULT FALSE`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS task_sig_alg TEXT DEFAULT 'hmac-sha256'`,
+		`ALTER TABLE agent_keys ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT NOW()`,
+		// Highest signed-envelope sequence accepted per agent (replay protection across reconnects)
+		`CREATE TABLE IF NOT EXISTS agent_counters (
+			common_name TEXT PRIMARY KEY,
+			high_water BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT NOW()
+		)`,
+		// Delivery sequence for gateway -> agent messages (at-least-once, agent dedups by epoch+seq)
+		`ALTER TABLE agent_counters ADD COLUMN IF NOT EXISTS delivery_epoch TEXT`,
+		`ALTER TABLE agent_counters ADD COLUMN IF NOT EXISTS delivery_seq BIGINT NOT NULL DEFAULT 0`,
+		// Last hello per agent: version, platform and the tasks it can run
+		`CREATE TABLE IF NOT EXISTS agent_capabilities (
+			common_name TEXT PRIMARY KEY,
+			agent_version TEXT NOT NULL,
+			os TEXT NOT NULL,
+			arch TEXT NOT NULL,
+			protocol_version INT NOT NULL,
+			capabilities TEXT NOT NULL DEFAULT '[]',
+			tasks TEXT NOT NULL DEFAULT '[]',
+			chroot BOOLEAN DEFAULT FALSE,
+			cgroup BOOLEAN DEFAULT FALSE,
+			updated_at TIMESTAMP DEFAULT NOW()
+		)`,
+		// Connection directory and result routing for multi-node deployments
+		`CREATE TABLE IF NOT EXISTS agent_connections (
+			common_name TEXT PRIMARY KEY,
+			node_id TEXT NOT NULL,
+			node_addr TEXT NOT NULL,
+			connected_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS task_routes (
+			task_id TEXT PRIMARY KEY,
+			common_name TEXT NOT NULL,
+			node_id TEXT NOT NULL,
+			node_addr TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS task_slots (
+			task_id TEXT PRIMARY KEY,
+			vps_id TEXT NOT NULL,
+			task TEXT NOT NULL,
+			lock_name TEXT NOT NULL DEFAULT '',
+			node_id TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		// When the lease was first taken, for queue listings
+		`ALTER TABLE task_slots ADD COLUMN IF NOT EXISTS started_at TIMESTAMP DEFAULT NOW()`,
 		`CREATE TABLE IF NOT EXISTS agent_certificates (
 			id SERIAL PRIMARY KEY,
 			agent_id INT REFERENCES agents(id) ON DELETE CASCADE,
@@ -84,7 +143,10 @@ func MigrateAgentTables() error {
 
 		// Indexes
 		`CREATE INDEX IF NOT EXISTS idx_agent_keys_identity ON agent_keys(identity_token)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_agent_keys_cn ON agent_keys(common_name)`,
 		`CREATE INDEX IF NOT EXISTS idx_heartbeats_agent ON agent_heartbeats(agent_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_connections_node ON agent_connections(node_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_task_routes_created ON task_routes(created_at)`,
 	}
 
 	for _, q := range queries {
@@ -122,6 +184,76 @@ func MigrateTaskTables() error {
 			created_at TIMESTAMP DEFAULT NOW(),
 			updated_at TIMESTAMP DEFAULT NOW()
 		)`,
+		// Messages queued for offline agents (payload envelope-encrypted)
+		`CREATE TABLE IF NOT EXISTS offline_messages (
+			id BIGSERIAL PRIMARY KEY,
+			identity_token TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			size INT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW()
+		)`,
+		`ALTER TABLE offline_messages ADD COLUMN IF NOT EXISTS task_id TEXT`,
+		`ALTER TABLE offline_messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP`,
+		`ALTER TABLE offline_messages ADD COLUMN IF NOT EXISTS epoch TEXT`,
+		`ALTER TABLE offline_messages ADD COLUMN IF NOT EXISTS seq BIGINT`,
+		// Running totals of offline_messages: size for the global cap, rows for stats
+		`CREATE TABLE IF NOT EXISTS offline_queue_totals (
+			id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+			bytes BIGINT NOT NULL
+		)`,
+		`INSERT INTO offline_queue_totals (id, bytes) SELECT TRUE, COALESCE(SUM(size), 0) FROM offline_messages
+			ON CONFLICT (id) DO NOTHING`,
+		`ALTER TABLE offline_queue_totals ADD COLUMN IF NOT EXISTS msgs BIGINT`,
+		`UPDATE offline_queue_totals SET msgs = (SELECT COUNT(*) FROM offline_messages) WHERE msgs IS NULL`,
+		// Offline-queue lifetime per template (NULL: OFFLINE_DEFAULT_TTL_SECONDS)
+		`ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS offline_ttl_seconds INT`,
+		// Longest a run may take (NULL: no template limit); bounds the task deadline
+		`ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS max_runtime_seconds INT`,
+		// Tasks sharing a lock name never run concurrently on one agent (NULL: no lock)
+		`ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS lock_name TEXT`,
+		// Retry policy (NULL attempts: a single try)
+		`ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS retry_max_attempts INT`,
+		`ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS retry_backoff_seconds INT`,
+		`ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS retry_max_backoff_seconds INT`,
+		`ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS retry_exit_codes INT[]`,
+		// Dispatch bookkeeping for gateway-issued tasks
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS vps_id TEXT`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS task_name TEXT`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS deadline TIMESTAMP`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS late BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS attempt INT NOT NULL DEFAULT 1`,
+		`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS root_task_id TEXT`,
+		// Retries of fire-and-forget tasks; next_attempt_at is NULL while an attempt is out
+		`CREATE TABLE IF NOT EXISTS task_retries (
+			root_task_id TEXT PRIMARY KEY,
+			task_id TEXT UNIQUE NOT NULL,
+			vps_id TEXT NOT NULL,
+			task_name TEXT NOT NULL,
+			args TEXT NOT NULL,
+			attempt INT NOT NULL,
+			next_attempt_at TIMESTAMP,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT NOW(),
+			updated_at TIMESTAMP DEFAULT NOW()
+		)`,
+		// Until when an attempt that is out may go without news before it is presumed lost
+		`ALTER TABLE task_retries ADD COLUMN IF NOT EXISTS lease_until TIMESTAMP`,
+		// Tasks that used up their retries
+		`CREATE TABLE IF NOT EXISTS task_dead_letters (
+			id BIGSERIAL PRIMARY KEY,
+			root_task_id TEXT NOT NULL,
+			task_id TEXT NOT NULL,
+			vps_id TEXT NOT NULL,
+			task_name TEXT NOT NULL,
+			args TEXT NOT NULL,
+			attempts INT NOT NULL,
+			exit_code INT,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT NOW(),
+			redriven_at TIMESTAMP,
+			redriven_task_id TEXT
+		)`,
 		`CREATE TABLE IF NOT EXISTS system_checkpoints (
 			id SERIAL PRIMARY KEY,
 			task_id INT REFERENCES tasks(id),
@@ -132,6 +264,10 @@ func MigrateTaskTables() error {
 		// Indexes
 		`CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status)`,
 		`CREATE INDEX IF NOT EXISTS idx_checkpoints_task ON system_checkpoints(task_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_offline_messages_identity ON offline_messages(identity_token, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_task_slots_vps ON task_slots(vps_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_task_retries_due ON task_retries(next_attempt_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_task_dead_letters_vps ON task_dead_letters(vps_id, id)`,
 	}
 
 	for _, q := range queries {
@@ -245,6 +381,10 @@ func MigrateSecurityTables() error {
 			timestamp TIMESTAMP DEFAULT NOW(),
 			details TEXT
 		)`,
+		// Hash chain columns (tamper evidence)
+		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS seq BIGINT`,
+		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS prev_hash TEXT`,
+		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS hash TEXT`,
 		`CREATE TABLE IF NOT EXISTS security_events (
 			id SERIAL PRIMARY KEY,
 			event_type TEXT NOT NULL,
@@ -253,6 +393,31 @@ func MigrateSecurityTables() error {
 			agent_id INT,
 			timestamp TIMESTAMP DEFAULT NOW()
 		)`,
+		`ALTER TABLE security_events ADD COLUMN IF NOT EXISTS agent_name TEXT`,
+		`ALTER TABLE security_events ADD COLUMN IF NOT EXISTS remote_addr TEXT`,
+		`CREATE TABLE IF NOT EXISTS agent_quarantine (
+			agent_name TEXT PRIMARY KEY,
+			reason TEXT,
+			quarantined_at TIMESTAMP DEFAULT NOW(),
+			released_at TIMESTAMP,
+			released_by TEXT
+		)`,
+		`CREATE TABLE IF NOT EXISTS revoked_certificates (
+			id SERIAL PRIMARY KEY,
+			serial TEXT,
+			fingerprint_sha256 TEXT,
+			common_name TEXT,
+			reason TEXT,
+			revoked_at TIMESTAMP DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS task_signing_keys (
+			kid TEXT PRIMARY KEY,
+			public_key TEXT NOT NULL,
+			private_key TEXT NOT NULL,
+			key_id TEXT,
+			created_at TIMESTAMP DEFAULT NOW(),
+			retired_at TIMESTAMP
+		)`,
 		`CREATE TABLE IF NOT EXISTS installation_tokens (
 			id SERIAL PRIMARY KEY,
 			token TEXT NOT NULL,
@@ -272,7 +437,11 @@ func MigrateSecurityTables() error {
 
 		// Indexes
 		`CREATE INDEX IF NOT EXISTS idx_audit_user ON audit_logs(user_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_audit_seq ON audit_logs(seq)`,
 		`CREATE INDEX IF NOT EXISTS idx_security_events_type ON security_events(event_type)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_agent ON security_events(agent_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_ts ON security_events(timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_revoked_serial ON revoked_certificates(serial)`,
 		`CREATE INDEX IF NOT EXISTS idx_tokens_expires ON installation_tokens(expires_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id)`,
 	}
@@ -0,0 +1,356 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+	"ultahost-ai-gateway/internal/utils"
+
+	"github.com/lib/pq"
+)
+
+// Message held for an offline agent
+type OfflineMessage struct {
+	ID        int64 // queue position, set by DrainOfflineMessages; a requeue restores it
+	Payload   []byte
+	TaskID    string    // set for signed tasks, so expiry can be reported on the task record
+	ExpiresAt time.Time // zero: never expires
+	Epoch     string    // delivery sequence, once assigned; redeliveries keep it
+	Seq       uint64
+}
+
+// Caps applied by EnqueueOfflineMessage, in payload (plaintext) bytes
+type OfflineLimits struct {
+	MaxMsgs        int
+	MaxBytes       int
+	GlobalMaxBytes int64
+}
+
+func offlineAAD(identityToken string) string {
+	return "offline_messages|" + identityToken
+}
+
+// EnqueueOfflineMessage appends a sealed payload to the agent's queue, dropping
+// the oldest messages to stay within the per-agent caps. accepted is false when
+// the payload alone exceeds a cap or the global ceiling is reached.
+func EnqueueOfflineMessage(identityToken string, m OfflineMessage, lim OfflineLimits) (dropped int, accepted bool, err error) {
+	size := len(m.Payload)
+	if size > lim.MaxBytes || int64(size) > lim.GlobalMaxBytes {
+		return 0, false, nil
+	}
+	sealed, err := utils.SealSecret(m.Payload, offlineAAD(identityToken))
+	if err != nil {
+		return 0, false, fmt.Errorf("seal offline message: %w", err)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Serialise writers of one queue, across gateway nodes too
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "offline|"+identityToken); err != nil {
+		return 0, false, err
+	}
+
+	rows, err := tx.Query(`SELECT id, size FROM offline_messages WHERE identity_token = $1 ORDER BY id`, identityToken)
+	if err != nil {
+		return 0, false, err
+	}
+	type queued struct {
+		id   int64
+		size int
+	}
+	var queue []queued
+	bytes := 0
+	for rows.Next() {
+		var q queued
+		if err := rows.Scan(&q.id, &q.size); err != nil {
+			rows.Close()
+			return 0, false, err
+		}
+		queue = append(queue, q)
+		bytes += q.size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+
+	// Drop from the head until the new message fits
+	var evict []int64
+	freed := 0
+	for len(queue) > 0 && (len(queue) >= lim.MaxMsgs || bytes+size > lim.MaxBytes) {
+		evict = append(evict, queue[0].id)
+		bytes -= queue[0].size
+		freed += queue[0].size
+		queue = queue[1:]
+	}
+	// The counter row is locked until commit, so concurrent enqueues for
+	// other agents see each other's reservations
+	ok, err := reserveOffline(tx, int64(size-freed), int64(1-len(evict)), lim.GlobalMaxBytes)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	if len(evict) > 0 {
+		if _, err := tx.Exec(`DELETE FROM offline_messages WHERE id = ANY($1)`, pq.Array(evict)); err != nil {
+			return 0, false, err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO offline_messages (identity_token, payload, size, task_id, expires_at, epoch, seq, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		identityToken, sealed, size, m.TaskID, nullTime(m.ExpiresAt), m.Epoch, int64(m.Seq), time.Now().UTC()); err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return len(evict), true, nil
+}
+
+// reserveOffline moves the global counters by bytes and msgs, refusing byte
+// growth past max.
+func reserveOffline(tx *sql.Tx, bytes, msgs, max int64) (bool, error) {
+	res, err := tx.Exec(`UPDATE offline_queue_totals SET bytes = GREATEST(bytes + $1, 0), msgs = GREATEST(msgs + $3, 0)
+		WHERE id AND ($1 <= 0 OR bytes + $1 <= $2)`, bytes, max, msgs)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// releaseOffline takes n deleted messages of freed bytes off the global counters.
+func releaseOffline(tx *sql.Tx, freed, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := reserveOffline(tx, -freed, -n, 0)
+	return err
+}
+
+// DrainOfflineMessages removes and returns the agent's queue, oldest first.
+// A message that can no longer be decrypted is dropped and counted in skipped.
+func DrainOfflineMessages(identityToken string) (msgs []OfflineMessage, skipped int, err error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM offline_messages WHERE identity_token = $1
+		RETURNING id, payload, COALESCE(task_id, ''), expires_at, COALESCE(epoch, ''), COALESCE(seq, 0), size`, identityToken)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type drained struct {
+		id      int64
+		sealed  string
+		taskID  string
+		expires sql.NullTime
+		epoch   string
+		seq     int64
+	}
+	var out []drained
+	var freed int64
+	for rows.Next() {
+		var d drained
+		var size int64
+		if err := rows.Scan(&d.id, &d.sealed, &d.taskID, &d.expires, &d.epoch, &d.seq, &size); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		out = append(out, d)
+		freed += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if err := releaseOffline(tx, freed, int64(len(out))); err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	for _, d := range out {
+		payload, err := utils.OpenSecret(d.sealed, offlineAAD(identityToken))
+		if err != nil {
+			skipped++
+			continue
+		}
+		msgs = append(msgs, OfflineMessage{
+			ID: d.id, Payload: payload, TaskID: d.taskID, ExpiresAt: d.expires.Time, Epoch: d.epoch, Seq: uint64(d.seq),
+		})
+	}
+	return msgs, skipped, nil
+}
+
+// RequeueOfflineMessages puts drained messages back where they were, ahead of
+// anything queued since, by restoring their ids. They were within the caps
+// when first queued, so none is dropped; the next enqueue trims the queue.
+func RequeueOfflineMessages(identityToken string, msgs []OfflineMessage) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "offline|"+identityToken); err != nil {
+		return err
+	}
+	var added, restored int64
+	for _, m := range msgs {
+		sealed, err := utils.SealSecret(m.Payload, offlineAAD(identityToken))
+		if err != nil {
+			return fmt.Errorf("seal offline message: %w", err)
+		}
+		var id sql.NullInt64
+		if m.ID > 0 {
+			id = sql.NullInt64{Int64: m.ID, Valid: true}
+		}
+		res, err := tx.Exec(`INSERT INTO offline_messages (id, identity_token, payload, size, task_id, expires_at, epoch, seq, created_at)
+			VALUES (COALESCE($1, nextval(pg_get_serial_sequence('offline_messages', 'id'))), $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (id) DO NOTHING`,
+			id, identityToken, sealed, len(m.Payload), m.TaskID, nullTime(m.ExpiresAt), m.Epoch, int64(m.Seq), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			added += int64(len(m.Payload))
+			restored++
+		}
+	}
+	if _, err := tx.Exec(`UPDATE offline_queue_totals SET bytes = bytes + $1, msgs = msgs + $2 WHERE id`, added, restored); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveOfflineTask deletes the queued message carrying taskID, if any.
+func RemoveOfflineTask(identityToken, taskID string) (bool, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var n, freed int64
+	err = tx.QueryRow(`WITH gone AS (
+			DELETE FROM offline_messages WHERE identity_token = $1 AND task_id = $2 RETURNING size
+		) SELECT COUNT(*), COALESCE(SUM(size), 0) FROM gone`, identityToken, taskID).Scan(&n, &freed)
+	if err != nil {
+		return false, err
+	}
+	if err := releaseOffline(tx, freed, n); err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// PurgedOfflineMessage is a queued message removed by PurgeOfflineMessages.
+type PurgedOfflineMessage struct {
+	IdentityToken string
+	TaskID        string
+	ExpiresAt     time.Time
+	Orphaned      bool // queued for an identity token no agent holds any more
+}
+
+// PurgeOfflineMessages deletes messages whose TTL has passed and messages left
+// under identity tokens that no longer belong to an agent (re-enrolled or
+// removed) for longer than orphanGrace.
+func PurgeOfflineMessages(now time.Time, orphanGrace time.Duration) ([]PurgedOfflineMessage, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM offline_messages m
+		WHERE (m.expires_at IS NOT NULL AND m.expires_at <= $1)
+			OR (m.created_at <= $2 AND NOT EXISTS (SELECT 1 FROM agent_keys k WHERE k.identity_token = m.identity_token))
+		RETURNING m.identity_token, COALESCE(m.task_id, ''), m.expires_at, m.size`, now.UTC(), now.Add(-orphanGrace).UTC())
+	if err != nil {
+		return nil, err
+	}
+	var out []PurgedOfflineMessage
+	var freed int64
+	for rows.Next() {
+		var p PurgedOfflineMessage
+		var expires sql.NullTime
+		var size int64
+		if err := rows.Scan(&p.IdentityToken, &p.TaskID, &expires, &size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.ExpiresAt = expires.Time
+		p.Orphaned = !expires.Valid || expires.Time.After(now)
+		out = append(out, p)
+		freed += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := releaseOffline(tx, freed, int64(len(out))); err != nil {
+		return nil, err
+	}
+	return out, tx.Commit()
+}
+
+// OfflineMessageStats summarises the durable queue from the counter row, so
+// it costs one primary-key read however long the queue is.
+func OfflineMessageStats() (msgs, bytes int, err error) {
+	err = db.DB.QueryRow(`SELECT COALESCE(msgs, 0), bytes FROM offline_queue_totals WHERE id`).Scan(&msgs, &bytes)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// RekeyOfflineMessages re-wraps queued payloads under the active KEK.
+func RekeyOfflineMessages() (int, error) {
+	rows, err := db.DB.Query(`SELECT id, payload FROM offline_messages`)
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id     int64
+		sealed string
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.sealed); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, r := range all {
+		resealed, changed, err := utils.ResealSecret(r.sealed)
+		if err != nil {
+			return n, fmt.Errorf("offline message %d: %w", r.id, err)
+		}
+		if !changed {
+			continue
+		}
+		if _, err := db.DB.Exec(`UPDATE offline_messages SET payload = $2 WHERE id = $1`, r.id, resealed); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+)
+
+// QuarantineAgent marks an identity quarantined (re-arming a previously released
+// row) and announces it to the other replicas.
+func QuarantineAgent(agentName, reason string) error {
+	_, err := db.DB.Exec(`INSERT INTO agent_quarantine (agent_name, reason, quarantined_at, released_at, released_by)
+		VALUES ($1, $2, $3, NULL, NULL)
+		ON CONFLICT (agent_name) DO UPDATE
+		SET reason = EXCLUDED.reason, quarantined_at = EXCLUDED.quarantined_at, released_at = NULL, released_by = NULL`,
+		agentName, reason, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return NotifyCluster(ChannelQuarantine, agentName)
+}
+
+// ReleaseAgentQuarantine lifts the quarantine and announces it; releasedBy
+// identifies the admin action.
+func ReleaseAgentQuarantine(agentName, releasedBy string) error {
+	_, err := db.DB.Exec(`UPDATE agent_quarantine SET released_at = $2, released_by = $3
+		WHERE agent_name = $1 AND released_at IS NULL`,
+		agentName, time.Now().UTC(), releasedBy)
+	if err != nil {
+		return err
+	}
+	return NotifyCluster(ChannelQuarantineRelease, agentName)
+}
+
+// ListActiveQuarantines returns identities that are still quarantined.
+func ListActiveQuarantines() ([]AgentQuarantine, error) {
+	rows, err := db.DB.Query(`SELECT agent_name, COALESCE(reason, ''), quarantined_at
+		FROM agent_quarantine WHERE released_at IS NULL ORDER BY quarantined_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AgentQuarantine
+	for rows.Next() {
+		var q AgentQuarantine
+		if err := rows.Scan(&q.AgentName, &q.Reason, &q.QuarantinedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
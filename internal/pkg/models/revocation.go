@@ -0,0 +1,35 @@
+package models
+
+import "ultahost-ai-gateway/internal/pkg/db"
+
+// InsertRevokedCertificate records a revocation and announces it to the other replicas.
+func InsertRevokedCertificate(rc RevokedCertificate) error {
+	_, err := db.DB.Exec(`INSERT INTO revoked_certificates (serial, fingerprint_sha256, common_name, reason, revoked_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		rc.Serial, rc.FingerprintSHA256, rc.CommonName, rc.Reason, rc.RevokedAt)
+	if err != nil {
+		return err
+	}
+	return NotifyCluster(ChannelRevocations, rc.CommonName)
+}
+
+// ListRevokedCertificates returns every revocation ever recorded.
+func ListRevokedCertificates() ([]RevokedCertificate, error) {
+	rows, err := db.DB.Query(`SELECT id, COALESCE(serial, ''), COALESCE(fingerprint_sha256, ''),
+			COALESCE(common_name, ''), COALESCE(reason, ''), revoked_at
+		FROM revoked_certificates ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []RevokedCertificate
+	for rows.Next() {
+		var rc RevokedCertificate
+		if err := rows.Scan(&rc.ID, &rc.Serial, &rc.FingerprintSHA256, &rc.CommonName, &rc.Reason, &rc.RevokedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rc)
+	}
+	return out, rows.Err()
+}
@@ -10,7 +10,10 @@ type AuditLog struct {
 	Entity    string    `db:"entity"`    // e.g., agent, vps, task
 	EntityID  int       `db:"entity_id"` // related record id
 	Timestamp time.Time `db:"timestamp"`
-	Details   string    `db:"details"` // optional JSON or message
+	Details   string    `db:"details"`   // optional JSON or message
+	Seq       int64     `db:"seq"`       // position in the hash chain
+	PrevHash  string    `db:"prev_hash"` // hash of the previous entry ("" for the first)
+	Hash      string    `db:"hash"`      // sha256 over this entry + PrevHash
 }
 
 // Security events (threats, anomalies)
@@ -20,6 +23,8 @@ type SecurityEvent struct {
 	Severity    string    `db:"severity"`    // low, medium, high, critical
 	Description string    `db:"description"` // details about event
 	AgentID     int       `db:"agent_id"`    // optional
+	AgentName   string    `db:"agent_name"`  // certificate CN, e.g. Agent_<vpsId>
+	RemoteAddr  string    `db:"remote_addr"` // peer address of the offending connection
 	Timestamp   time.Time `db:"timestamp"`
 }
 
@@ -42,3 +47,22 @@ type APIKey struct {
 	ExpiresAt *time.Time `db:"expires_at"` // optional
 	Revoked   bool       `db:"revoked"`
 }
+
+// Quarantined agent identities (refused until an admin releases them)
+type AgentQuarantine struct {
+	AgentName     string     `db:"agent_name"` // certificate CN
+	Reason        string     `db:"reason"`
+	QuarantinedAt time.Time  `db:"quarantined_at"`
+	ReleasedAt    *time.Time `db:"released_at"` // NULL while quarantined
+	ReleasedBy    string     `db:"released_by"`
+}
+
+// Revoked agent certificates (deny-list / CRL source)
+type RevokedCertificate struct {
+	ID                int       `db:"id"`
+	Serial            string    `db:"serial"` // lowercase hex, may be empty
+	FingerprintSHA256 string    `db:"fingerprint_sha256"`
+	CommonName        string    `db:"common_name"`
+	Reason            string    `db:"reason"`
+	RevokedAt         time.Time `db:"revoked_at"`
+}
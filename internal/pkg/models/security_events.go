@@ -0,0 +1,81 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+)
+
+// SecurityEventFilter narrows ListSecurityEvents; zero values mean "any".
+type SecurityEventFilter struct {
+	EventType string
+	Severity  string
+	AgentName string
+	Since     time.Time
+	Limit     int
+}
+
+// InsertSecurityEvent persists one security event.
+func InsertSecurityEvent(ev SecurityEvent) error {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	_, err := db.DB.Exec(`INSERT INTO security_events (event_type, severity, description, agent_name, remote_addr, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		ev.EventType, ev.Severity, ev.Description, ev.AgentName, ev.RemoteAddr, ev.Timestamp)
+	return err
+}
+
+// ListSecurityEvents returns the newest events matching f.
+func ListSecurityEvents(f SecurityEventFilter) ([]SecurityEvent, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.EventType != "" {
+		add("event_type = $%d", f.EventType)
+	}
+	if f.Severity != "" {
+		add("severity = $%d", f.Severity)
+	}
+	if f.AgentName != "" {
+		add("agent_name = $%d", f.AgentName)
+	}
+	if !f.Since.IsZero() {
+		add("timestamp >= $%d", f.Since.UTC())
+	}
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+
+	q := `SELECT id, event_type, severity, COALESCE(description, ''), COALESCE(agent_id, 0),
+			COALESCE(agent_name, ''), COALESCE(remote_addr, ''), timestamp
+		FROM security_events`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	q += fmt.Sprintf(" ORDER BY timestamp DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := db.DB.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []SecurityEvent{}
+	for rows.Next() {
+		var ev SecurityEvent
+		if err := rows.Scan(&ev.ID, &ev.EventType, &ev.Severity, &ev.Description, &ev.AgentID,
+			&ev.AgentName, &ev.RemoteAddr, &ev.Timestamp); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
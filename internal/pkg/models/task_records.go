@@ -0,0 +1,170 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+)
+
+// Task statuses written by the gateway
+const (
+	TaskStatusWaiting   = "waiting" // behind other tasks on the agent, not yet signed
+	TaskStatusQueued    = "queued"  // held in the offline queue
+	TaskStatusSent      = "sent"    // handed to a live connection
+	TaskStatusSuccess   = "success" // agent reported exit code 0
+	TaskStatusFailed    = "failed"
+	TaskStatusExpired   = "expired"   // TTL passed before the agent reconnected
+	TaskStatusCancelled = "cancelled" // removed from the queue, or stopped by the agent
+)
+
+// TaskFinished reports whether status is final.
+func TaskFinished(status string) bool {
+	switch status {
+	case TaskStatusSuccess, TaskStatusFailed, TaskStatusExpired, TaskStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// TaskTemplateTTL returns the offline-queue lifetime configured for a task;
+// ok is false if the template does not exist or sets none.
+func TaskTemplateTTL(name string) (ttl time.Duration, ok bool, err error) {
+	var secs sql.NullInt64
+	err = db.DB.QueryRow(`SELECT offline_ttl_seconds FROM task_templates WHERE name = $1`, name).Scan(&secs)
+	if err == sql.ErrNoRows || (err == nil && !secs.Valid) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Duration(secs.Int64) * time.Second, true, nil
+}
+
+// TaskTemplateMaxRuntime returns how long a run of the task may take; ok is
+// false if the template does not exist or sets no limit.
+func TaskTemplateMaxRuntime(name string) (max time.Duration, ok bool, err error) {
+	var secs sql.NullInt64
+	err = db.DB.QueryRow(`SELECT max_runtime_seconds FROM task_templates WHERE name = $1`, name).Scan(&secs)
+	if err == sql.ErrNoRows || (err == nil && (!secs.Valid || secs.Int64 <= 0)) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Duration(secs.Int64) * time.Second, true, nil
+}
+
+// TaskTemplateLock returns the lock name of a task ("" if it has none).
+func TaskTemplateLock(name string) (string, error) {
+	var lock sql.NullString
+	err := db.DB.QueryRow(`SELECT lock_name FROM task_templates WHERE name = $1`, name).Scan(&lock)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return lock.String, err
+}
+
+// CreateTaskRecord stores a dispatched task, linked to its template by name.
+// Recording a task that was waiting for a slot moves it to its dispatch status.
+func CreateTaskRecord(t Task) error {
+	if t.Attempt == 0 {
+		t.Attempt = 1
+	}
+	_, err := db.DB.Exec(`INSERT INTO tasks (task_id, vps_id, task_name, status, expires_at, deadline, attempt, root_task_id,
+			task_template_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), (SELECT id FROM task_templates WHERE name = $3), $9, $9)
+		ON CONFLICT (task_id) DO UPDATE SET status = EXCLUDED.status, expires_at = EXCLUDED.expires_at,
+			deadline = EXCLUDED.deadline, updated_at = EXCLUDED.updated_at
+		WHERE tasks.status = 'waiting'`,
+		t.TaskID, t.VPSID, t.TaskName, t.Status, nullTime(t.ExpiresAt), nullTime(t.Deadline), t.Attempt, t.RootTaskID,
+		time.Now().UTC())
+	return err
+}
+
+// SetTaskStatus moves a task to status; detail, if set, is kept as its stderr.
+func SetTaskStatus(taskID, status, detail string) error {
+	now := time.Now().UTC()
+	_, err := db.DB.Exec(`UPDATE tasks SET status = $2,
+			stderr = CASE WHEN $3 = '' THEN stderr ELSE $3 END,
+			finished_at = CASE WHEN $2 IN ('success', 'failed', 'expired', 'cancelled') THEN $4 ELSE finished_at END,
+			updated_at = $4
+		WHERE task_id = $1`,
+		taskID, status, detail, now)
+	return err
+}
+
+// AdvanceTaskStatus moves a task from one status to another, leaving it alone
+// if something else (a result, a cancel) changed it first.
+func AdvanceTaskStatus(taskID, from, to string) error {
+	_, err := db.DB.Exec(`UPDATE tasks SET status = $3, updated_at = $4 WHERE task_id = $1 AND status = $2`,
+		taskID, from, to, time.Now().UTC())
+	return err
+}
+
+// CancelTaskRecord marks a task cancelled unless it already reached a final
+// status; it reports whether the record changed.
+func CancelTaskRecord(taskID, detail string) (bool, error) {
+	now := time.Now().UTC()
+	res, err := db.DB.Exec(`UPDATE tasks SET status = 'cancelled',
+			stderr = CASE WHEN $2 = '' THEN stderr ELSE $2 END,
+			finished_at = $3, updated_at = $3
+		WHERE task_id = $1 AND status NOT IN ('success', 'failed', 'expired', 'cancelled')`,
+		taskID, detail, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// CompleteTaskRecord stores the outcome reported by the agent.
+func CompleteTaskRecord(t Task) error {
+	_, err := db.DB.Exec(`UPDATE tasks SET status = $2, exit_code = $3, stdout = $4, stderr = $5,
+			started_at = $6, finished_at = $7, duration_sec = $8, late = $9, updated_at = $10
+		WHERE task_id = $1`,
+		t.TaskID, t.Status, t.ExitCode, t.Stdout, t.Stderr,
+		nullTime(t.StartedAt), nullTime(t.FinishedAt), t.DurationSec, t.Late, time.Now().UTC())
+	return err
+}
+
+// GetTaskRecord returns the dispatch record of a task.
+func GetTaskRecord(taskID string) (Task, bool, error) {
+	var t Task
+	var vpsID, name sql.NullString
+	var expires, deadline sql.NullTime
+	err := db.DB.QueryRow(`SELECT task_id, vps_id, task_name, status, expires_at, deadline, late, created_at
+		FROM tasks WHERE task_id = $1`, taskID).
+		Scan(&t.TaskID, &vpsID, &name, &t.Status, &expires, &deadline, &t.Late, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return t, false, nil
+	}
+	if err != nil {
+		return t, false, err
+	}
+	t.VPSID, t.TaskName, t.ExpiresAt, t.Deadline = vpsID.String, name.String, expires.Time, deadline.Time
+	return t, true, nil
+}
+
+// ListWaitingTasks returns the tasks waiting for a slot on an agent, oldest
+// first.
+func ListWaitingTasks(vpsId string) ([]Task, error) {
+	rows, err := db.DB.Query(`SELECT task_id, task_name, created_at
+		FROM tasks WHERE vps_id = $1 AND status = $2 ORDER BY created_at, id`,
+		vpsId, TaskStatusWaiting)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		var t Task
+		var name sql.NullString
+		if err := rows.Scan(&t.TaskID, &name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.VPSID, t.TaskName, t.Status = vpsId, name.String, TaskStatusWaiting
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
@@ -0,0 +1,381 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+	"ultahost-ai-gateway/internal/pkg/db"
+	"ultahost-ai-gateway/internal/utils"
+
+	"github.com/lib/pq"
+)
+
+// Default delays when a template enables retries without setting them
+const (
+	defaultRetryBackoff    = 5 * time.Second
+	defaultRetryMaxBackoff = 5 * time.Minute
+)
+
+// RetryPolicy is how often and when a failed task is tried again.
+type RetryPolicy struct {
+	MaxAttempts int           // total tries, including the first; <= 1 disables retries
+	Backoff     time.Duration // delay before the second try, doubled for each further one
+	MaxBackoff  time.Duration
+	ExitCodes   []int // agent exit codes treated as transient
+}
+
+// Retries reports whether the policy allows more than one try.
+func (p RetryPolicy) Retries() bool { return p.MaxAttempts > 1 }
+
+// RetryableExit reports whether an agent exit code is worth another try.
+func (p RetryPolicy) RetryableExit(code int) bool {
+	for _, c := range p.ExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the backoff after the given (1-based) failed attempt.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// TaskTemplateRetryPolicy returns the retry policy of a task; a missing
+// template or one without retry_max_attempts yields a single try.
+func TaskTemplateRetryPolicy(name string) (RetryPolicy, error) {
+	var attempts, backoff, maxBackoff sql.NullInt64
+	var codes pq.Int64Array
+	err := db.DB.QueryRow(`SELECT retry_max_attempts, retry_backoff_seconds, retry_max_backoff_seconds, retry_exit_codes
+		FROM task_templates WHERE name = $1`, name).Scan(&attempts, &backoff, &maxBackoff, &codes)
+	if err == sql.ErrNoRows {
+		return RetryPolicy{MaxAttempts: 1}, nil
+	}
+	if err != nil {
+		return RetryPolicy{MaxAttempts: 1}, err
+	}
+	p := RetryPolicy{MaxAttempts: 1, Backoff: defaultRetryBackoff, MaxBackoff: defaultRetryMaxBackoff}
+	if attempts.Valid {
+		p.MaxAttempts = int(attempts.Int64)
+	}
+	if backoff.Valid && backoff.Int64 > 0 {
+		p.Backoff = time.Duration(backoff.Int64) * time.Second
+	}
+	if maxBackoff.Valid && maxBackoff.Int64 > 0 {
+		p.MaxBackoff = time.Duration(maxBackoff.Int64) * time.Second
+	}
+	for _, c := range codes {
+		p.ExitCodes = append(p.ExitCodes, int(c))
+	}
+	return p, nil
+}
+
+// Task args may carry secrets, so retries and dead letters keep them
+// envelope-encrypted, bound to their table and task.
+func taskArgsAAD(table, rootTaskID string) string {
+	return table + "|" + rootTaskID + "|args"
+}
+
+func sealTaskArgs(args []string, aad string) (string, error) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return utils.SealSecret(b, aad)
+}
+
+// openTaskArgs decrypts stored args; rows written before sealing hold plain JSON.
+func openTaskArgs(v, aad string) ([]string, error) {
+	b := []byte(v)
+	if utils.IsSealed(v) {
+		var err error
+		if b, err = utils.OpenSecret(v, aad); err != nil {
+			return nil, err
+		}
+	}
+	var args []string
+	err := json.Unmarshal(b, &args)
+	return args, err
+}
+
+// TaskRetry tracks a fire-and-forget task across its attempts.
+type TaskRetry struct {
+	RootTaskID    string
+	TaskID        string // current attempt
+	VPSID         string
+	TaskName      string
+	Args          []string
+	Attempt       int
+	NextAttemptAt time.Time // zero while an attempt is out
+	LeaseUntil    time.Time // while an attempt is out: when it is presumed lost
+	LastError     string
+}
+
+// SaveTaskRetry creates or updates the retry state of a task.
+func SaveTaskRetry(r TaskRetry) error {
+	args, err := sealTaskArgs(r.Args, taskArgsAAD("task_retries", r.RootTaskID))
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec(`INSERT INTO task_retries (root_task_id, task_id, vps_id, task_name, args, attempt, next_attempt_at,
+			lease_until, last_error, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+		ON CONFLICT (root_task_id) DO UPDATE SET task_id = EXCLUDED.task_id, attempt = EXCLUDED.attempt,
+			next_attempt_at = EXCLUDED.next_attempt_at, lease_until = EXCLUDED.lease_until,
+			last_error = EXCLUDED.last_error, updated_at = EXCLUDED.updated_at`,
+		r.RootTaskID, r.TaskID, r.VPSID, r.TaskName, args, r.Attempt, nullTime(r.NextAttemptAt),
+		nullTime(r.LeaseUntil), r.LastError, time.Now().UTC())
+	return err
+}
+
+// TaskRetryByTask returns the retry state whose current attempt is taskID.
+func TaskRetryByTask(taskID string) (TaskRetry, bool, error) {
+	rows, err := db.DB.Query(`SELECT `+taskRetryColumns+` FROM task_retries WHERE task_id = $1`, taskID)
+	if err != nil {
+		return TaskRetry{}, false, err
+	}
+	out, err := scanTaskRetries(rows)
+	if err != nil || len(out) == 0 {
+		return TaskRetry{}, false, err
+	}
+	return out[0], true, nil
+}
+
+// ClaimDueTaskRetries takes up to limit retries whose backoff has passed,
+// clearing next_attempt_at so no other node picks them up as well. The claim
+// holds for lease; a node that dies with it leaves the row to
+// ClaimLapsedTaskRetries.
+func ClaimDueTaskRetries(limit int, lease time.Duration) ([]TaskRetry, error) {
+	now := time.Now().UTC()
+	rows, err := db.DB.Query(`UPDATE task_retries SET next_attempt_at = NULL, lease_until = $3, updated_at = $1
+		WHERE root_task_id IN (
+			SELECT root_task_id FROM task_retries
+			WHERE next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+taskRetryColumns, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	return scanTaskRetries(rows)
+}
+
+// ClaimLapsedTaskRetries takes up to limit retries whose attempt is out and
+// whose lease has run out (rows from before leases count from their last
+// update), renewing the lease so other nodes leave them alone meanwhile.
+func ClaimLapsedTaskRetries(limit int, lease time.Duration) ([]TaskRetry, error) {
+	now := time.Now().UTC()
+	rows, err := db.DB.Query(`UPDATE task_retries SET lease_until = $3, updated_at = $1
+		WHERE root_task_id IN (
+			SELECT root_task_id FROM task_retries
+			WHERE next_attempt_at IS NULL AND COALESCE(lease_until, updated_at) <= $1
+			ORDER BY COALESCE(lease_until, updated_at)
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+taskRetryColumns, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	return scanTaskRetries(rows)
+}
+
+// DeleteTaskRetry stops tracking a task.
+func DeleteTaskRetry(rootTaskID string) error {
+	_, err := db.DB.Exec(`DELETE FROM task_retries WHERE root_task_id = $1`, rootTaskID)
+	return err
+}
+
+const taskRetryColumns = `root_task_id, task_id, vps_id, task_name, args, attempt, next_attempt_at, lease_until,
+		COALESCE(last_error, '')`
+
+func scanTaskRetries(rows *sql.Rows) ([]TaskRetry, error) {
+	defer rows.Close()
+	var out []TaskRetry
+	for rows.Next() {
+		var r TaskRetry
+		var args string
+		var next, lease sql.NullTime
+		if err := rows.Scan(&r.RootTaskID, &r.TaskID, &r.VPSID, &r.TaskName, &args, &r.Attempt, &next, &lease,
+			&r.LastError); err != nil {
+			return nil, err
+		}
+		var err error
+		if r.Args, err = openTaskArgs(args, taskArgsAAD("task_retries", r.RootTaskID)); err != nil {
+			return nil, fmt.Errorf("args of task %s: %w", r.RootTaskID, err)
+		}
+		r.NextAttemptAt, r.LeaseUntil = next.Time, lease.Time
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// DeadLetter is a task that failed on every attempt its policy allowed.
+type DeadLetter struct {
+	ID             int64
+	RootTaskID     string
+	TaskID         string // last attempt
+	VPSID          string
+	TaskName       string
+	Args           []string
+	Attempts       int
+	ExitCode       *int // nil when the last attempt never reached the agent
+	LastError      string
+	CreatedAt      time.Time
+	RedrivenAt     time.Time
+	RedrivenTaskID string
+}
+
+// InsertDeadLetter stores an exhausted task and returns its id.
+func InsertDeadLetter(d DeadLetter) (int64, error) {
+	args, err := sealTaskArgs(d.Args, taskArgsAAD("task_dead_letters", d.RootTaskID))
+	if err != nil {
+		return 0, err
+	}
+	var exitCode sql.NullInt64
+	if d.ExitCode != nil {
+		exitCode = sql.NullInt64{Int64: int64(*d.ExitCode), Valid: true}
+	}
+	var id int64
+	err = db.DB.QueryRow(`INSERT INTO task_dead_letters (root_task_id, task_id, vps_id, task_name, args, attempts,
+			exit_code, last_error, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		d.RootTaskID, d.TaskID, d.VPSID, d.TaskName, args, d.Attempts, exitCode, d.LastError,
+		time.Now().UTC()).Scan(&id)
+	return id, err
+}
+
+// DeadLetterFilter narrows ListDeadLetters; zero values mean "any".
+type DeadLetterFilter struct {
+	VPSID           string
+	IncludeRedriven bool
+	Limit           int
+}
+
+// ListDeadLetters returns the newest dead letters matching f.
+func ListDeadLetters(f DeadLetterFilter) ([]DeadLetter, error) {
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+	rows, err := db.DB.Query(deadLetterSelect+`
+		WHERE ($1 = '' OR vps_id = $1) AND ($2 OR redriven_at IS NULL)
+		ORDER BY id DESC LIMIT $3`, f.VPSID, f.IncludeRedriven, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeadLetters(rows)
+}
+
+// GetDeadLetter returns one dead letter.
+func GetDeadLetter(id int64) (DeadLetter, bool, error) {
+	rows, err := db.DB.Query(deadLetterSelect+` WHERE id = $1`, id)
+	if err != nil {
+		return DeadLetter{}, false, err
+	}
+	out, err := scanDeadLetters(rows)
+	if err != nil || len(out) == 0 {
+		return DeadLetter{}, false, err
+	}
+	return out[0], true, nil
+}
+
+// MarkDeadLetterRedriven records the task that re-ran a dead letter; it is
+// false if another request got there first.
+func MarkDeadLetterRedriven(id int64, taskID string) (bool, error) {
+	res, err := db.DB.Exec(`UPDATE task_dead_letters SET redriven_at = $2, redriven_task_id = $3
+		WHERE id = $1 AND redriven_at IS NULL`, id, time.Now().UTC(), taskID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ResetDeadLetterRedrive undoes MarkDeadLetterRedriven after a failed send.
+func ResetDeadLetterRedrive(id int64) error {
+	_, err := db.DB.Exec(`UPDATE task_dead_letters SET redriven_at = NULL, redriven_task_id = NULL WHERE id = $1`, id)
+	return err
+}
+
+const deadLetterSelect = `SELECT id, root_task_id, task_id, vps_id, task_name, args, attempts, exit_code,
+		COALESCE(last_error, ''), created_at, redriven_at, COALESCE(redriven_task_id, '')
+	FROM task_dead_letters`
+
+func scanDeadLetters(rows *sql.Rows) ([]DeadLetter, error) {
+	defer rows.Close()
+	out := []DeadLetter{}
+	for rows.Next() {
+		var d DeadLetter
+		var args string
+		var exitCode sql.NullInt64
+		var redriven sql.NullTime
+		if err := rows.Scan(&d.ID, &d.RootTaskID, &d.TaskID, &d.VPSID, &d.TaskName, &args, &d.Attempts, &exitCode,
+			&d.LastError, &d.CreatedAt, &redriven, &d.RedrivenTaskID); err != nil {
+			return nil, err
+		}
+		var err error
+		if d.Args, err = openTaskArgs(args, taskArgsAAD("task_dead_letters", d.RootTaskID)); err != nil {
+			return nil, fmt.Errorf("args of dead letter %d: %w", d.ID, err)
+		}
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			d.ExitCode = &code
+		}
+		d.RedrivenAt = redriven.Time
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// RekeyTaskArgs re-wraps the args of retries and dead letters under the active
+// KEK, sealing rows stored before args were encrypted.
+func RekeyTaskArgs() (int, error) {
+	n := 0
+	for _, table := range []string{"task_retries", "task_dead_letters"} {
+		rows, err := db.DB.Query(`SELECT root_task_id, args FROM ` + table)
+		if err != nil {
+			return n, err
+		}
+		type row struct{ root, args string }
+		var all []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.root, &r.args); err != nil {
+				rows.Close()
+				return n, err
+			}
+			all = append(all, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return n, err
+		}
+
+		for _, r := range all {
+			sealed, changed, err := resealColumn(r.args, taskArgsAAD(table, r.root))
+			if err != nil {
+				return n, fmt.Errorf("%s %s: %w", table, r.root, err)
+			}
+			if !changed {
+				continue
+			}
+			if _, err := db.DB.Exec(`UPDATE `+table+` SET args = $3 WHERE root_task_id = $1 AND args = $2`,
+				r.root, r.args, sealed); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+
+	"ultahost-ai-gateway/internal/pkg/db"
+	"ultahost-ai-gateway/internal/utils"
+)
+
+func taskKeyAAD(kid string) string {
+	return "task_signing_keys|" + kid + "|private_key"
+}
+
+// SaveTaskSigningKey upserts a gateway task-signing key; the private seed is envelope-encrypted.
+func SaveTaskSigningKey(k utils.TaskSigningKey) error {
+	sealed, err := utils.SealSecret(k.PrivateKey.Seed(), taskKeyAAD(k.KeyID))
+	if err != nil {
+		return fmt.Errorf("seal task signing key: %w", err)
+	}
+	_, err = db.DB.Exec(`INSERT INTO task_signing_keys (kid, public_key, private_key, key_id, created_at, retired_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (kid) DO UPDATE SET retired_at = EXCLUDED.retired_at`,
+		k.KeyID, base64.StdEncoding.EncodeToString(k.PublicKey), sealed, utils.ActiveKeyID(),
+		k.CreatedAt.UTC(), nullTime(k.RetiredAt))
+	if err != nil {
+		return err
+	}
+	return NotifyCluster(ChannelTaskSigningKeys, k.KeyID)
+}
+
+// LoadTaskSigningKeys reads and decrypts every stored task-signing key.
+func LoadTaskSigningKeys() ([]utils.TaskSigningKey, error) {
+	rows, err := db.DB.Query(`SELECT kid, private_key, created_at, retired_at FROM task_signing_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []utils.TaskSigningKey
+	for rows.Next() {
+		var (
+			k       utils.TaskSigningKey
+			sealed  string
+			retired sql.NullTime
+		)
+		if err := rows.Scan(&k.KeyID, &sealed, &k.CreatedAt, &retired); err != nil {
+			return nil, err
+		}
+		seed, err := utils.OpenSecret(sealed, taskKeyAAD(k.KeyID))
+		if err != nil {
+			return nil, fmt.Errorf("open task signing key %s: %w", k.KeyID, err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("task signing key %s: bad seed length", k.KeyID)
+		}
+		k.PrivateKey = ed25519.NewKeyFromSeed(seed)
+		k.PublicKey = k.PrivateKey.Public().(ed25519.PublicKey)
+		k.RetiredAt = retired.Time
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+// RekeyTaskSigningKeys re-wraps task-signing key seeds under the active KEK.
+func RekeyTaskSigningKeys() (int, error) {
+	rows, err := db.DB.Query(`SELECT kid, private_key FROM task_signing_keys`)
+	if err != nil {
+		return 0, err
+	}
+	sealed := map[string]string{}
+	for rows.Next() {
+		var kid, v string
+		if err := rows.Scan(&kid, &v); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sealed[kid] = v
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for kid, v := range sealed {
+		resealed, changed, err := utils.ResealSecret(v)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", kid, err)
+		}
+		if !changed {
+			continue
+		}
+		if _, err := db.DB.Exec(`UPDATE task_signing_keys SET private_key = $2, key_id = $3 WHERE kid = $1`,
+			kid, resealed, utils.ActiveKeyID()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
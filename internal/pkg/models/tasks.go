@@ -7,6 +7,13 @@ type TaskTemplate struct {
 	ID          int       `db:"id"`
 	Name        string    `db:"name"`         // e.g., "install_wordpress"
 	Description string    `db:"description"`
+	OfflineTTLSeconds *int `db:"offline_ttl_seconds"` // nil: OFFLINE_DEFAULT_TTL_SECONDS
+	MaxRuntimeSeconds *int `db:"max_runtime_seconds"` // nil: no limit from the template
+	LockName    string    `db:"lock_name"`    // e.g. "package_manager"; empty: no exclusive lock
+	RetryMaxAttempts       *int  `db:"retry_max_attempts"`        // nil: a single try
+	RetryBackoffSeconds    *int  `db:"retry_backoff_seconds"`     // first delay, doubled per attempt
+	RetryMaxBackoffSeconds *int  `db:"retry_max_backoff_seconds"` // cap on the delay
+	RetryExitCodes         []int `db:"retry_exit_codes"`          // agent exit codes worth retrying
 	CreatedAt   time.Time `db:"created_at"`
 	UpdatedAt   time.Time `db:"updated_at"`
 }
@@ -17,7 +24,14 @@ type Task struct {
 	TaskTemplateID int    `db:"task_template_id"` // references task_templates.id
 	AgentID     int       `db:"agent_id"`          // references agents.id
 	TaskID      string    `db:"task_id"`           // server-generated UUID (matches websocket)
-	Status      string    `db:"status"`            // pending, running, success, failed
+	VPSID       string    `db:"vps_id"`
+	TaskName    string    `db:"task_name"`         // allowlist name, e.g. "install_wordpress"
+	Status      string    `db:"status"`            // waiting, queued, sent, success, failed, expired, cancelled
+	ExpiresAt   time.Time `db:"expires_at"`        // zero: never expires in the offline queue
+	Deadline    time.Time `db:"deadline"`          // zero: none
+	Late        bool      `db:"late"`              // result arrived after the deadline
+	Attempt     int       `db:"attempt"`           // 1 for the first try
+	RootTaskID  string    `db:"root_task_id"`      // task_id of the first try; empty on it
 	ExitCode    int       `db:"exit_code"`
 	Stdout      string    `db:"stdout"`
 	Stderr      string    `db:"stderr"`
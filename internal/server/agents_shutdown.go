@@ -2,15 +2,12 @@ package server
 
 import "ultahost-ai-gateway/internal/websocket"
 
-// Iterates pool and closes Send to trigger writePump close frames.
+// Iterates pool and closes each connection to trigger writePump close frames.
+// Unacknowledged deliveries are queued first so they survive the restart.
 func CloseAllAgentConnections() {
 	websocket.PoolRange(func(_ string, a *websocket.AgentConn) bool {
-		select {
-		case <-a.Closed():
-			// already closed
-		default:
-			close(a.Send)
-		}
+		a.RequeueUnacked()
+		a.Close()
 		return true
 	})
 }
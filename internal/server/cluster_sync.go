@@ -0,0 +1,112 @@
+// internal/server/cluster_sync.go
+package server
+
+import (
+	"log"
+	"time"
+
+	"ultahost-ai-gateway/internal/api"
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+	"ultahost-ai-gateway/internal/websocket"
+
+	"github.com/lib/pq"
+)
+
+// StartClusterSync keeps the in-memory key stores, certificate deny-list and
+// quarantines of this replica in step with changes made on other nodes
+// (enrollment, renewal, secret rotation, task signing key rotation, revocation,
+// quarantine and release), announced through Postgres LISTEN/NOTIFY.
+func StartClusterSync() error {
+	if !config.AppConfig.Clustered() {
+		return nil
+	}
+	listener := pq.NewListener(config.AppConfig.DatabaseURL, 10*time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("cluster listener: %v", err)
+			}
+		})
+	for _, ch := range []string{models.ChannelAgentKeys, models.ChannelTaskSigningKeys, models.ChannelRevocations,
+		models.ChannelQuarantine, models.ChannelQuarantineRelease} {
+		if err := listener.Listen(ch); err != nil {
+			return err
+		}
+	}
+	websocket.StartClusterDirectory()
+
+	go func() {
+		for n := range listener.Notify {
+			if n == nil {
+				// Reconnected: notifications may have been missed
+				reloadAllAgentKeys()
+				reloadTaskSigningKeys()
+				syncRevocations("")
+				syncQuarantine("")
+				continue
+			}
+			node, payload := models.ParseClusterNotification(n.Extra)
+			if node == config.AppConfig.NodeID {
+				continue
+			}
+			switch n.Channel {
+			case models.ChannelAgentKeys:
+				reloadAgentKeys(payload)
+			case models.ChannelTaskSigningKeys:
+				reloadTaskSigningKeys()
+			case models.ChannelRevocations:
+				syncRevocations(payload)
+			case models.ChannelQuarantine, models.ChannelQuarantineRelease:
+				syncQuarantine(payload)
+			}
+		}
+	}()
+	return nil
+}
+
+func reloadAgentKeys(cn string) {
+	k, ok, err := models.LoadAgentKeyRecord(cn)
+	if err != nil {
+		log.Printf("cluster: reload keys of %s: %v", cn, err)
+		return
+	}
+	if ok {
+		utils.SaveAgentKeys(cn, k)
+	}
+}
+
+func reloadAllAgentKeys() {
+	keys, err := models.LoadAgentKeyRecords()
+	if err != nil {
+		log.Printf("cluster: reload agent keys: %v", err)
+		return
+	}
+	for cn, k := range keys {
+		utils.SaveAgentKeys(cn, k)
+	}
+}
+
+// reloadTaskSigningKeys adopts a key set rotated on another node and hands it
+// to the agents connected here.
+func reloadTaskSigningKeys() {
+	keys, err := models.LoadTaskSigningKeys()
+	if err != nil {
+		log.Printf("cluster: reload task signing keys: %v", err)
+		return
+	}
+	utils.SetTaskSigningKeys(keys)
+	websocket.BroadcastTaskSigningKeys()
+}
+
+func syncRevocations(cn string) {
+	if err := api.SyncRevocations(cn); err != nil {
+		log.Printf("cluster: reload revocations: %v", err)
+	}
+}
+
+func syncQuarantine(cn string) {
+	if err := websocket.SyncQuarantine(cn); err != nil {
+		log.Printf("cluster: reload quarantine of %q: %v", cn, err)
+	}
+}
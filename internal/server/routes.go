@@ -2,11 +2,16 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/pprof" // NEW
+	"time"
 
 	"ultahost-ai-gateway/internal/api"
+	"ultahost-ai-gateway/internal/pkg/models"
 	"ultahost-ai-gateway/internal/websocket"
 
 	"github.com/gin-gonic/gin"
@@ -18,6 +23,31 @@ func RegisterRoutes(r *gin.Engine) {
 	// Agent connect / register
 	r.GET("/agent/connect", websocket.HandleAgentWebSocket)
 	r.POST("/agent/register", api.InstallTokenMiddleware(), api.HandleAgentRegister)
+	r.GET("/pki/crl", api.HandleCRL)
+	r.GET("/pki/task-signing-keys", api.HandleTaskSigningKeys)
+
+	// Operator endpoints (ADMIN_TOKEN)
+	admin := r.Group("", api.AdminMiddleware())
+	admin.GET("/audit/verify", api.HandleAuditVerify)
+	admin.GET("/audit/export", api.HandleAuditExport)
+	admin.GET("/security/events", api.HandleListSecurityEvents)
+	admin.GET("/agents/quarantine", api.HandleListQuarantine)
+	admin.POST("/agents/:vpsId/quarantine", api.HandleQuarantineAgent)
+	admin.POST("/agents/:vpsId/quarantine/release", api.HandleReleaseQuarantine)
+	admin.POST("/agents/:vpsId/secret/rotate", api.HandleRotateAgentSecret)
+	admin.POST("/agents/secrets/rotate", api.HandleRotateAllSecrets)
+	admin.POST("/pki/revoke", api.HandleRevokeCert)
+	admin.GET("/pki/revoked", api.HandleListRevoked)
+	admin.POST("/pki/task-signing-keys/rotate", api.HandleRotateTaskSigningKey)
+	admin.GET("/agents/:vpsId/tasks/queue", api.HandleTaskQueue)
+	admin.DELETE("/tasks/:taskId", api.HandleCancelTask)
+	admin.GET("/tasks/dead-letters", api.HandleListDeadLetters)
+	admin.POST("/tasks/dead-letters/:id/redrive", api.HandleRedriveDeadLetter)
+
+	// Node-to-node (CLUSTER_SECRET)
+	internal := r.Group("/internal/cluster", api.ClusterMiddleware())
+	internal.POST("/deliver", api.HandleClusterDeliver)
+	internal.POST("/task-result", api.HandleClusterTaskResult)
 
 	// Auth-protected
 	r.Use(api.AuthMiddleware())
@@ -27,7 +57,8 @@ func RegisterRoutes(r *gin.Engine) {
 	// Message routing by agent ID
 	r.POST("/agents/:vpsId/send", func(c *gin.Context) {
 		type req struct {
-			Payload json.RawMessage `json:"payload" binding:"required"`
+			Payload    json.RawMessage `json:"payload" binding:"required"`
+			TTLSeconds int             `json:"ttl_seconds"` // offline-queue lifetime; 0 default, -1 never
 		}
 		var body req
 		if err := c.ShouldBindJSON(&body); err != nil {
@@ -35,33 +66,36 @@ func RegisterRoutes(r *gin.Engine) {
 			return
 		}
 		vpsId := c.Param("vpsId")
-		if err := websocket.SendMessage(vpsId, body.Payload); err != nil {
+		ttl := time.Duration(body.TTLSeconds) * time.Second
+		if err := websocket.SendMessageTTL(vpsId, body.Payload, ttl); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		models.RecordAudit(models.AuditEntry{
+			Action:   "agent_message_sent",
+			Entity:   "vps",
+			EntityID: models.AuditEntityID(vpsId),
+			Details:  payloadSummary(body.Payload),
+		})
 		c.JSON(http.StatusOK, gin.H{"status": "queued"})
 	})
 
 	// Pool & offline stats
 	r.GET("/agents/pool/stats", func(c *gin.Context) {
-		agents, totalMsgs, totalBytes := websocket.OfflineStats()
+		totalMsgs, totalBytes := websocket.OfflineStats()
 		c.JSON(http.StatusOK, gin.H{
 			"active_connections": websocket.PoolCount(),
-			"offline_agents":     agents,
 			"offline_msgs":       totalMsgs,
 			"offline_bytes":      totalBytes,
 		})
 	})
 
 	// --- NEW: health check for quick probes ---
+	// (liveness only: offline stats are in /agents/pool/stats, off the probe)
 	r.GET("/healthz", func(c *gin.Context) {
-		agents, totalMsgs, totalBytes := websocket.OfflineStats()
 		c.JSON(http.StatusOK, gin.H{
 			"ok":                 true,
 			"active_connections": websocket.PoolCount(),
-			"offline_agents":     agents,
-			"offline_msgs":       totalMsgs,
-			"offline_bytes":      totalBytes,
 		})
 	})
 
@@ -77,3 +111,15 @@ func RegisterRoutes(r *gin.Engine) {
 	pp.GET("/debug/pprof/trace", gin.WrapF(pprof.Trace))
 	r.Any("/debug/pprof/*any", func(c *gin.Context) { pp.HandleContext(c) })
 }
+
+// payloadSummary describes a raw agent message for the audit log by type and
+// hash: the chain is permanent, so payloads (which may carry credentials) are
+// never written to it.
+func payloadSummary(payload []byte) string {
+	var head struct {
+		Type string `json:"type"`
+	}
+	_ = json.Unmarshal(payload, &head)
+	sum := sha256.Sum256(payload)
+	return fmt.Sprintf("type=%s size=%d sha256=%s", head.Type, len(payload), hex.EncodeToString(sum[:]))
+}
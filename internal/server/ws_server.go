@@ -2,13 +2,19 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"ultahost-ai-gateway/internal/utils"
+	"ultahost-ai-gateway/internal/websocket"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -27,9 +33,10 @@ func StartWSTLSServer(addr string, h *gin.Engine) *WSTLSServer {
 	}
 
 	tlsConfig := &tls.Config{
-		ClientAuth: tls.RequireAndVerifyClientCert,
-		ClientCAs:  caCertPool,
-		MinVersion: tls.VersionTLS13,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             caCertPool,
+		MinVersion:            tls.VersionTLS13,
+		VerifyPeerCertificate: rejectRevokedCerts,
 	}
 
 	srv := &http.Server{
@@ -53,6 +60,26 @@ func StartWSTLSServer(addr string, h *gin.Engine) *WSTLSServer {
 	return &WSTLSServer{http: srv}
 }
 
+// rejectRevokedCerts runs after chain verification and fails the handshake
+// for certificates on the revocation deny-list (by serial or fingerprint).
+func rejectRevokedCerts(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	fp := hex.EncodeToString(sum[:])
+	if utils.IsCertRevoked(leaf.SerialNumber.Text(16), fp) {
+		websocket.RecordSecurityEvent(websocket.EventRevokedCertificate, websocket.SeverityHigh,
+			leaf.Subject.CommonName, "", "handshake with revoked certificate serial="+leaf.SerialNumber.Text(16))
+		return errors.New("client certificate revoked")
+	}
+	return nil
+}
+
 func (s *WSTLSServer) Shutdown(ctx context.Context) error {
 	return s.http.Shutdown(ctx)
 }
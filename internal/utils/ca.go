@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// ClientCertValidity is the lifetime of agent client certificates.
+const ClientCertValidity = 365 * 24 * time.Hour
+
+// LoadCA reads ca.crt / ca.key (PKCS#8 or PKCS#1 RSA) from the given directories.
+func LoadCA(keyPath, certPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	caCertPEM, err := os.ReadFile(certPath + "/ca.crt")
+	if err != nil {
+		return nil, nil, err
+	}
+	caKeyPEM, err := os.ReadFile(keyPath + "/ca.key")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(caCertPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("failed to parse CA cert PEM")
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ = pem.Decode(caKeyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("failed to parse CA key PEM")
+	}
+
+	// Try to parse PKCS#8 private key
+	keyInterface, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		// fallback: try PKCS#1 parsing
+		caKey, err2 := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err2 != nil {
+			return nil, nil, fmt.Errorf("failed to parse private key: %v / %v", err, err2)
+		}
+		return caCert, caKey, nil
+	}
+
+	caKey, ok := keyInterface.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("private key is not RSA")
+	}
+
+	return caCert, caKey, nil
+}
+
+// ParseAgentCSR decodes a PEM CSR and enforces the agent key policy:
+// self-signature valid, CN equal to expectedCN, and an RSA >= 2048,
+// ECDSA P-256/P-384 or Ed25519 public key.
+func ParseAgentCSR(csrPEM []byte, expectedCN string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("invalid CSR PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR signature invalid: %w", err)
+	}
+	if csr.Subject.CommonName != expectedCN {
+		return nil, fmt.Errorf("CSR common name %q, expected %q", csr.Subject.CommonName, expectedCN)
+	}
+
+	switch pub := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key too small: %d bits", pub.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() && pub.Curve != elliptic.P384() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", csr.PublicKey)
+	}
+	return csr, nil
+}
+
+// SignAgentCSR issues a client certificate for a validated CSR. Only the CN and
+// public key are taken from the request; everything else is set by the gateway.
+func SignAgentCSR(caCert *x509.Certificate, caKey *rsa.PrivateKey, csr *x509.CertificateRequest) ([]byte, *x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: csr.Subject.CommonName},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(ClientCertValidity),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), cert, nil
+}
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"ultahost-ai-gateway/internal/config"
+)
+
+// Envelope encryption for secrets at rest. Each value gets a random data key
+// (DEK); the DEK is wrapped with a key-encryption key (KEK) identified by a key
+// ID. Rotating the KEK only re-wraps DEKs.
+//
+// Sealed format: env1:<kid>:<base64 nonce||wrapped DEK>:<base64 nonce||ciphertext>
+//
+// KEKs come from KEK_BASE64 (+ KEK_ID) or from KEK_FILE, one "kid:base64key"
+// per line. KEK_ACTIVE_ID selects the key used for new seals; other keys are
+// kept only to open older values until the rekey command has run.
+
+const envelopePrefix = "env1"
+
+type keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+var (
+	kr     *keyring
+	krErr  error
+	krOnce sync.Once
+)
+
+// LoadKeyring initialises the KEK keyring once. With no KEK configured at all,
+// a key file is generated at KEK_FILE so development setups keep working.
+func LoadKeyring() error {
+	krOnce.Do(func() {
+		kr, krErr = readKeyring()
+	})
+	return krErr
+}
+
+// ActiveKeyID returns the KEK id new values are sealed with.
+func ActiveKeyID() string {
+	if LoadKeyring() != nil {
+		return ""
+	}
+	return kr.active
+}
+
+func readKeyring() (*keyring, error) {
+	k := &keyring{keys: map[string][]byte{}}
+
+	if b64 := config.String("KEK_BASE64", ""); b64 != "" {
+		if err := k.add(config.String("KEK_ID", "env"), b64); err != nil {
+			return nil, err
+		}
+		k.active = config.String("KEK_ID", "env")
+	}
+
+	path := config.String("KEK_FILE", "./certs/kek.keys")
+	if _, err := os.Stat(path); os.IsNotExist(err) && len(k.keys) == 0 {
+		if err := generateKeyFile(path); err != nil {
+			return nil, err
+		}
+		log.Printf("WARNING: no KEK configured, generated %s; set KEK_FILE/KEK_BASE64 in production", path)
+	}
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			kid, b64, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("%s: expected kid:base64key", path)
+			}
+			if err := k.add(kid, b64); err != nil {
+				return nil, err
+			}
+			if k.active == "" {
+				k.active = kid
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if active := config.String("KEK_ACTIVE_ID", ""); active != "" {
+		k.active = active
+	}
+	if _, ok := k.keys[k.active]; !ok {
+		return nil, fmt.Errorf("active KEK %q not loaded", k.active)
+	}
+	return k, nil
+}
+
+func (k *keyring) add(kid, b64 string) error {
+	if strings.Contains(kid, ":") || kid == "" {
+		return fmt.Errorf("invalid KEK id %q", kid)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+	if err != nil {
+		return fmt.Errorf("KEK %s: %w", kid, err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("KEK %s must be 32 bytes, got %d", kid, len(key))
+	}
+	k.keys[kid] = key
+	return nil
+}
+
+func generateKeyFile(path string) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	line := "k1:" + base64.StdEncoding.EncodeToString(key) + "\n"
+	return os.WriteFile(path, []byte(line), 0600)
+}
+
+func gcmSeal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed value too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// SealSecret envelope-encrypts plaintext. aad binds the value to its location
+// (e.g. "agent_keys|Agent_42|signature_secret") so ciphertexts cannot be swapped between rows.
+func SealSecret(plaintext []byte, aad string) (string, error) {
+	if err := LoadKeyring(); err != nil {
+		return "", err
+	}
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+	ct, err := gcmSeal(dek, plaintext, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return wrapDEK(kr.active, dek, ct)
+}
+
+func wrapDEK(kid string, dek, ct []byte) (string, error) {
+	wrapped, err := gcmSeal(kr.keys[kid], dek, []byte("dek|"+kid))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		envelopePrefix,
+		kid,
+		base64.StdEncoding.EncodeToString(wrapped),
+		base64.StdEncoding.EncodeToString(ct),
+	}, ":"), nil
+}
+
+func unwrapDEK(sealed string) (kid string, dek, ct []byte, err error) {
+	if err := LoadKeyring(); err != nil {
+		return "", nil, nil, err
+	}
+	parts := strings.Split(sealed, ":")
+	if len(parts) != 4 || parts[0] != envelopePrefix {
+		return "", nil, nil, fmt.Errorf("not an envelope-encrypted value")
+	}
+	kid = parts[1]
+	kek, ok := kr.keys[kid]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("KEK %q not loaded", kid)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	ct, err = base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dek, err = gcmOpen(kek, wrapped, []byte("dek|"+kid))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("unwrap DEK with %s: %w", kid, err)
+	}
+	return kid, dek, ct, nil
+}
+
+// OpenSecret decrypts a value produced by SealSecret with the same aad.
+func OpenSecret(sealed, aad string) ([]byte, error) {
+	_, dek, ct, err := unwrapDEK(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dek, ct, []byte(aad))
+}
+
+// IsSealed reports whether a stored value is in envelope format (vs legacy plaintext).
+func IsSealed(v string) bool {
+	return strings.HasPrefix(v, envelopePrefix+":")
+}
+
+// ResealSecret re-wraps the DEK of a sealed value under the active KEK.
+// The data ciphertext is untouched. changed is false if it already used the active key.
+func ResealSecret(sealed string) (resealed string, changed bool, err error) {
+	kid, dek, ct, err := unwrapDEK(sealed)
+	if err != nil {
+		return "", false, err
+	}
+	if kid == kr.active {
+		return sealed, false, nil
+	}
+	resealed, err = wrapDEK(kr.active, dek, ct)
+	return resealed, err == nil, err
+}
@@ -7,15 +7,55 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 type AgentKeys struct {
 	IdentityToken     string
 	SignatureSecret   string
 	Certificate       string `json:"certificate_pem"`
-	PrivateKey        string
 	FingerprintSHA256 string
-	
+
+	// Renewal overlap: the replaced certificate stays valid until PreviousFingerprintUntil.
+	PreviousFingerprintSHA256 string
+	PreviousFingerprintUntil  time.Time
+
+	// Secret rotation: the pending secret is accepted alongside SignatureSecret
+	// until PendingSecretUntil; the agent's ack promotes it and retires the old one.
+	PendingSignatureSecret string
+	PendingRotationID      string
+	PendingSecretUntil     time.Time
+	RotateOnConnect        bool // forced rotation waiting for the agent to come online
+
+	TaskSigAlg string // TaskSigHMAC or TaskSigEd25519; empty means HMAC
+}
+
+// TaskSigAlgorithm returns how tasks for this agent are signed.
+func (k AgentKeys) TaskSigAlgorithm() string {
+	if k.TaskSigAlg == TaskSigEd25519 {
+		return TaskSigEd25519
+	}
+	return TaskSigHMAC
+}
+
+// CandidateSecrets returns the secrets an agent-signed message may use:
+// the current one plus a pending rotation still inside its grace period.
+func (k AgentKeys) CandidateSecrets() []string {
+	out := []string{k.SignatureSecret}
+	if k.PendingSignatureSecret != "" && time.Now().Before(k.PendingSecretUntil) {
+		out = append(out, k.PendingSignatureSecret)
+	}
+	return out
+}
+
+// AcceptsFingerprint reports whether fp is the current certificate or the
+// previous one still inside its renewal overlap window.
+func (k AgentKeys) AcceptsFingerprint(fp string) bool {
+	if fp == k.FingerprintSHA256 {
+		return true
+	}
+	return k.PreviousFingerprintSHA256 != "" && fp == k.PreviousFingerprintSHA256 &&
+		time.Now().Before(k.PreviousFingerprintUntil)
 }
 
 var (
@@ -37,6 +77,42 @@ func GetAgentKeys(CommonName string) (AgentKeys, bool) {
 	return keys, exists
 }
 
+// UpdateAgentKeys applies fn to the stored keys under the store lock.
+func UpdateAgentKeys(CommonName string, fn func(keys *AgentKeys)) (AgentKeys, bool) {
+	agentKeysStoreMu.Lock()
+	defer agentKeysStoreMu.Unlock()
+	keys, exists := agentKeysStore[CommonName]
+	if !exists {
+		return AgentKeys{}, false
+	}
+	fn(&keys)
+	agentKeysStore[CommonName] = keys
+	return keys, true
+}
+
+// AgentCommonNames lists every enrolled agent CN.
+func AgentCommonNames() []string {
+	agentKeysStoreMu.Lock()
+	defer agentKeysStoreMu.Unlock()
+	out := make([]string, 0, len(agentKeysStore))
+	for cn := range agentKeysStore {
+		out = append(out, cn)
+	}
+	return out
+}
+
+// FindAgentKeys returns the first enrolled agent matching fn, with its CommonName.
+func FindAgentKeys(fn func(CommonName string, keys AgentKeys) bool) (string, AgentKeys, bool) {
+	agentKeysStoreMu.Lock()
+	defer agentKeysStoreMu.Unlock()
+	for cn, keys := range agentKeysStore {
+		if fn(cn, keys) {
+			return cn, keys, true
+		}
+	}
+	return "", AgentKeys{}, false
+}
+
 // GetAgentKeysByIdentity loads cert+key for a specific agent by its identity token
 func GetAgentKeysByIdentity(identityToken string) (*tls.Certificate, error) {
 	agentDir := filepath.Join("./agents", identityToken)
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RevokedCert is one entry of the certificate deny-list.
+// Either Serial or FingerprintSHA256 may be empty when revoked by the other.
+type RevokedCert struct {
+	Serial            string    `json:"serial"` // lowercase hex
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+	CommonName        string    `json:"common_name"`
+	Reason            string    `json:"reason"`
+	RevokedAt         time.Time `json:"revoked_at"`
+}
+
+var (
+	revokedBySerial = make(map[string]RevokedCert)
+	revokedByFP     = make(map[string]RevokedCert)
+	revokedMu       sync.RWMutex
+)
+
+// NormalizeSerial accepts "0x1A2B", "1a:2b" or "1A2B" and returns "1a2b".
+func NormalizeSerial(serial string) string {
+	s := strings.ToLower(strings.TrimSpace(serial))
+	s = strings.TrimPrefix(s, "0x")
+	s = strings.ReplaceAll(s, ":", "")
+	return strings.TrimLeft(s, "0")
+}
+
+// RevokeCert adds a certificate to the in-memory deny-list.
+func RevokeCert(rc RevokedCert) {
+	rc.Serial = NormalizeSerial(rc.Serial)
+	rc.FingerprintSHA256 = strings.ToLower(rc.FingerprintSHA256)
+
+	revokedMu.Lock()
+	defer revokedMu.Unlock()
+	if rc.Serial != "" {
+		revokedBySerial[rc.Serial] = rc
+	}
+	if rc.FingerprintSHA256 != "" {
+		revokedByFP[rc.FingerprintSHA256] = rc
+	}
+}
+
+// IsCertRevoked reports whether a certificate matches the deny-list by serial or fingerprint.
+func IsCertRevoked(serial, fingerprint string) bool {
+	revokedMu.RLock()
+	defer revokedMu.RUnlock()
+	if _, ok := revokedBySerial[NormalizeSerial(serial)]; ok {
+		return true
+	}
+	_, ok := revokedByFP[strings.ToLower(fingerprint)]
+	return ok
+}
+
+// ListRevokedCerts returns every deny-list entry (serial entries first, fingerprint-only after).
+func ListRevokedCerts() []RevokedCert {
+	revokedMu.RLock()
+	defer revokedMu.RUnlock()
+	out := make([]RevokedCert, 0, len(revokedBySerial))
+	for _, rc := range revokedBySerial {
+		out = append(out, rc)
+	}
+	for _, rc := range revokedByFP {
+		if rc.Serial == "" {
+			out = append(out, rc)
+		}
+	}
+	return out
+}
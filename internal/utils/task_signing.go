@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+)
+
+// Task signature algorithms. Agents enrolled before Ed25519 support keep HMAC.
+const (
+	TaskSigHMAC    = "hmac-sha256"
+	TaskSigEd25519 = "ed25519"
+)
+
+// Retired task-signing keys stay published for TASK_SIGNING_KEY_OVERLAP_HOURS
+// so tasks already queued under them still verify on the agent.
+var taskKeyOverlap = time.Duration(config.Int("TASK_SIGNING_KEY_OVERLAP_HOURS", 72)) * time.Hour
+
+// TaskSigningKey is a gateway Ed25519 key used to sign tasks.
+type TaskSigningKey struct {
+	KeyID      string
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	CreatedAt  time.Time
+	RetiredAt  time.Time // zero while active
+}
+
+// PublishedSigningKey is the public half handed to agents.
+type PublishedSigningKey struct {
+	KeyID     string `json:"kid"`
+	Alg       string `json:"alg"`
+	PublicKey string `json:"public_key"` // base64 raw Ed25519 key
+	CreatedAt string `json:"created_at"`
+	RetiredAt string `json:"retired_at,omitempty"`
+}
+
+var (
+	taskKeysMu sync.RWMutex
+	taskKeys   []TaskSigningKey // oldest first; the last non-retired key is active
+)
+
+// GenerateTaskSigningKey creates a new key with a sortable key ID.
+func GenerateTaskSigningKey() (TaskSigningKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return TaskSigningKey{}, err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return TaskSigningKey{}, err
+	}
+	now := time.Now().UTC()
+	return TaskSigningKey{
+		KeyID:      "ts-" + now.Format("20060102") + "-" + hex.EncodeToString(suffix),
+		PublicKey:  pub,
+		PrivateKey: priv,
+		CreatedAt:  now,
+	}, nil
+}
+
+// SetTaskSigningKeys replaces the in-memory keyring (startup and rotation).
+func SetTaskSigningKeys(keys []TaskSigningKey) {
+	sorted := append([]TaskSigningKey(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreatedAt.Before(sorted[j].CreatedAt) })
+	taskKeysMu.Lock()
+	taskKeys = sorted
+	taskKeysMu.Unlock()
+}
+
+// TaskSigningKeys returns a copy of the keyring, oldest first.
+func TaskSigningKeys() []TaskSigningKey {
+	taskKeysMu.RLock()
+	defer taskKeysMu.RUnlock()
+	return append([]TaskSigningKey(nil), taskKeys...)
+}
+
+func activeTaskKeyLocked() (TaskSigningKey, bool) {
+	for i := len(taskKeys) - 1; i >= 0; i-- {
+		if taskKeys[i].RetiredAt.IsZero() {
+			return taskKeys[i], true
+		}
+	}
+	return TaskSigningKey{}, false
+}
+
+// ActiveTaskSigningKey returns the key new tasks are signed with.
+func ActiveTaskSigningKey() (TaskSigningKey, bool) {
+	taskKeysMu.RLock()
+	defer taskKeysMu.RUnlock()
+	return activeTaskKeyLocked()
+}
+
+// Sign returns the base64 Ed25519 signature of msg.
+func (k TaskSigningKey) Sign(msg string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(k.PrivateKey, []byte(msg)))
+}
+
+// PublishedTaskSigningKeys lists the public keys agents should trust: the active
+// key plus retired keys still inside the overlap window.
+func PublishedTaskSigningKeys() []PublishedSigningKey {
+	taskKeysMu.RLock()
+	defer taskKeysMu.RUnlock()
+	out := []PublishedSigningKey{}
+	for _, k := range taskKeys {
+		if !k.RetiredAt.IsZero() && time.Since(k.RetiredAt) > taskKeyOverlap {
+			continue
+		}
+		p := PublishedSigningKey{
+			KeyID:     k.KeyID,
+			Alg:       TaskSigEd25519,
+			PublicKey: base64.StdEncoding.EncodeToString(k.PublicKey),
+			CreatedAt: k.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		if !k.RetiredAt.IsZero() {
+			p.RetiredAt = k.RetiredAt.UTC().Format(time.RFC3339)
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// SignWithPublishedTaskKeys signs msg with every published key, so an agent that
+// only knows an older key can still authenticate a key-set update.
+func SignWithPublishedTaskKeys(msg string) map[string]string {
+	published := map[string]bool{}
+	for _, p := range PublishedTaskSigningKeys() {
+		published[p.KeyID] = true
+	}
+	taskKeysMu.RLock()
+	defer taskKeysMu.RUnlock()
+	out := map[string]string{}
+	for _, k := range taskKeys {
+		if published[k.KeyID] {
+			out[k.KeyID] = k.Sign(msg)
+		}
+	}
+	return out
+}
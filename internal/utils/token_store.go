@@ -29,17 +29,36 @@ func SaveInstallToken(token string, userID, vpsID string, ttl time.Duration) {
 	}
 }
 
+// LookupInstallToken returns token data without using the token up
+func LookupInstallToken(token string) (TokenData, bool) {
+	tokenStoreMu.Lock()
+	defer tokenStoreMu.Unlock()
+
+	data, exists := tokenStore[token]
+	if !exists {
+		return TokenData{}, false
+	}
+	if time.Now().After(data.Expiry) {
+		delete(tokenStore, token)
+		return TokenData{}, false
+	}
+	return data, true
+}
+
 // ConsumeInstallToken returns token data and deletes it
 func ConsumeInstallToken(token string) (TokenData, bool) {
 	tokenStoreMu.Lock()
 	defer tokenStoreMu.Unlock()
 
 	data, exists := tokenStore[token]
-	if !exists || time.Now().After(data.Expiry) {
-		// return TokenData{}, false
+	if !exists {
+		return TokenData{}, false
 	}
 
 	// Delete token so it can't be reused
 	delete(tokenStore, token)
+	if time.Now().After(data.Expiry) {
+		return TokenData{}, false
+	}
 	return data, true
 }
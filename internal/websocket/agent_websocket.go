@@ -11,7 +11,7 @@ import (
 	"sync"
 	"time"
 
-	"ultahost-ai-gateway/internal/config" // NEW
+	"ultahost-ai-gateway/internal/pkg/models"
 	"ultahost-ai-gateway/internal/utils"
 
 	"github.com/gin-gonic/gin"
@@ -27,14 +27,34 @@ var upgrader = ws.Upgrader{
 
 type AgentConn struct {
 	Conn                 *ws.Conn
+	CommonName           string // certificate CN, "Agent_<vpsId>"
 	IdentityToken        string
 	LastHeartbeatCounter uint64
 	LastSeen             time.Time
+	CertNotAfter         time.Time // expiry of the presented client certificate
+	connectedAt          time.Time // identifies this connection in the cluster directory (µs, as stored)
 
-	Send   chan []byte   // bounded outbound queue
-	closed chan struct{} // closed when writer exits
+	sendQ    *sendQueue    // outbound priority lanes
+	quit     chan struct{} // closed by Close to stop the writer
+	quitOnce sync.Once
+	closed   chan struct{} // closed when writer exits
 
-	mu sync.Mutex
+	spillMu  sync.Mutex
+	spilling bool // messages go to the offline queue until it is flushed (spill policy)
+
+	mu             sync.Mutex
+	certRenewAsked time.Time // last cert_renew sent on this connection
+	certRenewed    bool      // a renewal was issued on this connection
+
+	envelopeSeq  uint64 // highest envelope seq accepted (seeded from agent_counters)
+	envelopeOnly bool   // bare (unenveloped) messages are refused
+
+	protocolVersion int                       // negotiated by hello; 0 means none yet (v1)
+	info            *models.AgentCapabilities // from hello; nil until it arrives
+	sessionOnce     sync.Once                 // startSession runs once per connection
+
+	unacked        map[uint64]models.OfflineMessage // delivery seq -> message awaiting ack
+	deliveryClosed bool                             // window handed back to the offline queue
 }
 
 const (
@@ -45,13 +65,21 @@ const (
 )
 
 func HandleAgentWebSocket(c *gin.Context) {
+	remoteAddr := c.Request.RemoteAddr
 	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+		recordSecurityEvent(EventClientCertMissing, SeverityMedium, "", remoteAddr, "connect attempt without client certificate")
 		c.String(http.StatusUnauthorized, "Client certificate required")
 		return
 	}
 	clientCert := c.Request.TLS.PeerCertificates[0]
 	cn := clientCert.Subject.CommonName
 
+	if IsQuarantined(cn) {
+		recordSecurityEvent(EventQuarantinedConnect, SeverityMedium, cn, remoteAddr, "connect refused: identity quarantined")
+		c.String(http.StatusForbidden, "agent quarantined")
+		return
+	}
+
 	// Upgrade to WS
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -62,6 +90,7 @@ func HandleAgentWebSocket(c *gin.Context) {
 	// Lookup issued keys
 	keyInfo, exist := utils.GetAgentKeys(cn)
 	if !exist {
+		recordSecurityEvent(EventUnknownAgent, SeverityHigh, cn, remoteAddr, "certificate CN is not enrolled")
 		_ = conn.WriteMessage(ws.TextMessage, []byte("agent not enrolled"))
 		_ = conn.Close()
 		return
@@ -69,31 +98,41 @@ func HandleAgentWebSocket(c *gin.Context) {
 
 	// Fingerprint check
 	presentedFP := sha256.Sum256(clientCert.Raw)
-	if hex.EncodeToString(presentedFP[:]) != keyInfo.FingerprintSHA256 {
+	if !keyInfo.AcceptsFingerprint(hex.EncodeToString(presentedFP[:])) {
+		recordSecurityEvent(EventFingerprintMismatch, SeverityHigh, cn, remoteAddr,
+			"presented certificate "+hex.EncodeToString(presentedFP[:])+" does not match enrolled fingerprint")
 		_ = conn.WriteMessage(ws.TextMessage, []byte("certificate fingerprint mismatch"))
 		_ = conn.Close()
 		return
 	}
 
 	// Build connection
-	sendQ := config.Int("WS_SEND_QUEUE", 64)
-	if sendQ < 1 {
-		sendQ = 1
-	} else if sendQ > 1024 {
-		sendQ = 1024 // hard ceiling
-	}
-
 	agentConn := &AgentConn{
 		Conn:          conn,
+		CommonName:    cn,
 		IdentityToken: keyInfo.IdentityToken,
 		LastSeen:      time.Now(),
-		Send:          make(chan []byte, sendQ), // CHANGED
+		CertNotAfter:  clientCert.NotAfter,
+		connectedAt:   time.Now().UTC().Truncate(time.Microsecond),
+		sendQ:         newSendQueue(),
+		quit:          make(chan struct{}),
 		closed:        make(chan struct{}),
 	}
 
+	// Seed replay protection; an agent that ever sent an envelope may not fall back to bare messages
+	agentConn.envelopeOnly = envelopeRequired
+	if hw, err := models.GetAgentHighWater(cn); err != nil {
+		log.Printf("load envelope counter for %s: %v", cn, err)
+	} else if hw > 0 {
+		agentConn.envelopeSeq = hw
+		agentConn.envelopeOnly = true
+	}
+
 	// Auto-reconnect: replace any existing for this identity
 	PoolPut(keyInfo.IdentityToken, agentConn)
 	metricsIncActive()
+	endReconnectGrace(keyInfo.IdentityToken)
+	registerConnection(agentConn)
 
 	// WS read settings
 	conn.SetReadLimit(1 << 20) // 1MiB
@@ -115,28 +154,38 @@ func HandleAgentWebSocket(c *gin.Context) {
 	go writePump(agentConn)
 	go handleAgentReadLoop(agentConn, keyInfo)
 
-	// After connection established, flush any offline-buffered messages
-	go func(identity string, a *AgentConn) {
-		queued := OfflineDrain(identity)
-		if len(queued) > 0 {
-			flushed := 0
-			for _, m := range queued {
-				select {
-				case a.Send <- m:
-					flushed++
-				default:
-					// backpressure: stop flushing to avoid OOM
-					metricsDropped(1)
-					return
-				}
-			}
-			metricsOfflineFlushed(flushed)
-		}
-	}(keyInfo.IdentityToken, agentConn)
+	// Offline flush, renewal and rotation start once the agent has said hello
+	awaitHello(agentConn)
 
 	log.Printf("Agent connected: CN=%s, IdentityToken=%s", cn, keyInfo.IdentityToken)
 }
 
+// flushOfflineBuffer delivers messages queued while the agent was offline,
+// dropping those whose TTL has passed. It waits for room in the send queue; if
+// the connection stalls or ends, the rest goes back to the head of the offline
+// queue.
+func flushOfflineBuffer(a *AgentConn) {
+	queued := OfflineDrain(a.IdentityToken)
+	if len(queued) == 0 {
+		return
+	}
+	now := time.Now()
+	flushed := 0
+	for i, m := range queued {
+		if offlineExpired(m, now) {
+			expireOfflineMessage(a, m)
+			continue
+		}
+		if err := deliver(a, m, writeTimeout); err != nil {
+			log.Printf("offline flush to %s stopped: %v", a.CommonName, err)
+			OfflineRequeue(a.IdentityToken, queued[i:])
+			break
+		}
+		flushed++
+	}
+	metricsOfflineFlushed(flushed)
+}
+
 func writePump(a *AgentConn) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -146,66 +195,84 @@ func writePump(a *AgentConn) {
 		metricsDecActive()
 	}()
 
+	ping := func() bool {
+		a.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return a.Conn.WriteMessage(ws.PingMessage, nil) == nil
+	}
+
 	for {
+		// Close and pings go first, even while the lanes stay busy
 		select {
-		case msg, ok := <-a.Send:
+		case <-a.quit:
 			a.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			if !ok {
-				_ = a.Conn.WriteMessage(ws.CloseMessage, []byte{})
-				return
-			}
-			w, err := a.Conn.NextWriter(ws.TextMessage)
-			if err != nil {
-				return
-			}
-			if _, err := w.Write(msg); err != nil {
-				_ = w.Close()
+			_ = a.Conn.WriteMessage(ws.CloseMessage, []byte{})
+			return
+		case <-ticker.C:
+			if !ping() {
 				return
 			}
+		default:
+		}
 
-			// batch a small burst
-			drain := 0
-			for drain < 16 {
-				select {
-				case more := <-a.Send:
-					if _, err := w.Write([]byte{'\n'}); err != nil {
-						_ = w.Close()
-						return
-					}
-					if _, err := w.Write(more); err != nil {
-						_ = w.Close()
-						return
-					}
-					drain++
-				default:
-					drain = 16
+		f, lane, ok := a.sendQ.pop()
+		if !ok {
+			select {
+			case <-a.sendQ.ready:
+			case <-a.quit:
+			case <-ticker.C:
+				if !ping() {
+					return
 				}
 			}
-			if err := w.Close(); err != nil {
+			continue
+		}
+
+		a.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		w, err := a.Conn.NextWriter(ws.TextMessage)
+		if err != nil {
+			return
+		}
+		if _, err := w.Write(f.data); err != nil {
+			_ = w.Close()
+			return
+		}
+		metricsLane(lane, "written", 1)
+
+		// batch a small burst, still highest lane first
+		drain := 0
+		for drain < 16 {
+			more, lane, ok := a.sendQ.pop()
+			if !ok {
+				break
+			}
+			if _, err := w.Write([]byte{'\n'}); err != nil {
+				_ = w.Close()
 				return
 			}
-			metricsEnqueued(1 + drain)
-
-		case <-ticker.C:
-			a.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			if err := a.Conn.WriteMessage(ws.PingMessage, nil); err != nil {
+			if _, err := w.Write(more.data); err != nil {
+				_ = w.Close()
 				return
 			}
+			metricsLane(lane, "written", 1)
+			drain++
+		}
+		if err := w.Close(); err != nil {
+			return
 		}
+		metricsEnqueued(1 + drain)
 	}
 }
 
 func handleAgentReadLoop(a *AgentConn, keyInfo utils.AgentKeys) {
 	defer func() {
-		PoolDelete(a.IdentityToken)
-		failPendingForAgent(keyInfo.IdentityToken, "connection closed")
-		// Stop writer
-		select {
-		case <-a.closed:
-			// already closed
-		default:
-			close(a.Send)
+		replaced := !poolRemove(a)
+		unregisterConnection(a)
+		a.RequeueUnacked()
+		if !replaced {
+			startReconnectGrace(a)
 		}
+		// Stop writer
+		a.Close()
 		_ = a.Conn.Close()
 	}()
 
@@ -223,21 +290,69 @@ func handleAgentReadLoop(a *AgentConn, keyInfo utils.AgentKeys) {
 			var generic map[string]interface{}
 			if err := json.Unmarshal(msg, &generic); err == nil {
 				if t, ok := generic["type"].(string); ok {
+					enveloped := false
+					if _, ok := generic["payload"]; ok {
+						env, err := openEnvelope(a, msg)
+						if err != nil {
+							log.Printf("envelope rejected (%s): %v", a.CommonName, err)
+							eventType, severity := envelopeEvent(err)
+							recordSecurityEvent(eventType, severity, a.CommonName, a.Conn.RemoteAddr().String(), err.Error())
+							return
+						}
+						t, msg, enveloped = env.Type, env.Payload, true
+					} else if a.envelopeOnly {
+						recordSecurityEvent(EventEnvelopeDowngrade, SeverityHigh, a.CommonName, a.Conn.RemoteAddr().String(),
+							"unsigned "+t+" from an agent that uses signed envelopes")
+						return
+					}
+
+					if helloRequired && t != "hello" && !a.protocolNegotiated() {
+						log.Printf("%s sent %s before hello, closing", a.CommonName, t)
+						return
+					}
+
 					switch t {
 					case "heartbeat":
-						if err := verifyHeartbeat(msg, keyInfo); err != nil {
+						if enveloped {
+							continue // the envelope already proved origin and freshness
+						}
+						keys, _ := utils.GetAgentKeys(a.CommonName) // fresh: rotation may have changed the secret
+						if err := verifyHeartbeat(a, msg, keys); err != nil {
 							log.Printf("heartbeat verification failed (%s): %v", a.IdentityToken, err)
+							eventType, severity := heartbeatEvent(err)
+							recordSecurityEvent(eventType, severity, a.CommonName, a.Conn.RemoteAddr().String(), err.Error())
 							return
 						}
 						continue
+					case "ack":
+						if err := handleDeliveryAck(a, msg); err != nil {
+							log.Printf("ack rejected (%s): %v", a.CommonName, err)
+						}
+						continue
 					case "task_result":
-						var tr TaskResult
-						if err := json.Unmarshal(msg, &tr); err != nil {
-							log.Printf("invalid task_result from %s: %v", keyInfo.IdentityToken, err)
-							continue
+						if err := handleTaskResult(a, msg, enveloped); err != nil {
+							log.Printf("task_result rejected (%s): %v", a.CommonName, err)
+						}
+						continue
+					case "task_cancel_ack":
+						if err := handleTaskCancelAck(a, msg, enveloped); err != nil {
+							log.Printf("task_cancel_ack rejected (%s): %v", a.CommonName, err)
+						}
+						continue
+					case "hello":
+						if err := handleHello(a, msg); err != nil {
+							log.Printf("hello failed (%s): %v", a.CommonName, err)
+							return
+						}
+						continue
+					case "secret_rotate_ack":
+						if err := handleSecretRotateAck(a, msg); err != nil {
+							log.Printf("secret rotation ack rejected (%s): %v", a.CommonName, err)
 						}
-						if resolved := resolvePending(tr.TaskID, tr); !resolved {
-							log.Printf("unknown task_id %s (agent %s)", tr.TaskID, keyInfo.IdentityToken)
+						continue
+					case "cert_csr":
+						if err := handleCertCSR(a, msg); err != nil {
+							log.Printf("certificate renewal failed (%s): %v", a.CommonName, err)
 						}
 						continue
 					}
@@ -248,50 +363,70 @@ func handleAgentReadLoop(a *AgentConn, keyInfo utils.AgentKeys) {
 	}
 }
 
-// verifyHeartbeat unchanged (uses PoolGet)
-func verifyHeartbeat(msg []byte, keyInfo utils.AgentKeys) error {
-	type hb struct {
-		Type      string `json:"type"`
-		Version   int    `json:"version"`
-		AgentID   string `json:"agent_id"`
-		Counter   uint64 `json:"counter"`
-		Nonce     string `json:"nonce"`
-		Timestamp string `json:"timestamp"`
-		Signature string `json:"signature"`
+var (
+	errHeartbeatMalformed = errors.New("malformed heartbeat")
+	errHeartbeatSkew      = errors.New("heartbeat timestamp outside allowed skew")
+	errHeartbeatSignature = errors.New("invalid signature")
+	errHeartbeatReplay    = errors.New("replay or old counter")
+)
+
+// heartbeatEvent maps a verifyHeartbeat error to its security event type and severity.
+func heartbeatEvent(err error) (string, string) {
+	switch {
+	case errors.Is(err, errHeartbeatSignature):
+		return EventHeartbeatSignature, SeverityHigh
+	case errors.Is(err, errHeartbeatReplay):
+		return EventHeartbeatReplay, SeverityHigh
+	case errors.Is(err, errHeartbeatSkew):
+		return EventHeartbeatClockSkew, SeverityMedium
+	default:
+		return EventHeartbeatMalformed, SeverityMedium
 	}
-	var h hb
+}
+
+// verifyHeartbeat checks skew, HMAC and counter monotonicity (uses PoolGet).
+// A heartbeat signed with a pending rotation secret completes that rotation.
+func verifyHeartbeat(a *AgentConn, msg []byte, keyInfo utils.AgentKeys) error {
+	var h Heartbeat
 	if err := json.Unmarshal(msg, &h); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", errHeartbeatMalformed, err)
 	}
-
-	maxSkew := 5 * time.Minute
-	ht, err := time.Parse(time.RFC3339Nano, h.Timestamp)
-	if err != nil {
-		ht, err = time.Parse(time.RFC3339, h.Timestamp)
-		if err != nil {
-			return fmt.Errorf("invalid heartbeat timestamp: %w", err)
-		}
+	formats, ok := protocolRegistry[h.Version]
+	if !ok {
+		return fmt.Errorf("%w: unknown heartbeat version %d", errHeartbeatMalformed, h.Version)
 	}
-	delta := time.Since(ht.UTC())
-	if delta < 0 {
-		delta = -delta
+	if negotiated := a.ProtocolVersion(); h.Version < negotiated {
+		return fmt.Errorf("%w: heartbeat v%d below negotiated v%d", errHeartbeatMalformed, h.Version, negotiated)
 	}
-	if delta > maxSkew {
-		return errors.New("heartbeat timestamp outside allowed skew")
+
+	if _, err := checkAgentTimestamp(h.Timestamp); err != nil {
+		if errors.Is(err, errTimestampSkew) {
+			return errHeartbeatSkew
+		}
+		return fmt.Errorf("%w: %v", errHeartbeatMalformed, err)
 	}
 
-	canon := fmt.Sprintf("%s|%s|%d|%s|%s", h.Version, h.AgentID, h.Counter, h.Nonce, h.Timestamp)
-	expected := utils.HMACSHA256Base64([]byte(keyInfo.SignatureSecret), canon)
-	if expected != h.Signature {
-		return errors.New("invalid signature")
+	secret, ok := matchSecret(keyInfo, formats.Heartbeat(h), h.Signature)
+	if !ok {
+		return errHeartbeatSignature
 	}
 
+	// The per-connection counter resets on reconnect; the process-wide nonce
+	// cache covers replays inside the skew window across reconnects.
+	if !agentNonces.Check(a.CommonName, h.Nonce) {
+		return errHeartbeatReplay
+	}
 	if aConn, ok := PoolGet(keyInfo.IdentityToken); ok {
 		if h.Counter <= aConn.LastHeartbeatCounter {
-			return errors.New("replay or old counter")
+			return errHeartbeatReplay
 		}
 		aConn.LastHeartbeatCounter = h.Counter
 	}
+	if secret != keyInfo.SignatureSecret {
+		if err := completeSecretRotation(a, keyInfo.PendingRotationID, "heartbeat"); err != nil {
+			log.Printf("secret rotation for %s not completed: %v", a.CommonName, err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,187 @@
+// internal/websocket/backpressure.go
+package websocket
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// WS_BACKPRESSURE_POLICY decides what SendMessage and RouteToIdentity do when
+// the agent's lane (or its delivery window) is full:
+//
+//	disconnect   close the connection; unacked deliveries go back to the
+//	             offline queue (default)
+//	block        wait up to WS_BACKPRESSURE_BLOCK_MS for room, then fail with
+//	             the queue-full error, which task retries treat as transient
+//	spill        put the message in the offline queue and move it onto the
+//	             connection as room frees up; messages sent meanwhile follow
+//	             it there, so order is kept
+//	drop_oldest  drop the oldest queued message of the lane that carries no
+//	             task; a lane holding only tasks, or a full delivery window,
+//	             fails as under block
+//
+// Control messages and deliveries forwarded by other nodes are not subject to
+// the policy.
+const (
+	policyDisconnect = "disconnect"
+	policyBlock      = "block"
+	policySpill      = "spill"
+	policyDropOldest = "drop_oldest"
+)
+
+var (
+	backpressurePolicy       = parseBackpressurePolicy(config.String("WS_BACKPRESSURE_POLICY", policyDisconnect))
+	backpressureBlockTimeout = time.Duration(config.Int("WS_BACKPRESSURE_BLOCK_MS", 2000)) * time.Millisecond
+)
+
+func parseBackpressurePolicy(s string) string {
+	switch p := strings.ToLower(strings.TrimSpace(s)); p {
+	case policyDisconnect, policyBlock, policySpill, policyDropOldest:
+		return p
+	}
+	log.Printf("unknown WS_BACKPRESSURE_POLICY %q, using %s", s, policyDisconnect)
+	return policyDisconnect
+}
+
+func queueFull(err error) bool {
+	return errors.Is(err, errSendQueueFull) || errors.Is(err, errDeliveryWindowFull)
+}
+
+// deliverLive puts m on a live connection, applying the backpressure policy
+// when the agent falls behind. It reports whether m went to the offline queue
+// instead; errDeliveryClosed tells the caller to buffer m itself.
+func deliverLive(a *AgentConn, m models.OfflineMessage) (queued bool, err error) {
+	if spillBehind(a, m) {
+		return true, nil
+	}
+	err = deliver(a, m, 0)
+	if err == nil || !queueFull(err) {
+		return false, err
+	}
+
+	switch backpressurePolicy {
+	case policyBlock:
+		if err = deliver(a, m, backpressureBlockTimeout); err == nil {
+			metricsBackpressure(policyBlock, "blocked")
+			return false, nil
+		}
+		if queueFull(err) {
+			metricsBackpressure(policyBlock, "timeout")
+		}
+		return false, err
+	case policySpill:
+		spill(a, m)
+		metricsBackpressure(policySpill, "spilled")
+		return true, nil
+	case policyDropOldest:
+		if errors.Is(err, errSendQueueFull) {
+			if f, ok := a.sendQ.dropOldest(messageLane(m)); ok {
+				a.forgetDelivery(f.seq)
+				metricsDropped(1)
+				metricsBackpressure(policyDropOldest, "dropped_oldest")
+				return false, deliver(a, m, 0)
+			}
+		}
+		metricsBackpressure(policyDropOldest, "rejected")
+		return false, err
+	}
+
+	metricsDropped(1)
+	metricsBackpressure(policyDisconnect, "disconnected")
+	a.Close()
+	_ = a.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return false, errBackpressure
+}
+
+func bufferOffline(identityToken string, m models.OfflineMessage) {
+	if dropped := OfflineEnqueue(identityToken, m); dropped > 0 {
+		metricsDropped(dropped)
+	}
+	metricsOfflineBuffered(1)
+}
+
+// spillBehind sends m to the offline queue while spilled messages of the
+// connection still wait there, so it cannot overtake them.
+func spillBehind(a *AgentConn, m models.OfflineMessage) bool {
+	a.spillMu.Lock()
+	defer a.spillMu.Unlock()
+	if !a.spilling {
+		return false
+	}
+	bufferOffline(a.IdentityToken, m)
+	return true
+}
+
+// spill parks m in the offline queue and starts moving the queue back onto
+// the connection.
+func spill(a *AgentConn, m models.OfflineMessage) {
+	a.spillMu.Lock()
+	defer a.spillMu.Unlock()
+	bufferOffline(a.IdentityToken, m)
+	if !a.spilling {
+		a.spilling = true
+		go unspill(a)
+	}
+}
+
+// unspill delivers spilled messages in order, waiting for room as long as the
+// connection lasts, and ends spilling once the offline queue is empty. If the
+// connection goes, the rest goes back to the head of the queue for the next one.
+func unspill(a *AgentConn) {
+	for {
+		a.spillMu.Lock()
+		var queued []models.OfflineMessage
+		if !IsQuarantined(a.CommonName) {
+			queued = OfflineDrain(a.IdentityToken)
+		}
+		if len(queued) == 0 {
+			a.spilling = false
+			a.spillMu.Unlock()
+			return
+		}
+		a.spillMu.Unlock()
+
+		flushed := 0
+		for i, m := range queued {
+			if offlineExpired(m, time.Now()) {
+				expireOfflineMessage(a, m)
+				continue
+			}
+			if !deliverSpilled(a, m) {
+				OfflineRequeue(a.IdentityToken, queued[i:])
+				metricsOfflineFlushed(flushed)
+				return
+			}
+			flushed++
+		}
+		metricsOfflineFlushed(flushed)
+	}
+}
+
+// deliverSpilled retries m until it is on the connection or the connection
+// ends.
+func deliverSpilled(a *AgentConn, m models.OfflineMessage) bool {
+	for {
+		err := deliver(a, m, writeTimeout)
+		switch {
+		case err == nil:
+			return true
+		case errors.Is(err, errDeliveryClosed):
+			return false
+		case !queueFull(err):
+			log.Printf("spilled message for %s: %v", a.CommonName, err)
+		}
+		select {
+		case <-a.closed:
+			return false
+		case <-a.quit:
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// internal/websocket/cert_renewal.go
+package websocket
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+)
+
+// Renewal policy: agents are asked to renew CERT_RENEW_BEFORE_DAYS before expiry;
+// the replaced certificate keeps working for CERT_OVERLAP_HOURS so the agent can
+// reconnect with either while it swaps files.
+var (
+	certRenewBefore  = time.Duration(config.Int("CERT_RENEW_BEFORE_DAYS", 30)) * 24 * time.Hour
+	certOverlap      = time.Duration(config.Int("CERT_OVERLAP_HOURS", 72)) * time.Hour
+	certCheckPeriod  = 6 * time.Hour
+	certRenewRetryIn = time.Hour
+)
+
+// CertRenewRequest asks the agent for a CSR over the live connection.
+type CertRenewRequest struct {
+	Type     string `json:"type"` // "cert_renew"
+	NotAfter string `json:"not_after"`
+}
+
+// CertCSR is the agent's reply carrying a PEM CSR for its new key.
+type CertCSR struct {
+	Type string `json:"type"` // "cert_csr"
+	CSR  string `json:"csr"`
+}
+
+// CertRenewed delivers the newly issued certificate.
+type CertRenewed struct {
+	Type              string `json:"type"` // "cert_renewed"
+	Certificate       string `json:"certificate"`
+	FingerprintSHA256 string `json:"fingerprint_sha256"`
+	NotAfter          string `json:"not_after"`
+	OverlapUntil      string `json:"overlap_until"`
+}
+
+// StartCertRenewalMonitor periodically asks connected agents with expiring certificates to renew.
+func StartCertRenewalMonitor() {
+	go func() {
+		ticker := time.NewTicker(certCheckPeriod)
+		defer ticker.Stop()
+		for range ticker.C {
+			expiring := 0
+			PoolRange(func(_ string, a *AgentConn) bool {
+				if certNeedsRenewal(a) {
+					expiring++
+					maybeRequestRenewal(a)
+				}
+				return true
+			})
+			metricCertsExpiring.Set(float64(expiring))
+		}
+	}()
+}
+
+func certNeedsRenewal(a *AgentConn) bool {
+	return !a.CertNotAfter.IsZero() && time.Until(a.CertNotAfter) < certRenewBefore
+}
+
+// maybeRequestRenewal sends cert_renew if the certificate is in the window and
+// no request is outstanding on this connection.
+func maybeRequestRenewal(a *AgentConn) {
+	if !certNeedsRenewal(a) || !a.hasCapability("cert_renewal") {
+		return
+	}
+	a.mu.Lock()
+	if a.certRenewed || time.Since(a.certRenewAsked) < certRenewRetryIn {
+		a.mu.Unlock()
+		return
+	}
+	a.certRenewAsked = time.Now()
+	a.mu.Unlock()
+
+	req := CertRenewRequest{Type: "cert_renew", NotAfter: a.CertNotAfter.UTC().Format(time.RFC3339)}
+	if err := sendControl(a, req); err != nil {
+		log.Printf("cert_renew to %s failed: %v", a.CommonName, err)
+		return
+	}
+	metricsCertRenewal("requested")
+	log.Printf("requested certificate renewal from %s (expires %s)", a.CommonName, req.NotAfter)
+}
+
+// handleCertCSR validates the agent's CSR, issues a certificate and rotates the
+// stored fingerprint, keeping the old one for the overlap window.
+func handleCertCSR(a *AgentConn, msg []byte) error {
+	if err := issueRenewal(a, msg); err != nil {
+		metricsCertRenewal("failed")
+		return err
+	}
+	metricsCertRenewal("issued")
+	return nil
+}
+
+func issueRenewal(a *AgentConn, msg []byte) error {
+	var req CertCSR
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	already := a.certRenewed
+	a.mu.Unlock()
+	if already {
+		return fmt.Errorf("certificate already renewed on this connection")
+	}
+	if !certNeedsRenewal(a) {
+		return fmt.Errorf("certificate not inside renewal window")
+	}
+
+	csr, err := utils.ParseAgentCSR([]byte(req.CSR), a.CommonName)
+	if err != nil {
+		return err
+	}
+	caCert, caKey, err := utils.LoadCA("./certs", "./certs")
+	if err != nil {
+		return err
+	}
+	certPEM, cert, err := utils.SignAgentCSR(caCert, caKey, csr)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := utils.ComputeCertFingerprintSHA256(certPEM)
+	if err != nil {
+		return err
+	}
+
+	keys, ok := utils.GetAgentKeys(a.CommonName)
+	if !ok {
+		return fmt.Errorf("agent keys missing for %s", a.CommonName)
+	}
+	overlapUntil := time.Now().Add(certOverlap)
+	keys.PreviousFingerprintSHA256 = keys.FingerprintSHA256
+	keys.PreviousFingerprintUntil = overlapUntil
+	keys.FingerprintSHA256 = fingerprint
+	keys.Certificate = base64.StdEncoding.EncodeToString(certPEM)
+	if err := models.SaveAgentKeyRecord(a.CommonName, keys); err != nil {
+		return fmt.Errorf("persist renewed keys: %w", err)
+	}
+	utils.SaveAgentKeys(a.CommonName, keys)
+
+	a.mu.Lock()
+	a.certRenewed = true
+	a.mu.Unlock()
+
+	models.RecordAudit(models.AuditEntry{
+		Action:   "certificate_renewed",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(strings.TrimPrefix(a.CommonName, "Agent_")),
+		Details: fmt.Sprintf("serial=%s fingerprint=%s previous=%s not_after=%s",
+			cert.SerialNumber.Text(16), fingerprint, keys.PreviousFingerprintSHA256, cert.NotAfter.UTC().Format(time.RFC3339)),
+	})
+
+	return sendControl(a, CertRenewed{
+		Type:              "cert_renewed",
+		Certificate:       string(certPEM),
+		FingerprintSHA256: fingerprint,
+		NotAfter:          cert.NotAfter.UTC().Format(time.RFC3339),
+		OverlapUntil:      overlapUntil.UTC().Format(time.RFC3339),
+	})
+}
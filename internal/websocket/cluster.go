@@ -0,0 +1,259 @@
+// internal/websocket/cluster.go
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+)
+
+// Multi-node operation (NODE_ADDR and CLUSTER_SECRET set): every replica records
+// the agents it holds in agent_connections. SendMessage on a node that does not
+// hold the agent forwards the payload to the owner; a task waited on by one node
+// and answered on another is routed back through task_routes. Entries of a node
+// that stops refreshing them are ignored after clusterDirectoryTTL.
+const (
+	clusterRefreshPeriod = 30 * time.Second
+	clusterDirectoryTTL  = 3 * clusterRefreshPeriod
+	clusterRouteMaxAge   = 24 * time.Hour
+
+	clusterDeliverPath    = "/internal/cluster/deliver"
+	clusterTaskResultPath = "/internal/cluster/task-result"
+)
+
+// ErrAgentNotHere is returned for a forwarded message whose agent left this node.
+var ErrAgentNotHere = errors.New("agent not connected to this node")
+
+var clusterClient = &http.Client{Timeout: 10 * time.Second}
+
+// ClusterDelivery is the body of a forwarded message.
+type ClusterDelivery struct {
+	CommonName string          `json:"common_name"`
+	Payload    json.RawMessage `json:"payload"`
+	TaskID     string          `json:"task_id,omitempty"`
+	ExpiresAt  time.Time       `json:"expires_at,omitempty"`
+}
+
+func clustered() bool {
+	return config.AppConfig.Clustered()
+}
+
+// StartClusterDirectory clears entries left by a previous run of this node and
+// keeps its live entries fresh. No-op on a single node.
+func StartClusterDirectory() {
+	if !clustered() {
+		return
+	}
+	node := config.AppConfig.NodeID
+	if err := models.DeleteNodeConnections(node); err != nil {
+		log.Printf("cluster: clear stale connections of %s: %v", node, err)
+	}
+	if err := models.DeleteNodeTaskSlots(node); err != nil {
+		log.Printf("cluster: clear stale slot leases of %s: %v", node, err)
+	}
+	startTaskSlotPoller()
+	go func() {
+		t := time.NewTicker(clusterRefreshPeriod)
+		defer t.Stop()
+		for range t.C {
+			if err := models.TouchNodeConnections(node); err != nil {
+				log.Printf("cluster: refresh connections: %v", err)
+			}
+			if err := models.PurgeTaskRoutes(clusterRouteMaxAge); err != nil {
+				log.Printf("cluster: purge task routes: %v", err)
+			}
+		}
+	}()
+	log.Printf("cluster: node %s serving at %s", node, config.AppConfig.NodeAddr)
+}
+
+// registerConnection records this node as the holder of a's identity.
+func registerConnection(a *AgentConn) {
+	if !clustered() {
+		return
+	}
+	err := models.UpsertAgentConnection(models.AgentConnection{
+		CommonName:  a.CommonName,
+		NodeID:      config.AppConfig.NodeID,
+		NodeAddr:    config.AppConfig.NodeAddr,
+		ConnectedAt: a.connectedAt,
+	})
+	if err != nil {
+		log.Printf("cluster: register %s: %v", a.CommonName, err)
+	}
+}
+
+// unregisterConnection drops the entry unless a newer connection replaced it.
+func unregisterConnection(a *AgentConn) {
+	if !clustered() {
+		return
+	}
+	if err := models.DeleteAgentConnection(a.CommonName, config.AppConfig.NodeID, a.connectedAt); err != nil {
+		log.Printf("cluster: unregister %s: %v", a.CommonName, err)
+	}
+}
+
+// clusterPost sends a signed node-to-node request and returns the status code.
+func clusterPost(addr, path string, v interface{}) (int, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(addr, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	node := config.AppConfig.NodeID
+	ts := time.Now().UTC().Format(time.RFC3339Nano)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(utils.ClusterNodeHeader, node)
+	req.Header.Set(utils.ClusterTimestampHeader, ts)
+	req.Header.Set(utils.ClusterSignatureHeader,
+		utils.SignClusterRequest(config.AppConfig.ClusterSecret, node, ts, http.MethodPost, path, body))
+
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// forwardToOwner hands payload to the node holding the agent. It reports false
+// when no other live node holds it, so the caller falls back to the offline buffer.
+func forwardToOwner(cn string, m models.OfflineMessage) (bool, error) {
+	if !clustered() {
+		return false, nil
+	}
+	owner, ok, err := models.LookupAgentConnection(cn, clusterDirectoryTTL)
+	if err != nil {
+		log.Printf("cluster: lookup %s: %v", cn, err)
+		return false, nil
+	}
+	if !ok || owner.NodeID == config.AppConfig.NodeID {
+		return false, nil
+	}
+
+	status, err := clusterPost(owner.NodeAddr, clusterDeliverPath, ClusterDelivery{
+		CommonName: cn, Payload: m.Payload, TaskID: m.TaskID, ExpiresAt: m.ExpiresAt,
+	})
+	switch {
+	case err != nil:
+		metricsClusterForward("error")
+		log.Printf("cluster: forward to %s for %s: %v", owner.NodeID, cn, err)
+		return false, nil
+	case status == http.StatusConflict:
+		metricsClusterForward("not_held")
+		return false, nil
+	case status != http.StatusOK:
+		metricsClusterForward("error")
+		return true, fmt.Errorf("node %s refused message for %s: HTTP %d", owner.NodeID, cn, status)
+	}
+	metricsClusterForward("delivered")
+	return true, nil
+}
+
+// DeliverLocal queues a message forwarded by another node on the local
+// connection. It never buffers: the sender does that on ErrAgentNotHere.
+func DeliverLocal(d ClusterDelivery) error {
+	cn := d.CommonName
+	keyInfo, ok := utils.GetAgentKeys(cn)
+	if !ok {
+		return ErrAgentNotHere
+	}
+	a, ok := PoolGet(keyInfo.IdentityToken)
+	if !ok {
+		return ErrAgentNotHere
+	}
+	if IsQuarantined(cn) {
+		// The sender keeps the message buffered until the identity is released
+		DisconnectAgent(cn)
+		return ErrAgentNotHere
+	}
+	if cancelsQueuedTask(a, d.Payload) {
+		return nil
+	}
+	err := deliver(a, models.OfflineMessage{Payload: d.Payload, TaskID: d.TaskID, ExpiresAt: d.ExpiresAt}, 0)
+	switch {
+	case errors.Is(err, errDeliveryClosed):
+		return ErrAgentNotHere
+	case err != nil:
+		metricsDropped(1)
+		return err
+	}
+	return nil
+}
+
+// routeTask records that this node waits for taskID, so a result arriving on
+// another node is sent back here.
+func routeTask(taskID, cn string) {
+	if !clustered() {
+		return
+	}
+	err := models.InsertTaskRoute(models.TaskRoute{
+		TaskID:     taskID,
+		CommonName: cn,
+		NodeID:     config.AppConfig.NodeID,
+		NodeAddr:   config.AppConfig.NodeAddr,
+	})
+	if err != nil {
+		log.Printf("cluster: route task %s: %v", taskID, err)
+	}
+}
+
+func unrouteTask(taskID string) {
+	if !clustered() {
+		return
+	}
+	if err := models.DeleteTaskRoute(taskID); err != nil {
+		log.Printf("cluster: unroute task %s: %v", taskID, err)
+	}
+}
+
+// remoteTaskRoute returns the route of a task waited on by another node.
+func remoteTaskRoute(taskID string) (models.TaskRoute, bool) {
+	if !clustered() {
+		return models.TaskRoute{}, false
+	}
+	route, ok, err := models.GetTaskRoute(taskID)
+	if err != nil {
+		log.Printf("cluster: task route %s: %v", taskID, err)
+		return models.TaskRoute{}, false
+	}
+	if !ok || route.NodeID == config.AppConfig.NodeID {
+		return models.TaskRoute{}, false
+	}
+	return route, true
+}
+
+// forwardTaskResult sends a verified result to the node waiting for it.
+func forwardTaskResult(route models.TaskRoute, tr TaskResult) error {
+	status, err := clusterPost(route.NodeAddr, clusterTaskResultPath, tr)
+	if err != nil {
+		metricsClusterForward("error")
+		return err
+	}
+	if status != http.StatusOK {
+		metricsClusterForward("error")
+		return fmt.Errorf("node %s refused result: HTTP %d", route.NodeID, status)
+	}
+	metricsClusterForward("result")
+	return nil
+}
+
+// ResolveForwardedResult frees the agent slot this node holds for the task and
+// wakes its local waiter. The verifying node has already recorded the result
+// (and scheduled any retry), so it is not recorded again here.
+func ResolveForwardedResult(tr TaskResult) bool {
+	releaseTaskSlot(tr.TaskID)
+	return resolvePending(tr.TaskID, tr)
+}
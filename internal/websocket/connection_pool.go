@@ -9,14 +9,8 @@ var ConnectedVPS sync.Map
 func PoolPut(identityToken string, a *AgentConn) {
 	// If an old connection exists, close it first.
 	if oldV, ok := ConnectedVPS.Load(identityToken); ok {
-		old := oldV.(*AgentConn)
-		// Close its Send channel; writePump will send a Close frame & exit.
-		select {
-		case <-old.closed:
-			// already closed
-		default:
-			close(old.Send)
-		}
+		// writePump sends a Close frame & exits.
+		oldV.(*AgentConn).Close()
 	}
 	ConnectedVPS.Store(identityToken, a)
 }
@@ -32,6 +26,12 @@ func PoolDelete(identityToken string) {
 	ConnectedVPS.Delete(identityToken)
 }
 
+// poolRemove deletes a only if it is still the pooled connection, so a closing
+// connection never removes the one that replaced it.
+func poolRemove(a *AgentConn) bool {
+	return ConnectedVPS.CompareAndDelete(a.IdentityToken, a)
+}
+
 func PoolCount() int {
 	n := 0
 	ConnectedVPS.Range(func(_, _ any) bool {
@@ -46,3 +46,13 @@ func PoolRange(fn func(identity string, a *AgentConn) bool) {
 		return fn(k.(string), v.(*AgentConn))
 	})
 }
+
+// DisconnectAgent closes any live connection presenting the given certificate CN.
+func DisconnectAgent(cn string) {
+	PoolRange(func(_ string, a *AgentConn) bool {
+		if a.CommonName == cn {
+			a.Close()
+		}
+		return true
+	})
+}
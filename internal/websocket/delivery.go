@@ -0,0 +1,241 @@
+// internal/websocket/delivery.go
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+
+	"github.com/google/uuid"
+)
+
+// At-least-once delivery, for agents that list "delivery_ack" in their hello:
+//
+//	gateway -> agent  {"type":"delivery","epoch":E,"seq":N,"message":{...}}
+//	agent   -> gateway {"type":"ack","seq":N}
+//
+// Sequence numbers come from a per-agent counter in agent_counters, so they are
+// unique across reconnects, restarts and gateway nodes. A delivery stays in the
+// connection's unacked window until acknowledged; when the connection ends the
+// window goes back to the offline queue with its epoch and seq, and is sent
+// again after the agent reconnects. Other agents get bare messages.
+//
+// Dedup on the agent is bounded by DELIVERY_WINDOW (W): per epoch it keeps the
+// highest seq H it has seen and the seqs it has seen in (H-W, H]. A delivery
+// whose seq is already in that set, or is <= H-W, is a duplicate: the agent
+// drops it and still acks it. The gateway keeps that rule safe: a connection
+// never has deliveries outstanding that span W or more seqs, so nothing in
+// flight falls W behind a newer seq, and a redelivery whose seq has fallen that
+// far behind the agent's counter is sent with a fresh seq instead.
+var deliveryWindow = config.Int("DELIVERY_WINDOW", 256)
+
+var (
+	errDeliveryWindowFull = errors.New("agent delivery window full")
+	errDeliveryClosed     = errors.New("agent connection closed")
+	errSendQueueFull      = errors.New("agent send queue full")
+)
+
+// Delivery wraps a message with its sequence number.
+type Delivery struct {
+	Type    string          `json:"type"` // "delivery"
+	Epoch   string          `json:"epoch"`
+	Seq     uint64          `json:"seq"`
+	Message json.RawMessage `json:"message"`
+}
+
+// DeliveryAck confirms one delivery.
+type DeliveryAck struct {
+	Type string `json:"type"` // "ack"
+	Seq  uint64 `json:"seq"`
+}
+
+// acksDeliveries reports whether the agent agreed to acknowledge deliveries.
+// Unlike hasCapability this is false for agents that never sent a hello.
+func (a *AgentConn) acksDeliveries() bool {
+	info, ok := a.Info()
+	if !ok {
+		return false
+	}
+	for _, c := range info.Capabilities {
+		if c == "delivery_ack" {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver puts m on its lane of the connection, waiting up to wait for room
+// (0: not at all). For acking agents m is sequenced and kept in the unacked
+// window until the agent confirms it.
+func deliver(a *AgentConn, m models.OfflineMessage, wait time.Duration) error {
+	frame := m.Payload
+	if a.acksDeliveries() {
+		if m.Seq != 0 && deliveryStale(a, m.Seq) {
+			// The agent may count it as seen; an unprocessed delivery must not be dropped
+			m.Epoch, m.Seq = "", 0
+			metricsDelivery("resequenced", 1)
+		}
+		if m.Seq == 0 {
+			epoch, seq, err := models.NextDeliverySeq(a.CommonName, uuid.NewString())
+			if err != nil {
+				return fmt.Errorf("allocate delivery seq: %w", err)
+			}
+			m.Epoch, m.Seq = epoch, seq
+		}
+		b, err := json.Marshal(Delivery{Type: "delivery", Epoch: m.Epoch, Seq: m.Seq, Message: m.Payload})
+		if err != nil {
+			return err
+		}
+		frame = b
+
+		a.mu.Lock()
+		switch {
+		case a.deliveryClosed:
+			a.mu.Unlock()
+			return errDeliveryClosed
+		case len(a.unacked) >= deliveryWindow, m.Seq-a.oldestUnacked(m.Seq) >= uint64(deliveryWindow):
+			a.mu.Unlock()
+			return errDeliveryWindowFull
+		}
+		if a.unacked == nil {
+			a.unacked = map[uint64]models.OfflineMessage{}
+		}
+		a.unacked[m.Seq] = m
+		a.mu.Unlock()
+	}
+
+	if err := enqueueFrame(a, messageLane(m), queuedFrame{data: frame, taskID: m.TaskID, seq: m.Seq}, wait); err != nil {
+		a.forgetDelivery(m.Seq)
+		return err
+	}
+	if m.Seq != 0 {
+		metricsDelivery("sent", 1)
+	}
+	return nil
+}
+
+// enqueueFrame pushes f onto a lane, waiting up to wait for room in it.
+func enqueueFrame(a *AgentConn, lane sendLane, f queuedFrame, wait time.Duration) error {
+	var expired <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		select {
+		case <-a.closed:
+			return errDeliveryClosed
+		case <-a.quit:
+			return errDeliveryClosed
+		default:
+		}
+		depth, err := a.sendQ.push(lane, f)
+		if err == nil {
+			metricsEnqueued(1)
+			metricsLane(lane, "enqueued", 1)
+			if depth > 0 {
+				metricsLane(lane, "high_water", 1)
+				log.Printf("send queue of %s: %s lane at %d/%d, agent is falling behind", a.CommonName, lane, depth, laneLimits[lane])
+			}
+			return nil
+		}
+		if expired == nil {
+			metricsLane(lane, "full", 1)
+			return err
+		}
+		select {
+		case <-a.sendQ.room:
+		case <-a.closed:
+			return errDeliveryClosed
+		case <-expired:
+			metricsLane(lane, "full", 1)
+			return err
+		}
+	}
+}
+
+// deliveryStale reports whether a redelivery's seq lies W or more behind the
+// agent's counter, where the agent treats it as already processed.
+func deliveryStale(a *AgentConn, seq uint64) bool {
+	cur, err := models.CurrentDeliverySeq(a.CommonName)
+	if err != nil {
+		log.Printf("delivery counter of %s: %v", a.CommonName, err)
+		return false
+	}
+	return cur >= seq+uint64(deliveryWindow)
+}
+
+// oldestUnacked returns the lowest seq in the unacked window, or seq if it is
+// lower or the window is empty. Called with a.mu held.
+func (a *AgentConn) oldestUnacked(seq uint64) uint64 {
+	oldest := seq
+	for s := range a.unacked {
+		if s < oldest {
+			oldest = s
+		}
+	}
+	return oldest
+}
+
+func (a *AgentConn) forgetDelivery(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	a.mu.Lock()
+	delete(a.unacked, seq)
+	a.mu.Unlock()
+}
+
+// handleDeliveryAck removes an acknowledged delivery from the window.
+func handleDeliveryAck(a *AgentConn, msg []byte) error {
+	var ack DeliveryAck
+	if err := json.Unmarshal(msg, &ack); err != nil {
+		return fmt.Errorf("invalid ack: %w", err)
+	}
+	a.mu.Lock()
+	m, ok := a.unacked[ack.Seq]
+	delete(a.unacked, ack.Seq)
+	a.mu.Unlock()
+	if !ok {
+		metricsDelivery("ack_unknown", 1) // duplicate ack, or a delivery from an earlier connection
+		return nil
+	}
+	if m.TaskID != "" {
+		markPendingDelivered(m.TaskID)
+	}
+	metricsDelivery("acked", 1)
+	return nil
+}
+
+// RequeueUnacked closes the delivery window and returns its messages to the
+// offline queue, oldest first, for redelivery on the next connection. Safe to
+// call more than once.
+func (a *AgentConn) RequeueUnacked() {
+	a.mu.Lock()
+	a.deliveryClosed = true
+	pending := make([]models.OfflineMessage, 0, len(a.unacked))
+	for _, m := range a.unacked {
+		pending = append(pending, m)
+	}
+	a.unacked = nil
+	a.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Seq < pending[j].Seq })
+	for _, m := range pending {
+		if dropped := OfflineEnqueue(a.IdentityToken, m); dropped > 0 {
+			metricsDropped(dropped)
+		}
+	}
+	metricsDelivery("requeued", len(pending))
+	log.Printf("%d unacknowledged message(s) for %s queued for redelivery", len(pending), a.CommonName)
+}
@@ -0,0 +1,138 @@
+// internal/websocket/envelope.go
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+)
+
+// AgentEnvelope wraps any agent-originated message:
+//
+//	{"v":1,"type":"task_result","seq":42,"nonce":"…","timestamp":"…","payload":{…},"signature":"…"}
+//
+// signature = base64 HMAC-SHA256(signature secret, envelopeCanonical). seq must
+// increase strictly for the lifetime of the agent identity (agents persist it, or
+// derive it from a clock); the gateway keeps the high-water mark in agent_counters.
+// Once an agent has sent one envelope, bare messages from it are refused.
+type AgentEnvelope struct {
+	V         int             `json:"v"`
+	Type      string          `json:"type"`
+	Seq       uint64          `json:"seq"`
+	Nonce     string          `json:"nonce"`
+	Timestamp string          `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+const envelopeVersion = 1
+
+// Clock skew tolerated on signed agent messages.
+const maxClockSkew = 5 * time.Minute
+
+// AGENT_ENVELOPE_REQUIRED=1 refuses bare messages from every agent.
+var envelopeRequired = config.Int("AGENT_ENVELOPE_REQUIRED", 0) == 1
+
+var (
+	errEnvelopeMalformed = errors.New("malformed envelope")
+	errEnvelopeSignature = errors.New("invalid envelope signature")
+	errEnvelopeReplay    = errors.New("envelope replay")
+	errTimestampSkew     = errors.New("timestamp outside allowed skew")
+)
+
+// envelopeCanonical covers the payload by hash, exactly as received.
+func envelopeCanonical(e AgentEnvelope) string {
+	sum := sha256.Sum256(e.Payload)
+	return fmt.Sprintf("env-v%d|%s|%d|%s|%s|%s", e.V, e.Type, e.Seq, e.Nonce, e.Timestamp, hex.EncodeToString(sum[:]))
+}
+
+// checkAgentTimestamp parses an RFC3339(Nano) timestamp and enforces maxClockSkew.
+func checkAgentTimestamp(ts string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp: %v", err)
+		}
+	}
+	delta := time.Since(t.UTC())
+	if delta < 0 {
+		delta = -delta
+	}
+	if delta > maxClockSkew {
+		return t, errTimestampSkew
+	}
+	return t, nil
+}
+
+// openEnvelope verifies signature, freshness, nonce and sequence, and advances
+// the persisted high-water mark before the payload is acted on.
+func openEnvelope(a *AgentConn, msg []byte) (AgentEnvelope, error) {
+	var env AgentEnvelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return env, fmt.Errorf("%w: %v", errEnvelopeMalformed, err)
+	}
+	if env.V != envelopeVersion || env.Type == "" || env.Nonce == "" || env.Seq == 0 || len(env.Payload) == 0 {
+		return env, fmt.Errorf("%w: missing fields or unsupported version %d", errEnvelopeMalformed, env.V)
+	}
+	if _, err := checkAgentTimestamp(env.Timestamp); err != nil {
+		if errors.Is(err, errTimestampSkew) {
+			return env, err
+		}
+		return env, fmt.Errorf("%w: %v", errEnvelopeMalformed, err)
+	}
+
+	keys, ok := utils.GetAgentKeys(a.CommonName)
+	if !ok {
+		return env, errEnvelopeSignature
+	}
+	secret, ok := matchSecret(keys, envelopeCanonical(env), env.Signature)
+	if !ok {
+		return env, errEnvelopeSignature
+	}
+
+	if env.Seq <= a.envelopeSeq {
+		return env, fmt.Errorf("%w: seq %d <= %d", errEnvelopeReplay, env.Seq, a.envelopeSeq)
+	}
+	if !agentNonces.Check(a.CommonName, env.Nonce) {
+		return env, fmt.Errorf("%w: nonce reused", errEnvelopeReplay)
+	}
+	advanced, err := models.AdvanceAgentHighWater(a.CommonName, env.Seq)
+	if err != nil {
+		// Keep the channel up on a database hiccup; memory and the nonce cache still guard this connection.
+		log.Printf("persist envelope counter for %s: %v", a.CommonName, err)
+	} else if !advanced {
+		return env, fmt.Errorf("%w: seq %d already accepted", errEnvelopeReplay, env.Seq)
+	}
+	a.envelopeSeq = env.Seq
+	a.envelopeOnly = true
+
+	if secret != keys.SignatureSecret {
+		if err := completeSecretRotation(a, keys.PendingRotationID, "envelope"); err != nil {
+			log.Printf("secret rotation for %s not completed: %v", a.CommonName, err)
+		}
+	}
+	return env, nil
+}
+
+// envelopeEvent maps an openEnvelope error to its security event type and severity.
+func envelopeEvent(err error) (string, string) {
+	switch {
+	case errors.Is(err, errEnvelopeSignature):
+		return EventEnvelopeSignature, SeverityHigh
+	case errors.Is(err, errEnvelopeReplay):
+		return EventEnvelopeReplay, SeverityHigh
+	case errors.Is(err, errTimestampSkew):
+		return EventHeartbeatClockSkew, SeverityMedium
+	default:
+		return EventEnvelopeMalformed, SeverityMedium
+	}
+}
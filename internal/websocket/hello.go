@@ -0,0 +1,245 @@
+// internal/websocket/hello.go
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// The first message on every connection must be a hello (AGENT_HELLO_REQUIRED=0
+// lets pre-hello agents connect during a rollout). Nothing is sent to the agent
+// beyond what the gateway needs to answer until the hello arrives, so queued
+// tasks are signed for the negotiated protocol.
+var (
+	helloRequired = config.Int("AGENT_HELLO_REQUIRED", 1) == 1
+	helloTimeout  = time.Duration(config.Int("AGENT_HELLO_TIMEOUT_SECONDS", 15)) * time.Second
+)
+
+const (
+	maxHelloTasks  = 256
+	maxHelloString = 128
+)
+
+// Hello opens the session: the agent describes itself and lists the protocol
+// versions, capabilities and tasks it supports.
+type Hello struct {
+	Type             string       `json:"type"` // "hello"
+	ProtocolVersions []int        `json:"protocol_versions"`
+	Capabilities     []string     `json:"capabilities"`
+	AgentVersion     string       `json:"agent_version"`
+	OS               string       `json:"os"`
+	Arch             string       `json:"arch"`
+	Tasks            []string     `json:"tasks"` // allowlist names, e.g. "install_wordpress"
+	Sandbox          HelloSandbox `json:"sandbox"`
+	Inflight         []string     `json:"inflight,omitempty"` // task IDs from an earlier connection still running or with a result not yet sent
+}
+
+// HelloSandbox reports the isolation features available to task runners.
+type HelloSandbox struct {
+	Chroot bool `json:"chroot"`
+	Cgroup bool `json:"cgroup"`
+}
+
+// HelloAck carries the agreed version; capabilities are the intersection.
+type HelloAck struct {
+	Type              string   `json:"type"` // "hello_ack"
+	ProtocolVersion   int      `json:"protocol_version"`
+	Capabilities      []string `json:"capabilities"`
+	SupportedVersions []int    `json:"supported_versions"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// Last known hello per CN, for agents that are currently offline.
+var agentInfoCache sync.Map // CN -> models.AgentCapabilities
+
+func (h Hello) validate() error {
+	switch {
+	case h.AgentVersion == "" || h.OS == "" || h.Arch == "":
+		return fmt.Errorf("agent_version, os and arch are required")
+	case len(h.AgentVersion) > maxHelloString || len(h.OS) > maxHelloString || len(h.Arch) > maxHelloString:
+		return fmt.Errorf("hello field too long")
+	case h.Tasks == nil:
+		return fmt.Errorf("tasks is required")
+	case len(h.Tasks) > maxHelloTasks || len(h.Capabilities) > maxHelloTasks || len(h.Inflight) > maxHelloTasks:
+		return fmt.Errorf("too many tasks or capabilities")
+	}
+	for _, t := range h.Tasks {
+		if t == "" || len(t) > maxHelloString {
+			return fmt.Errorf("invalid task name %q", t)
+		}
+	}
+	return nil
+}
+
+// handleHello negotiates the protocol and records what the agent can do. It
+// returns an error (and the caller drops the connection) on an invalid hello or
+// when there is no common version.
+func handleHello(a *AgentConn, msg []byte) error {
+	var h Hello
+	if err := json.Unmarshal(msg, &h); err != nil {
+		return fmt.Errorf("invalid hello: %w", err)
+	}
+	ack := HelloAck{Type: "hello_ack", SupportedVersions: SupportedProtocolVersions()}
+	if a.protocolNegotiated() {
+		return fmt.Errorf("hello already negotiated on this connection")
+	}
+	if err := h.validate(); err != nil {
+		ack.Error = err.Error()
+		_ = sendControl(a, ack)
+		return fmt.Errorf("invalid hello: %w", err)
+	}
+
+	version := negotiateProtocol(h.ProtocolVersions)
+	if version == 0 {
+		ack.Error = "no common protocol version"
+		_ = sendControl(a, ack)
+		return fmt.Errorf("no common protocol version in %v", h.ProtocolVersions)
+	}
+
+	offered := map[string]bool{}
+	for _, c := range h.Capabilities {
+		offered[c] = true
+	}
+	ack.Capabilities = []string{}
+	for _, c := range gatewayCapabilities {
+		if offered[c] {
+			ack.Capabilities = append(ack.Capabilities, c)
+		}
+	}
+	ack.ProtocolVersion = version
+
+	info := models.AgentCapabilities{
+		CommonName:      a.CommonName,
+		AgentVersion:    h.AgentVersion,
+		OS:              h.OS,
+		Arch:            h.Arch,
+		ProtocolVersion: version,
+		Capabilities:    ack.Capabilities,
+		Tasks:           h.Tasks,
+		Chroot:          h.Sandbox.Chroot,
+		Cgroup:          h.Sandbox.Cgroup,
+		UpdatedAt:       time.Now().UTC(),
+	}
+	a.mu.Lock()
+	a.protocolVersion = version
+	a.info = &info
+	a.mu.Unlock()
+	agentInfoCache.Store(a.CommonName, info)
+	go func() {
+		if err := models.SaveAgentCapabilities(info); err != nil {
+			log.Printf("persist hello of %s: %v", a.CommonName, err)
+		}
+	}()
+
+	log.Printf("agent %s hello: v%s %s/%s protocol v%d capabilities=%v tasks=%v",
+		a.CommonName, h.AgentVersion, h.OS, h.Arch, version, ack.Capabilities, h.Tasks)
+	if err := sendControl(a, ack); err != nil {
+		return err
+	}
+	resumeInflight(a, h.Inflight)
+	startSession(a)
+	return nil
+}
+
+// awaitHello drops connections that stay silent past the hello timeout.
+func awaitHello(a *AgentConn) {
+	if !helloRequired {
+		startSession(a)
+		return
+	}
+	go func() {
+		select {
+		case <-time.After(helloTimeout):
+			if !a.protocolNegotiated() {
+				log.Printf("no hello from %s within %s, closing", a.CommonName, helloTimeout)
+				_ = a.Conn.Close()
+			}
+		case <-a.closed:
+		}
+	}()
+}
+
+// startSession runs the per-connection work that depends on knowing the agent:
+// key set, offline flush, certificate renewal and pending secret rotation.
+func startSession(a *AgentConn) {
+	a.sessionOnce.Do(func() {
+		// Key set first: buffered tasks may be signed with a key the agent has not seen
+		sendTaskSigningKeys(a)
+		go flushOfflineBuffer(a)
+		maybeRequestRenewal(a)
+		maybeRotateOnConnect(a)
+	})
+}
+
+// Info returns the agent's hello, if it sent one on this connection.
+func (a *AgentConn) Info() (models.AgentCapabilities, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.info == nil {
+		return models.AgentCapabilities{}, false
+	}
+	return *a.info, true
+}
+
+// hasCapability reports whether the agent agreed to c. Agents that never sent a
+// hello are treated as supporting every legacy control message.
+func (a *AgentConn) hasCapability(c string) bool {
+	info, ok := a.Info()
+	if !ok {
+		return true
+	}
+	for _, have := range info.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// AgentInfo returns the latest hello of an agent: from the live connection, or
+// the stored one while it is offline. ok is false if it never sent a hello.
+func AgentInfo(vpsId string) (models.AgentCapabilities, bool) {
+	cn := "Agent_" + vpsId
+	PoolRange(func(_ string, a *AgentConn) bool {
+		if a.CommonName == cn {
+			if info, ok := a.Info(); ok {
+				agentInfoCache.Store(cn, info)
+			}
+			return false
+		}
+		return true
+	})
+	if v, ok := agentInfoCache.Load(cn); ok {
+		return v.(models.AgentCapabilities), true
+	}
+	info, ok, err := models.GetAgentCapabilities(cn)
+	if err != nil {
+		log.Printf("load hello of %s: %v", cn, err)
+		return models.AgentCapabilities{}, false
+	}
+	if ok {
+		agentInfoCache.Store(cn, info)
+	}
+	return info, ok
+}
+
+// AgentSupportsTask reports whether the agent advertised task. Agents with no
+// recorded hello are assumed to support everything, as before the handshake existed.
+func AgentSupportsTask(vpsId, task string) bool {
+	info, ok := AgentInfo(vpsId)
+	if !ok {
+		return true
+	}
+	for _, t := range info.Tasks {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
@@ -53,6 +53,153 @@ var (
 		},
 	)
 
+	metricOfflineExpired = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "offline_expired_total",
+			Help:      "Total offline-buffered messages dropped at flush because their TTL had passed",
+		},
+	)
+
+	metricSecurityEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "security",
+			Name:      "events_total",
+			Help:      "Security events raised by the agent channel, by type and severity",
+		},
+		[]string{"type", "severity"},
+	)
+
+	metricCertRenewals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "pki",
+			Name:      "cert_renewals_total",
+			Help:      "In-band client certificate renewals by result (requested, issued, failed)",
+		},
+		[]string{"result"},
+	)
+
+	metricCertsExpiring = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "ultaai",
+			Subsystem: "pki",
+			Name:      "connected_certs_expiring",
+			Help:      "Connected agents whose client certificate is inside the renewal window",
+		},
+	)
+
+	metricSecretRotations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "security",
+			Name:      "secret_rotations_total",
+			Help:      "Signature secret rotations by result (started, deferred, completed, expired, failed)",
+		},
+		[]string{"result"},
+	)
+
+	metricTaskResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "task_results_total",
+			Help:      "Task results received from agents by verification outcome (verified, unsigned, rejected, unknown)",
+		},
+		[]string{"verification"},
+	)
+
+	metricDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "deliveries_total",
+			Help:      "Sequenced deliveries to acking agents by event (sent, acked, ack_unknown, requeued, resequenced)",
+		},
+		[]string{"event"},
+	)
+
+	metricReconnectTasks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "reconnect_tasks_total",
+			Help:      "Pending tasks across agent reconnects by outcome (resumed, lost, failed)",
+		},
+		[]string{"outcome"},
+	)
+
+	metricTaskCancels = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "task_cancellations_total",
+			Help:      "Task cancellations by outcome (dequeued, requested, confirmed, too_late, failed)",
+		},
+		[]string{"outcome"},
+	)
+
+	metricClusterForwards = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "cluster",
+			Name:      "forwards_total",
+			Help:      "Messages and task results forwarded to other gateway nodes by outcome (delivered, result, not_held, error)",
+		},
+		[]string{"outcome"},
+	)
+
+	metricLateResults = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "task_results_late_total",
+			Help:      "Accepted task results that arrived after the task's deadline",
+		},
+	)
+
+	metricTaskAdmissions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "task_admissions_total",
+			Help:      "Per-agent task admissions by outcome (started, queued, busy, queue_full, timeout, withdrawn)",
+		},
+		[]string{"outcome"},
+	)
+
+	metricTaskRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "task_retries_total",
+			Help:      "Task retry events (scheduled, retried, reclaimed, dead_lettered, redriven)",
+		},
+		[]string{"event"},
+	)
+
+	metricSendLanes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "send_lane_messages_total",
+			Help:      "Outbound messages per priority lane (control, interactive, bulk) by event (enqueued, written, full, high_water)",
+		},
+		[]string{"lane", "event"},
+	)
+
+	metricBackpressure = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ultaai",
+			Subsystem: "ws",
+			Name:      "backpressure_total",
+			Help:      "Messages that met a full agent queue, by policy and outcome (blocked, timeout, spilled, dropped_oldest, rejected, disconnected)",
+		},
+		[]string{"policy", "outcome"},
+	)
+
 	metricsOnce sync.Once
 )
 
@@ -65,6 +212,21 @@ func RegisterMetrics() {
 			metricMsgsDropped,
 			metricOfflineBuffered,
 			metricOfflineFlushed,
+			metricOfflineExpired,
+			metricSecurityEvents,
+			metricCertRenewals,
+			metricCertsExpiring,
+			metricSecretRotations,
+			metricTaskResults,
+			metricClusterForwards,
+			metricDeliveries,
+			metricReconnectTasks,
+			metricTaskCancels,
+			metricLateResults,
+			metricTaskAdmissions,
+			metricTaskRetries,
+			metricSendLanes,
+			metricBackpressure,
 
 			// runtime & process metrics
 
@@ -79,3 +241,27 @@ func metricsEnqueued(n int)        { metricMsgsEnqueued.Add(float64(n)) }
 func metricsDropped(n int)         { metricMsgsDropped.Add(float64(n)) }
 func metricsOfflineBuffered(n int) { metricOfflineBuffered.Add(float64(n)) }
 func metricsOfflineFlushed(n int)  { metricOfflineFlushed.Add(float64(n)) }
+func metricsOfflineExpired(n int)  { metricOfflineExpired.Add(float64(n)) }
+func metricsLateResult()           { metricLateResults.Inc() }
+func metricsSecurityEvent(eventType, severity string) {
+	metricSecurityEvents.WithLabelValues(eventType, severity).Inc()
+}
+func metricsCertRenewal(result string)      { metricCertRenewals.WithLabelValues(result).Inc() }
+func metricsSecretRotation(result string)   { metricSecretRotations.WithLabelValues(result).Inc() }
+func metricsTaskResult(verification string) { metricTaskResults.WithLabelValues(verification).Inc() }
+func metricsClusterForward(outcome string)  { metricClusterForwards.WithLabelValues(outcome).Inc() }
+func metricsDelivery(event string, n int) {
+	metricDeliveries.WithLabelValues(event).Add(float64(n))
+}
+func metricsTaskCancel(outcome string)    { metricTaskCancels.WithLabelValues(outcome).Inc() }
+func metricsTaskAdmission(outcome string) { metricTaskAdmissions.WithLabelValues(outcome).Inc() }
+func metricsTaskRetry(event string)       { metricTaskRetries.WithLabelValues(event).Inc() }
+func metricsLane(lane sendLane, event string, n int) {
+	metricSendLanes.WithLabelValues(lane.String(), event).Add(float64(n))
+}
+func metricsBackpressure(policy, outcome string) {
+	metricBackpressure.WithLabelValues(policy, outcome).Inc()
+}
+func metricsReconnectTasks(outcome string, n int) {
+	metricReconnectTasks.WithLabelValues(outcome).Add(float64(n))
+}
@@ -0,0 +1,59 @@
+// internal/websocket/nonce_cache.go
+package websocket
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+)
+
+// Nonces are remembered for twice the allowed clock skew: anything older fails
+// the timestamp check anyway. NONCE_CACHE_SIZE bounds memory; when full the
+// oldest entry is evicted first.
+var agentNonces = newNonceCache(config.Int("NONCE_CACHE_SIZE", 100000), 2*maxClockSkew)
+
+type nonceEntry struct {
+	key     string
+	expires time.Time
+}
+
+type nonceCache struct {
+	mu    sync.Mutex
+	max   int
+	ttl   time.Duration
+	order *list.List // oldest first
+	seen  map[string]*list.Element
+}
+
+func newNonceCache(max int, ttl time.Duration) *nonceCache {
+	if max < 1 {
+		max = 1
+	}
+	return &nonceCache{max: max, ttl: ttl, order: list.New(), seen: map[string]*list.Element{}}
+}
+
+// Check records agent|nonce and reports false if it was already seen (a replay).
+// The cache is process-wide, so it survives the agent reconnecting.
+func (c *nonceCache) Check(agent, nonce string) bool {
+	key := agent + "|" + nonce
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.order.Front(); e != nil && now.After(e.Value.(nonceEntry).expires); e = c.order.Front() {
+		c.order.Remove(e)
+		delete(c.seen, e.Value.(nonceEntry).key)
+	}
+	if _, dup := c.seen[key]; dup {
+		return false
+	}
+	for c.order.Len() >= c.max {
+		e := c.order.Front()
+		c.order.Remove(e)
+		delete(c.seen, e.Value.(nonceEntry).key)
+	}
+	c.seen[key] = c.order.PushBack(nonceEntry{key: key, expires: now.Add(c.ttl)})
+	return true
+}
@@ -4,8 +4,11 @@ package websocket
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
 )
 
 // A small, bounded, per-agent FIFO buffer for messages when the agent is offline.
@@ -13,7 +16,7 @@ import (
 
 type offlineQueue struct {
 	mu       sync.Mutex
-	msgs     [][]byte
+	msgs     []models.OfflineMessage
 	bytes    int
 	
 	maxMsgs  int
@@ -27,7 +30,8 @@ func newOfflineQueue(maxMsgs, maxBytes int) *offlineQueue {
 	}
 }
 
-func (q *offlineQueue) Enqueue(b []byte) (dropped int, accepted bool, deltaBytes int) {
+func (q *offlineQueue) Enqueue(m models.OfflineMessage) (dropped int, accepted bool, deltaBytes int) {
+	b := m.Payload
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
@@ -37,19 +41,21 @@ func (q *offlineQueue) Enqueue(b []byte) (dropped int, accepted bool, deltaBytes
 			// even a single msg larger than cap -> reject
 			return 0, false, 0
 		}
-		head := q.msgs[0]
+		head := q.msgs[0].Payload
 		q.msgs = q.msgs[1:]
 		q.bytes -= len(head)
+		deltaBytes -= len(head)
 		dropped++
 	}
 
 	// append copy
-	q.msgs = append(q.msgs, append([]byte(nil), b...))
+	m.Payload = append([]byte(nil), b...)
+	q.msgs = append(q.msgs, m)
 	q.bytes += len(b)
-	return dropped, true, len(b)
+	return dropped, true, deltaBytes + len(b)
 }
 
-func (q *offlineQueue) Drain() (out [][]byte, deltaBytes int) {
+func (q *offlineQueue) Drain() (out []models.OfflineMessage, deltaBytes int) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	out = q.msgs
@@ -59,6 +65,52 @@ func (q *offlineQueue) Drain() (out [][]byte, deltaBytes int) {
 	return
 }
 
+// Requeue puts drained messages back in front of the queue. They fit the caps
+// when first queued, so none is dropped here.
+func (q *offlineQueue) Requeue(msgs []models.OfflineMessage) (deltaBytes int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, m := range msgs {
+		deltaBytes += len(m.Payload)
+	}
+	q.msgs = append(append([]models.OfflineMessage(nil), msgs...), q.msgs...)
+	q.bytes += deltaBytes
+	return deltaBytes
+}
+
+// Remove deletes the message carrying taskID and returns the bytes freed.
+func (q *offlineQueue) Remove(taskID string) (removed bool, freed int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, m := range q.msgs {
+		if m.TaskID == taskID {
+			q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+			q.bytes -= len(m.Payload)
+			return true, len(m.Payload)
+		}
+	}
+	return false, 0
+}
+
+// RemoveExpired deletes messages whose TTL has passed and returns them with
+// the bytes freed.
+func (q *offlineQueue) RemoveExpired(now time.Time) (out []models.OfflineMessage, freed int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := q.msgs[:0]
+	for _, m := range q.msgs {
+		if offlineExpired(m, now) {
+			out = append(out, m)
+			freed += len(m.Payload)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	q.msgs = kept
+	q.bytes -= freed
+	return out, freed
+}
+
 func (q *offlineQueue) Len() int {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -91,12 +143,16 @@ func getOrMakeQueue(identityToken string) *offlineQueue {
 	return actual.(*offlineQueue)
 }
 
-// Exposed helpers
-func OfflineEnqueue(identityToken string, payload []byte) (dropped int) {
+// memoryOfflineStore is the process-local OfflineStore (OFFLINE_STORE=memory).
+// Queued messages are lost on restart.
+type memoryOfflineStore struct{}
+
+func (memoryOfflineStore) Enqueue(identityToken string, m models.OfflineMessage) (dropped int, err error) {
+	payload := m.Payload
 	// fast fail if a single message is absurdly large compared to global cap
 	if int64(len(payload)) > globalOfflineMaxBytes {
 		metricsDropped(1)
-		return 1
+		return 1, nil
 	}
 
 	// Check global headroom
@@ -105,7 +161,7 @@ func OfflineEnqueue(identityToken string, payload []byte) (dropped int) {
 		if cur+int64(len(payload)) > globalOfflineMaxBytes {
 			// No room globally; drop this payload
 			metricsDropped(1)
-			return 1
+			return 1, nil
 		}
 		if atomic.CompareAndSwapInt64(&globalOfflineBytes, cur, cur+int64(len(payload))) {
 			break
@@ -114,12 +170,12 @@ func OfflineEnqueue(identityToken string, payload []byte) (dropped int) {
 
 	// Try to enqueue in per-agent queue (may drop head to make room)
 	q := getOrMakeQueue(identityToken)
-	droppedLocal, accepted, deltaBytes := q.Enqueue(payload)
+	droppedLocal, accepted, deltaBytes := q.Enqueue(m)
 	if !accepted {
 		// refund the previously reserved global bytes
 		atomic.AddInt64(&globalOfflineBytes, -int64(len(payload)))
 		metricsDropped(1)
-		return 1
+		return 1, nil
 	}
 
 	// If we dropped local messages, reflect those bytes into global counter.
@@ -131,33 +187,83 @@ func OfflineEnqueue(identityToken string, payload []byte) (dropped int) {
 		metricsDropped(droppedLocal)
 	}
 
-	// deltaBytes counts the payload admitted; already added to global before Enqueue.
-	_ = deltaBytes
-	return droppedLocal
+	// deltaBytes is the payload admitted minus the heads dropped; the payload was
+	// already added to global before Enqueue, so release the dropped bytes.
+	if freed := len(payload) - deltaBytes; freed > 0 {
+		atomic.AddInt64(&globalOfflineBytes, -int64(freed))
+	}
+	return droppedLocal, nil
 }
 
-func OfflineDrain(identityToken string) [][]byte {
+func (memoryOfflineStore) Drain(identityToken string) ([]models.OfflineMessage, error) {
 	if v, ok := offlineBuf.Load(identityToken); ok {
 		q := v.(*offlineQueue)
 		out, delta := q.Drain()
 		if delta != 0 {
 			atomic.AddInt64(&globalOfflineBytes, int64(delta))
 		}
-		return out
+		return out, nil
 	}
+	return nil, nil
+}
+
+func (memoryOfflineStore) Requeue(identityToken string, msgs []models.OfflineMessage) error {
+	delta := getOrMakeQueue(identityToken).Requeue(msgs)
+	atomic.AddInt64(&globalOfflineBytes, int64(delta))
 	return nil
 }
 
-func OfflineStats() (agents int, totalMsgs int, totalBytes int) {
-	agents = 0
+func (memoryOfflineStore) RemoveTask(identityToken, taskID string) (bool, error) {
+	v, ok := offlineBuf.Load(identityToken)
+	if !ok {
+		return false, nil
+	}
+	removed, freed := v.(*offlineQueue).Remove(taskID)
+	if freed > 0 {
+		atomic.AddInt64(&globalOfflineBytes, -int64(freed))
+	}
+	return removed, nil
+}
+
+func (memoryOfflineStore) Stats() (totalMsgs int, totalBytes int, err error) {
 	totalMsgs = 0
 	totalBytes = 0
 	offlineBuf.Range(func(_, vv any) bool {
 		q := vv.(*offlineQueue)
-		agents++
 		totalMsgs += q.Len()
 		totalBytes += q.Bytes()
 		return true
 	})
 	return
 }
+
+func (memoryOfflineStore) Purge(now time.Time) ([]models.PurgedOfflineMessage, error) {
+	var out []models.PurgedOfflineMessage
+	offlineBuf.Range(func(k, v any) bool {
+		identityToken := k.(string)
+		q := v.(*offlineQueue)
+		_, _, enrolled := utils.FindAgentKeys(func(_ string, keys utils.AgentKeys) bool {
+			return keys.IdentityToken == identityToken
+		})
+		var gone []models.OfflineMessage
+		var delta int
+		if enrolled {
+			var freed int
+			gone, freed = q.RemoveExpired(now)
+			delta = -freed
+		} else {
+			gone, delta = q.Drain()
+			offlineBuf.Delete(identityToken)
+		}
+		if delta != 0 {
+			atomic.AddInt64(&globalOfflineBytes, int64(delta))
+		}
+		for _, m := range gone {
+			out = append(out, models.PurgedOfflineMessage{
+				IdentityToken: identityToken, TaskID: m.TaskID, ExpiresAt: m.ExpiresAt, Orphaned: !enrolled,
+			})
+		}
+		return true
+	})
+	return out, nil
+}
@@ -0,0 +1,134 @@
+// internal/websocket/offline_store.go
+package websocket
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// OfflineStore holds messages for agents that are not connected. Enqueue keeps
+// the per-agent (OFFLINE_MAX_MSGS, OFFLINE_MAX_BYTES) and global
+// (OFFLINE_GLOBAL_MAX_BYTES) caps, dropping the agent's oldest messages first;
+// Drain returns the queue in enqueue order and empties it; Requeue puts the
+// undelivered rest of a drain back at the head, ahead of messages queued since.
+// Expiry is checked by the caller at flush time.
+type OfflineStore interface {
+	Enqueue(identityToken string, m models.OfflineMessage) (dropped int, err error)
+	Drain(identityToken string) ([]models.OfflineMessage, error)
+	Requeue(identityToken string, msgs []models.OfflineMessage) error
+	RemoveTask(identityToken, taskID string) (bool, error) // drop a queued task (cancellation)
+	Stats() (msgs, bytes int, err error)
+	// Purge drops expired messages and queues of identities no agent holds
+	Purge(now time.Time) ([]models.PurgedOfflineMessage, error)
+}
+
+// OFFLINE_STORE selects the backend: "postgres" (default; survives restarts and
+// is shared by every gateway node) or "memory".
+var offlineStore = newOfflineStore(config.String("OFFLINE_STORE", "postgres"))
+
+func newOfflineStore(kind string) OfflineStore {
+	switch strings.ToLower(kind) {
+	case "memory":
+		return memoryOfflineStore{}
+	case "postgres", "":
+		return postgresOfflineStore{}
+	default:
+		log.Printf("unknown OFFLINE_STORE %q, using postgres", kind)
+		return postgresOfflineStore{}
+	}
+}
+
+// SetOfflineStore replaces the backend; call before agents connect.
+func SetOfflineStore(s OfflineStore) {
+	offlineStore = s
+}
+
+// postgresOfflineStore keeps queued messages in offline_messages, payloads
+// envelope-encrypted like other secrets at rest.
+type postgresOfflineStore struct{}
+
+func (postgresOfflineStore) Enqueue(identityToken string, m models.OfflineMessage) (int, error) {
+	dropped, accepted, err := models.EnqueueOfflineMessage(identityToken, m, models.OfflineLimits{
+		MaxMsgs:        defaultOfflineMaxMsgs,
+		MaxBytes:       defaultOfflineMaxBytes,
+		GlobalMaxBytes: globalOfflineMaxBytes,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !accepted {
+		return dropped + 1, nil
+	}
+	return dropped, nil
+}
+
+func (postgresOfflineStore) Drain(identityToken string) ([]models.OfflineMessage, error) {
+	msgs, skipped, err := models.DrainOfflineMessages(identityToken)
+	if skipped > 0 {
+		log.Printf("offline queue of %s: %d undecryptable message(s) dropped", identityToken, skipped)
+		metricsDropped(skipped)
+	}
+	return msgs, err
+}
+
+func (postgresOfflineStore) Requeue(identityToken string, msgs []models.OfflineMessage) error {
+	return models.RequeueOfflineMessages(identityToken, msgs)
+}
+
+func (postgresOfflineStore) RemoveTask(identityToken, taskID string) (bool, error) {
+	return models.RemoveOfflineTask(identityToken, taskID)
+}
+
+func (postgresOfflineStore) Stats() (int, int, error) {
+	return models.OfflineMessageStats()
+}
+
+func (postgresOfflineStore) Purge(now time.Time) ([]models.PurgedOfflineMessage, error) {
+	return models.PurgeOfflineMessages(now, offlineOrphanGrace)
+}
+
+// OfflineEnqueue queues a message for an offline agent and returns how many
+// messages were dropped to respect the caps (including m itself if it could
+// not be stored).
+func OfflineEnqueue(identityToken string, m models.OfflineMessage) (dropped int) {
+	dropped, err := offlineStore.Enqueue(identityToken, m)
+	if err != nil {
+		log.Printf("offline enqueue for %s failed: %v", identityToken, err)
+		return 1
+	}
+	return dropped
+}
+
+// OfflineDrain removes and returns the agent's queued messages, oldest first.
+func OfflineDrain(identityToken string) []models.OfflineMessage {
+	msgs, err := offlineStore.Drain(identityToken)
+	if err != nil {
+		log.Printf("offline drain for %s failed: %v", identityToken, err)
+	}
+	return msgs
+}
+
+// OfflineRequeue returns drained messages that could not be delivered to the
+// head of the agent's queue, keeping their order.
+func OfflineRequeue(identityToken string, msgs []models.OfflineMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	if err := offlineStore.Requeue(identityToken, msgs); err != nil {
+		log.Printf("offline requeue for %s failed: %v", identityToken, err)
+		metricsDropped(len(msgs))
+	}
+}
+
+// OfflineStats reports the queued messages and bytes across all agents.
+func OfflineStats() (totalMsgs int, totalBytes int) {
+	totalMsgs, totalBytes, err := offlineStore.Stats()
+	if err != nil {
+		log.Printf("offline stats failed: %v", err)
+	}
+	return totalMsgs, totalBytes
+}
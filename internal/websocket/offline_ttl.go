@@ -0,0 +1,134 @@
+// internal/websocket/offline_ttl.go
+package websocket
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Messages queued for an offline agent expire so a task nobody is waiting for
+// any more is not run days later. The lifetime is chosen per send, else by the
+// task template (task_templates.offline_ttl_seconds), else
+// OFFLINE_DEFAULT_TTL_SECONDS; 0 in the template or the setting means never.
+var defaultOfflineTTL = time.Duration(config.Int("OFFLINE_DEFAULT_TTL_SECONDS", 24*60*60)) * time.Second
+
+// Expired messages of agents that stay away, and queues left under an identity
+// token after re-enrollment, are purged every OFFLINE_PURGE_INTERVAL_SECONDS
+// so they stop counting against OFFLINE_GLOBAL_MAX_BYTES. Orphaned rows are
+// kept for OFFLINE_ORPHAN_GRACE_SECONDS first.
+var (
+	offlinePurgeInterval = time.Duration(config.Int("OFFLINE_PURGE_INTERVAL_SECONDS", 300)) * time.Second
+	offlineOrphanGrace   = time.Duration(config.Int("OFFLINE_ORPHAN_GRACE_SECONDS", 3600)) * time.Second
+)
+
+// offlineExpiry turns a send-time TTL into an expiry: 0 selects the default,
+// a negative TTL never expires.
+func offlineExpiry(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		ttl = defaultOfflineTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl).UTC()
+}
+
+// taskOfflineTTL resolves the TTL of a task: override, then template, then 0 (default).
+func taskOfflineTTL(task string, override time.Duration) time.Duration {
+	if override != 0 {
+		return override
+	}
+	ttl, ok, err := models.TaskTemplateTTL(task)
+	if err != nil {
+		log.Printf("offline ttl of %s: %v", task, err)
+		return 0
+	}
+	if !ok {
+		return 0
+	}
+	if ttl <= 0 {
+		return -1 // template says never
+	}
+	return ttl
+}
+
+func offlineExpired(m models.OfflineMessage, now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// expireOfflineMessage drops a message whose TTL passed before delivery and
+// reports it on the task it carried.
+func expireOfflineMessage(a *AgentConn, m models.OfflineMessage) {
+	metricsOfflineExpired(1)
+	if m.TaskID == "" {
+		log.Printf("offline message for %s expired at %s, dropped", a.CommonName, m.ExpiresAt.Format(time.RFC3339))
+		return
+	}
+	detail := fmt.Sprintf("expired in offline queue at %s before the agent reconnected", m.ExpiresAt.Format(time.RFC3339))
+	expireQueuedTask(strings.TrimPrefix(a.CommonName, "Agent_"), m.TaskID, m.ExpiresAt, detail)
+	log.Printf("task %s for %s expired in the offline queue", m.TaskID, a.CommonName)
+}
+
+// expireQueuedTask closes the record of a task that left the offline queue
+// without being delivered.
+func expireQueuedTask(vpsId, taskID string, expiresAt time.Time, detail string) {
+	releaseTaskSlot(taskID)
+	stopRetries(taskID)
+	if err := models.SetTaskStatus(taskID, models.TaskStatusExpired, detail); err != nil {
+		log.Printf("mark task %s expired: %v", taskID, err)
+	}
+	models.RecordAudit(models.AuditEntry{
+		Action:   "task_expired",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(vpsId),
+		Details:  fmt.Sprintf("task_id=%s expires_at=%s", taskID, expiresAt.Format(time.RFC3339)),
+	})
+}
+
+// StartOfflinePurger periodically drops expired and orphaned offline messages.
+func StartOfflinePurger() {
+	go func() {
+		ticker := time.NewTicker(offlinePurgeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			purgeOfflineMessages(time.Now())
+		}
+	}()
+}
+
+func purgeOfflineMessages(now time.Time) {
+	purged, err := offlineStore.Purge(now)
+	if err != nil {
+		log.Printf("offline purge failed: %v", err)
+		return
+	}
+	orphaned := 0
+	for _, p := range purged {
+		if p.Orphaned {
+			orphaned++
+			metricsDropped(1)
+		} else {
+			metricsOfflineExpired(1)
+		}
+		if p.TaskID == "" {
+			continue
+		}
+		detail := fmt.Sprintf("expired in offline queue at %s before the agent reconnected", p.ExpiresAt.Format(time.RFC3339))
+		if p.Orphaned {
+			detail = "dropped from the offline queue: the agent was re-enrolled or removed"
+		}
+		vpsId := ""
+		if rec, ok, err := models.GetTaskRecord(p.TaskID); err == nil && ok {
+			vpsId = rec.VPSID
+		}
+		expireQueuedTask(vpsId, p.TaskID, p.ExpiresAt, detail)
+	}
+	if len(purged) > 0 {
+		log.Printf("offline purge: %d message(s) dropped, %d of them orphaned", len(purged), orphaned)
+	}
+}
@@ -12,6 +12,7 @@ type pendingEntry struct {
 	ch            chan TaskResult
 	agentIdentity string
 	created       time.Time
+	delivered     bool // the agent acknowledged the delivery carrying the task
 }
 
 var (
@@ -47,6 +48,17 @@ func unregisterPending(taskID string) {
 	}
 }
 
+// pendingOwner returns the agent identity a pending task was sent to.
+func pendingOwner(taskID string) (string, bool) {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+	e, ok := pendingMap[taskID]
+	if !ok {
+		return "", false
+	}
+	return e.agentIdentity, true
+}
+
 // resolvePending sends result to the waiting channel and returns true if someone was waiting.
 func resolvePending(taskID string, result TaskResult) bool {
 	pendingMtx.Lock()
@@ -88,9 +100,52 @@ func waitForPending(taskID string, timeout time.Duration) (TaskResult, error) {
 	}
 }
 
+// markPendingDelivered records that the agent acknowledged receiving the task.
+func markPendingDelivered(taskID string) {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+	if e, ok := pendingMap[taskID]; ok {
+		e.delivered = true
+	}
+}
+
+// pendingTask is a snapshot of one pending entry.
+type pendingTask struct {
+	taskID    string
+	delivered bool
+}
+
+// pendingForAgent lists the tasks still waiting on agentIdentity.
+func pendingForAgent(agentIdentity string) []pendingTask {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+	var out []pendingTask
+	for id, e := range pendingMap {
+		if e.agentIdentity == agentIdentity {
+			out = append(out, pendingTask{taskID: id, delivered: e.delivered})
+		}
+	}
+	return out
+}
+
+// failPendingTask fails one pending task; reason becomes the result's stderr.
+func failPendingTask(taskID, reason string) bool {
+	pendingMtx.Lock()
+	e, ok := pendingMap[taskID]
+	if ok {
+		delete(pendingMap, taskID)
+	}
+	pendingMtx.Unlock()
+	if ok {
+		failEntries(map[string]*pendingEntry{taskID: e}, reason)
+	}
+	return ok
+}
+
 // failPendingForAgent fails all pending tasks that were intended for agentIdentity
-// This is invoked on agent disconnect so callers don't wait forever.
-func failPendingForAgent(agentIdentity, reason string) {
+// This is invoked once an agent stays disconnected past the reconnect grace so
+// callers don't wait forever.
+func failPendingForAgent(agentIdentity, reason string) int {
 	pendingMtx.Lock()
 	toFail := make(map[string]*pendingEntry)
 	for id, e := range pendingMap {
@@ -101,13 +156,19 @@ func failPendingForAgent(agentIdentity, reason string) {
 	}
 	pendingMtx.Unlock()
 
+	failEntries(toFail, "agent disconnected or connection lost: "+reason)
+	return len(toFail)
+}
+
+func failEntries(toFail map[string]*pendingEntry, reason string) {
 	for id, e := range toFail {
+		releaseTaskSlot(id)
 		res := TaskResult{
 			TaskID:       id,
 			Task:         "",
 			ExitCode:     -1,
 			Stdout:       "",
-			Stderr:       "agent disconnected or connection lost: " + reason,
+			Stderr:       reason,
 			StartedAt:    time.Now().UTC().Format(time.RFC3339Nano),
 			FinishedAt:   time.Now().UTC().Format(time.RFC3339Nano),
 			DurationSec:  0,
@@ -0,0 +1,140 @@
+// internal/websocket/protocol.go
+package websocket
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Agent protocol versions. Each version fixes the canonical strings both sides
+// sign; a format never changes inside a version. Connections that never send a
+// hello speak v1.
+//
+//	v1  legacy: heartbeat version rendered as Go prints an int under %s
+//	    ("%!s(int=1)"), task "v1|task|args joined by space|nonce|ts"
+//	v2  heartbeat "hb-v2|…" with a plain integer; task canonicalStringV2
+//	    (binds task ID and key ID, JSON-encodes args)
+//	v3  task canonicalStringV3: v2 plus the deadline, which the agent enforces
+//
+// Result and envelope formats carry their own version prefix and are the same
+// in all of them.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+	ProtocolV3 = 3
+)
+
+// Heartbeat is the agent keep-alive message.
+type Heartbeat struct {
+	Type      string `json:"type"` // "heartbeat"
+	Version   int    `json:"version"`
+	AgentID   string `json:"agent_id"`
+	Counter   uint64 `json:"counter"`
+	Nonce     string `json:"nonce"`
+	Timestamp string `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// canonicalFormats is one row of the registry.
+type canonicalFormats struct {
+	Heartbeat func(h Heartbeat) string
+	Task      func(tr TaskRequest) string // Ed25519 tasks use v2 or later
+	Result    func(tr TaskResult) string
+}
+
+var protocolRegistry = map[int]canonicalFormats{
+	ProtocolV1: {
+		Heartbeat: heartbeatCanonicalV1,
+		Task:      func(tr TaskRequest) string { return canonicalString(tr.Task, tr.Args, tr.Nonce, tr.Timestamp) },
+		Result:    resultCanonical,
+	},
+	ProtocolV2: {
+		Heartbeat: heartbeatCanonicalV2,
+		Task:      canonicalStringV2,
+		Result:    resultCanonical,
+	},
+	ProtocolV3: {
+		Heartbeat: heartbeatCanonicalV2,
+		Task:      canonicalStringV3,
+		Result:    resultCanonical,
+	},
+}
+
+// Gateway capabilities advertised in hello_ack.
+var gatewayCapabilities = []string{
+	"envelope",         // AgentEnvelope accepted
+	"result_signature", // signed task_result verified
+	"secret_rotation",  // secret_rotate / secret_rotate_ack
+	"cert_renewal",     // cert_renew / cert_csr
+	"ed25519_tasks",    // task_signing_keys, Ed25519 task signatures
+	"delivery_ack",     // sequenced delivery frames, acknowledged by the agent
+	"task_cancel",      // task_cancel / task_cancel_ack
+}
+
+// heartbeatCanonicalV1 reproduces what deployed v1 agents sign: the version is
+// formatted with %s, which Go renders as "%!s(int=N)".
+func heartbeatCanonicalV1(h Heartbeat) string {
+	return fmt.Sprintf("%%!s(int=%d)|%s|%d|%s|%s", h.Version, h.AgentID, h.Counter, h.Nonce, h.Timestamp)
+}
+
+func heartbeatCanonicalV2(h Heartbeat) string {
+	return fmt.Sprintf("hb-v2|%s|%d|%s|%s", h.AgentID, h.Counter, h.Nonce, h.Timestamp)
+}
+
+// SupportedProtocolVersions lists the registry, ascending.
+func SupportedProtocolVersions() []int {
+	out := make([]int, 0, len(protocolRegistry))
+	for v := range protocolRegistry {
+		out = append(out, v)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// negotiateProtocol picks the highest version both sides support (0 if none).
+func negotiateProtocol(offered []int) int {
+	best := 0
+	for _, v := range offered {
+		if _, ok := protocolRegistry[v]; ok && v > best {
+			best = v
+		}
+	}
+	return best
+}
+
+// ProtocolVersion returns the negotiated version (v1 until a hello arrives).
+func (a *AgentConn) ProtocolVersion() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.protocolVersion == 0 {
+		return ProtocolV1
+	}
+	return a.protocolVersion
+}
+
+func (a *AgentConn) protocolNegotiated() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.protocolVersion != 0
+}
+
+// agentProtocolVersion is the version tasks for an agent are signed with: the
+// negotiated one while connected here, else the one recorded with its last hello
+// (read fresh, as the agent may have reconnected to another node meanwhile), and
+// v1, understood by every agent, when it never sent one.
+func agentProtocolVersion(cn, identityToken string) int {
+	if a, ok := PoolGet(identityToken); ok {
+		return a.ProtocolVersion()
+	}
+	info, ok, err := models.GetAgentCapabilities(cn)
+	if err != nil {
+		log.Printf("load hello of %s: %v", cn, err)
+	}
+	if !ok || info.ProtocolVersion < ProtocolV1 {
+		return ProtocolV1
+	}
+	return info.ProtocolVersion
+}
@@ -0,0 +1,129 @@
+// internal/websocket/protocol_vectors.go
+package websocket
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+
+	"ultahost-ai-gateway/internal/utils"
+)
+
+// ProtocolVector is one known-answer test for the agent implementation: given
+// Input, the agent must produce exactly Canonical and Signature.
+type ProtocolVector struct {
+	Name      string          `json:"name"`
+	Version   int             `json:"protocol_version,omitempty"`
+	Alg       string          `json:"alg"`
+	Input     json.RawMessage `json:"input"`
+	Canonical string          `json:"canonical"`
+	Signature string          `json:"signature"`
+}
+
+// ProtocolVectorSet is the file shared with the agent repository.
+type ProtocolVectorSet struct {
+	Secret        string           `json:"hmac_secret"`
+	Ed25519Seed   string           `json:"ed25519_seed"` // base64; public key derived from it
+	Ed25519Public string           `json:"ed25519_public_key"`
+	Vectors       []ProtocolVector `json:"vectors"`
+}
+
+// Fixed inputs: vectors must be byte-for-byte reproducible.
+const (
+	vectorSecret    = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	vectorTimestamp = "2025-01-02T03:04:05.123456789Z"
+	vectorNonce     = "6f9619ff-8b86-d011-b42d-00c04fc964ff"
+	vectorTaskID    = "3f2504e0-4f89-11d3-9a0c-0305e82c3301"
+	vectorDeadline  = "2025-01-02T04:04:05Z"
+)
+
+// ProtocolTestVectors builds the known-answer vectors for every registered
+// canonical format. cmd/protocol-vectors writes them out for the agent.
+func ProtocolTestVectors() ProtocolVectorSet {
+	seed := sha256.Sum256([]byte("ultaai protocol test vector key"))
+	priv := ed25519.NewKeyFromSeed(seed[:])
+	signKey := utils.TaskSigningKey{KeyID: "ts-test", PrivateKey: priv, PublicKey: priv.Public().(ed25519.PublicKey)}
+
+	set := ProtocolVectorSet{
+		Secret:        vectorSecret,
+		Ed25519Seed:   base64.StdEncoding.EncodeToString(seed[:]),
+		Ed25519Public: base64.StdEncoding.EncodeToString(signKey.PublicKey),
+	}
+	hmacVector := func(name string, version int, input interface{}, canon string) {
+		raw, _ := json.Marshal(input)
+		set.Vectors = append(set.Vectors, ProtocolVector{
+			Name: name, Version: version, Alg: "hmac-sha256", Input: raw,
+			Canonical: canon, Signature: utils.HMACSHA256Base64([]byte(vectorSecret), canon),
+		})
+	}
+
+	task := TaskRequest{
+		Type: "task", TaskID: vectorTaskID, Task: "install_wordpress",
+		Args: []string{"example.com", "admin user"}, Timestamp: vectorTimestamp, Nonce: vectorNonce,
+	}
+	result := TaskResult{
+		TaskID: vectorTaskID, Task: "install_wordpress", ExitCode: 0,
+		Stdout: "installed\n", Stderr: "", StartedAt: vectorTimestamp, FinishedAt: "2025-01-02T03:05:00Z",
+	}
+
+	for _, v := range SupportedProtocolVersions() {
+		f := protocolRegistry[v]
+		hb := Heartbeat{Type: "heartbeat", Version: v, AgentID: "Agent_42", Counter: 7, Nonce: vectorNonce, Timestamp: vectorTimestamp}
+		hmacVector("heartbeat", v, hb, f.Heartbeat(hb))
+
+		t := task
+		if v > ProtocolV1 {
+			t.Version = v
+		}
+		if v >= ProtocolV3 {
+			t.Deadline = vectorDeadline
+		}
+		hmacVector("task", v, t, f.Task(t))
+		hmacVector("task_result", v, result, f.Result(result))
+	}
+
+	edTask := task
+	edTask.Version, edTask.Alg, edTask.KeyID = ProtocolV2, utils.TaskSigEd25519, signKey.KeyID
+	raw, _ := json.Marshal(edTask)
+	canon := canonicalStringV2(edTask)
+	set.Vectors = append(set.Vectors, ProtocolVector{
+		Name: "task", Version: ProtocolV2, Alg: utils.TaskSigEd25519, Input: raw,
+		Canonical: canon, Signature: signKey.Sign(canon),
+	})
+	edTask.Version, edTask.Deadline = ProtocolV3, vectorDeadline
+	raw, _ = json.Marshal(edTask)
+	canon = canonicalStringV3(edTask)
+	set.Vectors = append(set.Vectors, ProtocolVector{
+		Name: "task", Version: ProtocolV3, Alg: utils.TaskSigEd25519, Input: raw,
+		Canonical: canon, Signature: signKey.Sign(canon),
+	})
+
+	env := AgentEnvelope{
+		V: envelopeVersion, Type: "heartbeat", Seq: 1001, Nonce: vectorNonce, Timestamp: vectorTimestamp,
+		Payload: json.RawMessage(`{"type":"heartbeat","agent_id":"Agent_42"}`),
+	}
+	hmacVector("envelope", 0, env, envelopeCanonical(env))
+
+	rot := SecretRotate{
+		Type: "secret_rotate", RotationID: vectorTaskID, NewSecret: "new-secret",
+		GraceUntil: "2025-01-02T04:04:05Z", Timestamp: vectorTimestamp, Nonce: vectorNonce,
+	}
+	hmacVector("secret_rotate", 0, rot, rotateCanonical(rot))
+	hmacVector("secret_rotate_ack", 0, map[string]string{"rotation_id": vectorTaskID}, rotateAckCanonical(vectorTaskID))
+
+	cancel := TaskCancel{Type: "task_cancel", TaskID: vectorTaskID, Reason: "cancelled by user", Timestamp: vectorTimestamp, Nonce: vectorNonce}
+	hmacVector("task_cancel", 0, cancel, cancelCanonical(cancel))
+	edCancel := cancel
+	edCancel.Alg, edCancel.KeyID = utils.TaskSigEd25519, signKey.KeyID
+	raw, _ = json.Marshal(edCancel)
+	canon = cancelCanonical(edCancel)
+	set.Vectors = append(set.Vectors, ProtocolVector{
+		Name: "task_cancel", Alg: utils.TaskSigEd25519, Input: raw,
+		Canonical: canon, Signature: signKey.Sign(canon),
+	})
+	hmacVector("task_cancel_ack", 0, map[string]interface{}{"task_id": vectorTaskID, "cancelled": true},
+		cancelAckCanonical(vectorTaskID, true))
+
+	return set
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"ultahost-ai-gateway/internal/utils"
+)
+
+const vectorsFile = "testdata/protocol_vectors.json"
+
+func loadVectorFile(t *testing.T) ([]byte, ProtocolVectorSet) {
+	t.Helper()
+	data, err := os.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatalf("read %s: %v", vectorsFile, err)
+	}
+	var set ProtocolVectorSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		t.Fatalf("parse %s: %v", vectorsFile, err)
+	}
+	return data, set
+}
+
+// The file shared with the agent must match what the registry produces now;
+// regenerate it with `go run ./cmd/protocol-vectors`.
+func TestProtocolVectorsUpToDate(t *testing.T) {
+	existing, _ := loadVectorFile(t)
+	data, err := json.MarshalIndent(ProtocolTestVectors(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+	if !bytes.Equal(existing, data) {
+		t.Fatalf("%s is out of date; run go run ./cmd/protocol-vectors and share it with the agent", vectorsFile)
+	}
+}
+
+// Every vector's canonical string follows from its input, and its signature
+// verifies over that string.
+func TestProtocolVectorSignatures(t *testing.T) {
+	_, set := loadVectorFile(t)
+	pub, err := base64.StdEncoding.DecodeString(set.Ed25519Public)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		t.Fatalf("bad ed25519_public_key: %v", err)
+	}
+	if len(set.Vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+
+	for _, v := range set.Vectors {
+		name := v.Name + "/" + v.Alg
+		canon, err := vectorCanonical(v)
+		if err != nil {
+			t.Errorf("%s v%d: decode input: %v", name, v.Version, err)
+			continue
+		}
+		if canon != v.Canonical {
+			t.Errorf("%s v%d: canonical %q, file has %q", name, v.Version, canon, v.Canonical)
+		}
+
+		switch v.Alg {
+		case "hmac-sha256":
+			if sig := utils.HMACSHA256Base64([]byte(set.Secret), v.Canonical); sig != v.Signature {
+				t.Errorf("%s v%d: hmac %s, file has %s", name, v.Version, sig, v.Signature)
+			}
+		case utils.TaskSigEd25519:
+			sig, err := base64.StdEncoding.DecodeString(v.Signature)
+			if err != nil || !ed25519.Verify(pub, []byte(v.Canonical), sig) {
+				t.Errorf("%s v%d: ed25519 signature does not verify", name, v.Version)
+			}
+		default:
+			t.Errorf("%s v%d: unknown alg", name, v.Version)
+		}
+	}
+}
+
+// vectorCanonical rebuilds the canonical string of a vector from its input.
+func vectorCanonical(v ProtocolVector) (string, error) {
+	format := protocolRegistry[v.Version]
+	switch v.Name {
+	case "heartbeat":
+		var hb Heartbeat
+		err := json.Unmarshal(v.Input, &hb)
+		return format.Heartbeat(hb), err
+	case "task":
+		var tr TaskRequest
+		err := json.Unmarshal(v.Input, &tr)
+		return format.Task(tr), err
+	case "task_result":
+		var res TaskResult
+		err := json.Unmarshal(v.Input, &res)
+		return format.Result(res), err
+	case "envelope":
+		var env AgentEnvelope
+		if err := json.Unmarshal(v.Input, &env); err != nil {
+			return "", err
+		}
+		// The file is indented; the payload hash covers the compact bytes as sent
+		var payload bytes.Buffer
+		err := json.Compact(&payload, env.Payload)
+		env.Payload = payload.Bytes()
+		return envelopeCanonical(env), err
+	case "secret_rotate":
+		var rot SecretRotate
+		err := json.Unmarshal(v.Input, &rot)
+		return rotateCanonical(rot), err
+	case "secret_rotate_ack":
+		var ack struct {
+			RotationID string `json:"rotation_id"`
+		}
+		err := json.Unmarshal(v.Input, &ack)
+		return rotateAckCanonical(ack.RotationID), err
+	case "task_cancel":
+		var c TaskCancel
+		err := json.Unmarshal(v.Input, &c)
+		return cancelCanonical(c), err
+	case "task_cancel_ack":
+		var ack struct {
+			TaskID    string `json:"task_id"`
+			Cancelled bool   `json:"cancelled"`
+		}
+		err := json.Unmarshal(v.Input, &ack)
+		return cancelAckCanonical(ack.TaskID, ack.Cancelled), err
+	}
+	return "", fmt.Errorf("unknown vector %q", v.Name)
+}
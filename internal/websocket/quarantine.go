@@ -0,0 +1,173 @@
+// internal/websocket/quarantine.go
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Quarantine policy: QUARANTINE_MAX_FAILURES security failures within
+// QUARANTINE_WINDOW_MINUTES quarantine the identity until an admin releases it.
+// A max of 0 disables automatic quarantine.
+var (
+	quarantineMaxFailures = config.Int("QUARANTINE_MAX_FAILURES", 5)
+	quarantineWindow      = time.Duration(config.Int("QUARANTINE_WINDOW_MINUTES", 10)) * time.Minute
+)
+
+var ErrAgentQuarantined = errors.New("agent is quarantined")
+
+// Event types that count towards the quarantine threshold.
+var quarantineCountedEvents = map[string]bool{
+	EventFingerprintMismatch: true,
+	EventHeartbeatSignature:  true,
+	EventHeartbeatReplay:     true,
+	EventResultWrongAgent:    true,
+	EventResultSignature:     true,
+	EventEnvelopeSignature:   true,
+	EventEnvelopeReplay:      true,
+	EventEnvelopeDowngrade:   true,
+}
+
+type QuarantineInfo struct {
+	AgentName string    `json:"agent"`
+	Reason    string    `json:"reason"`
+	Since     time.Time `json:"since"`
+}
+
+var (
+	quarantined sync.Map // CN -> QuarantineInfo
+
+	failuresMu sync.Mutex
+	failures   = map[string][]time.Time{} // CN -> recent failure times
+)
+
+// LoadQuarantine restores active quarantines from the database at startup.
+func LoadQuarantine() error {
+	rows, err := models.ListActiveQuarantines()
+	if err != nil {
+		return err
+	}
+	for _, q := range rows {
+		quarantined.Store(q.AgentName, QuarantineInfo{AgentName: q.AgentName, Reason: q.Reason, Since: q.QuarantinedAt})
+	}
+	if len(rows) > 0 {
+		log.Printf("restored %d quarantined agent(s)", len(rows))
+	}
+	return nil
+}
+
+// SyncQuarantine adopts the quarantines recorded by other nodes: released
+// identities are dropped, new ones stored and their live connection here closed.
+// An empty cn re-reads every identity (e.g. after missed notifications).
+func SyncQuarantine(cn string) error {
+	rows, err := models.ListActiveQuarantines()
+	if err != nil {
+		return err
+	}
+	active := map[string]QuarantineInfo{}
+	for _, q := range rows {
+		active[q.AgentName] = QuarantineInfo{AgentName: q.AgentName, Reason: q.Reason, Since: q.QuarantinedAt}
+	}
+	apply := func(name string) {
+		info, ok := active[name]
+		if !ok {
+			quarantined.Delete(name)
+			return
+		}
+		quarantined.Store(name, info)
+		DisconnectAgent(name)
+	}
+	if cn != "" {
+		apply(cn)
+		return nil
+	}
+	quarantined.Range(func(k, _ any) bool {
+		if _, ok := active[k.(string)]; !ok {
+			quarantined.Delete(k)
+		}
+		return true
+	})
+	for name := range active {
+		apply(name)
+	}
+	return nil
+}
+
+func IsQuarantined(cn string) bool {
+	_, ok := quarantined.Load(cn)
+	return ok
+}
+
+func QuarantineList() []QuarantineInfo {
+	out := []QuarantineInfo{}
+	quarantined.Range(func(_, v any) bool {
+		out = append(out, v.(QuarantineInfo))
+		return true
+	})
+	return out
+}
+
+// noteSecurityFailure feeds the sliding window and quarantines once the policy trips.
+func noteSecurityFailure(cn, remoteAddr, eventType string) {
+	if cn == "" || quarantineMaxFailures <= 0 || !quarantineCountedEvents[eventType] || IsQuarantined(cn) {
+		return
+	}
+
+	now := time.Now()
+	failuresMu.Lock()
+	recent := failures[cn][:0]
+	for _, t := range failures[cn] {
+		if now.Sub(t) < quarantineWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	failures[cn] = recent
+	tripped := len(recent) >= quarantineMaxFailures
+	if tripped {
+		delete(failures, cn)
+	}
+	failuresMu.Unlock()
+
+	if tripped {
+		reason := fmt.Sprintf("%d security failures within %s (last: %s)", quarantineMaxFailures, quarantineWindow, eventType)
+		if err := QuarantineAgent(cn, reason, remoteAddr); err != nil {
+			log.Printf("quarantine of %s failed: %v", cn, err)
+		}
+	}
+}
+
+// QuarantineAgent quarantines an identity and drops its live connection.
+// Queued messages stay in the offline buffer until the identity is released.
+func QuarantineAgent(cn, reason, remoteAddr string) error {
+	if err := models.QuarantineAgent(cn, reason); err != nil {
+		return err
+	}
+	quarantined.Store(cn, QuarantineInfo{AgentName: cn, Reason: reason, Since: time.Now().UTC()})
+	recordSecurityEvent(EventAgentQuarantined, SeverityCritical, cn, remoteAddr, reason)
+
+	DisconnectAgent(cn)
+	return nil
+}
+
+// ReleaseQuarantine lifts a quarantine; held messages flush on the next connect.
+func ReleaseQuarantine(cn, releasedBy string) error {
+	if !IsQuarantined(cn) {
+		return fmt.Errorf("%s is not quarantined", cn)
+	}
+	if err := models.ReleaseAgentQuarantine(cn, releasedBy); err != nil {
+		return err
+	}
+	quarantined.Delete(cn)
+	failuresMu.Lock()
+	delete(failures, cn)
+	failuresMu.Unlock()
+	log.Printf("quarantine released for %s by %s", cn, releasedBy)
+	return nil
+}
@@ -0,0 +1,100 @@
+// internal/websocket/reconnect.go
+package websocket
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// A dropped connection does not fail the agent's pending tasks at once: the
+// agent usually keeps running them and reconnects. Waiters are failed only if
+// it stays away for RECONNECT_GRACE_SECONDS (0 fails them immediately). On
+// reconnect the agent lists in its hello the tasks it is still running or has
+// results for; a task it acknowledged receiving but does not list was lost
+// (e.g. the agent restarted) and is failed right away. Results sent after the reconnect
+// resolve the original waiter as usual.
+var reconnectGrace = time.Duration(config.Int("RECONNECT_GRACE_SECONDS", 120)) * time.Second
+
+var graceTimers sync.Map // identityToken -> *time.Timer
+
+// startReconnectGrace runs when a's connection ends.
+func startReconnectGrace(a *AgentConn) {
+	if reconnectGrace <= 0 {
+		metricsReconnectTasks("failed", failPendingForAgent(a.IdentityToken, "connection closed"))
+		return
+	}
+	if len(pendingForAgent(a.IdentityToken)) == 0 {
+		return
+	}
+	identity, cn := a.IdentityToken, a.CommonName
+	var t *time.Timer
+	t = time.AfterFunc(reconnectGrace, func() {
+		if !graceTimers.CompareAndDelete(identity, t) {
+			return // superseded by a reconnect or a later disconnect
+		}
+		if agentReconnected(identity, cn) {
+			return
+		}
+		n := failPendingForAgent(identity, "agent did not reconnect within "+reconnectGrace.String())
+		metricsReconnectTasks("failed", n)
+		if n > 0 {
+			log.Printf("%s did not reconnect within %s: %d pending task(s) failed", cn, reconnectGrace, n)
+		}
+	})
+	if old, loaded := graceTimers.Swap(identity, t); loaded {
+		old.(*time.Timer).Stop()
+	}
+}
+
+// endReconnectGrace cancels the grace timer when the agent is back.
+func endReconnectGrace(identityToken string) {
+	if t, ok := graceTimers.LoadAndDelete(identityToken); ok {
+		t.(*time.Timer).Stop()
+	}
+}
+
+// agentReconnected reports whether the identity is connected here or, in a
+// cluster, to another node (its results are then routed back to this one).
+func agentReconnected(identityToken, cn string) bool {
+	if _, ok := PoolGet(identityToken); ok {
+		return true
+	}
+	if !clustered() {
+		return false
+	}
+	_, ok, err := models.LookupAgentConnection(cn, clusterDirectoryTTL)
+	if err != nil {
+		log.Printf("reconnect check for %s: %v", cn, err)
+	}
+	return ok
+}
+
+// resumeInflight reconciles the agent's pending tasks with the in-flight list
+// of its hello. Tasks never acknowledged are left alone: they are still queued
+// for (re)delivery.
+func resumeInflight(a *AgentConn, inflight []string) {
+	running := make(map[string]bool, len(inflight))
+	for _, id := range inflight {
+		running[id] = true
+	}
+	resumed, lost := 0, 0
+	for _, p := range pendingForAgent(a.IdentityToken) {
+		switch {
+		case running[p.taskID]:
+			resumed++
+		case p.delivered && a.acksDeliveries():
+			if failPendingTask(p.taskID, "agent reconnected without task "+p.taskID) {
+				lost++
+			}
+		}
+	}
+	metricsReconnectTasks("resumed", resumed)
+	metricsReconnectTasks("lost", lost)
+	if resumed > 0 || lost > 0 {
+		log.Printf("%s reconnected: %d pending task(s) resumed, %d lost", a.CommonName, resumed, lost)
+	}
+}
@@ -1,24 +1,19 @@
 package websocket
 
 import (
-	"fmt"
-	"time"
+	"errors"
+
+	"ultahost-ai-gateway/internal/pkg/models"
 )
 
 func RouteToIdentity(identityToken string, payload []byte) error {
+	m := models.OfflineMessage{Payload: payload, ExpiresAt: offlineExpiry(0)}
 	if a, ok := PoolGet(identityToken); ok {
-		select {
-		case a.Send <- payload:
-			metricsEnqueued(1)
-			return nil
-		default:
-			metricsDropped(1)
-			close(a.Send)
-			_ = a.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			return fmt.Errorf("agent disconnected: backpressure")
+		if _, err := deliverLive(a, m); !errors.Is(err, errDeliveryClosed) {
+			return err
 		}
 	}
-	dropped := OfflineEnqueue(identityToken, payload)
+	dropped := OfflineEnqueue(identityToken, m)
 	if dropped > 0 {
 		metricsDropped(dropped)
 	}
@@ -0,0 +1,247 @@
+// internal/websocket/secret_rotation.go
+package websocket
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+
+	"github.com/google/uuid"
+)
+
+// Rotation protocol:
+//
+//  1. gateway -> agent  secret_rotate      new secret, signed with the current secret
+//  2. agent   -> gateway secret_rotate_ack  signed with the new secret
+//  3. gateway -> agent  secret_rotated     old secret retired
+//
+// Until the ack (or SECRET_ROTATION_GRACE_MINUTES) both secrets verify agent
+// messages; tasks keep being signed with the current secret until promotion.
+// A heartbeat signed with the pending secret counts as an implicit ack, so a
+// lost ack does not lock the agent out.
+var secretRotationGrace = time.Duration(config.Int("SECRET_ROTATION_GRACE_MINUTES", 60)) * time.Minute
+
+// SecretRotate hands the agent its next signature secret.
+type SecretRotate struct {
+	Type       string `json:"type"` // "secret_rotate"
+	RotationID string `json:"rotation_id"`
+	NewSecret  string `json:"new_secret"`
+	GraceUntil string `json:"grace_until"`
+	Timestamp  string `json:"timestamp"`
+	Nonce      string `json:"nonce"`
+	Signature  string `json:"signature"` // HMAC(current secret, rotateCanonical)
+}
+
+// SecretRotateAck proves the agent holds the new secret.
+type SecretRotateAck struct {
+	Type       string `json:"type"` // "secret_rotate_ack"
+	RotationID string `json:"rotation_id"`
+	Signature  string `json:"signature"` // HMAC(new secret, "rotate-ack-v1|rotation_id")
+}
+
+// SecretRotated tells the agent the old secret is retired.
+type SecretRotated struct {
+	Type       string `json:"type"` // "secret_rotated"
+	RotationID string `json:"rotation_id"`
+}
+
+func rotateCanonical(r SecretRotate) string {
+	return fmt.Sprintf("rotate-v1|%s|%s|%s|%s|%s", r.RotationID, r.NewSecret, r.GraceUntil, r.Nonce, r.Timestamp)
+}
+
+func rotateAckCanonical(rotationID string) string {
+	return "rotate-ack-v1|" + rotationID
+}
+
+func newSignatureSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// matchSecret returns the candidate secret that produced sig over canon.
+func matchSecret(keys utils.AgentKeys, canon, sig string) (string, bool) {
+	for _, secret := range keys.CandidateSecrets() {
+		expected := utils.HMACSHA256Base64([]byte(secret), canon)
+		if hmac.Equal([]byte(expected), []byte(sig)) {
+			return secret, true
+		}
+	}
+	return "", false
+}
+
+// RotateAgentSecret starts a rotation for cn. Connected agents receive the new
+// secret immediately; offline agents are flagged and rotate on their next connect.
+// It reports whether the rotation was sent now.
+func RotateAgentSecret(cn, reason string) (bool, error) {
+	keys, ok := utils.GetAgentKeys(cn)
+	if !ok {
+		return false, fmt.Errorf("agent keys missing for %s", cn)
+	}
+	a, online := PoolGet(keys.IdentityToken)
+	if !online {
+		keys, _ = utils.UpdateAgentKeys(cn, func(k *utils.AgentKeys) { k.RotateOnConnect = true })
+		if err := models.SaveAgentKeyRecord(cn, keys); err != nil {
+			return false, fmt.Errorf("persist rotation flag: %w", err)
+		}
+		metricsSecretRotation("deferred")
+		log.Printf("secret rotation for %s deferred until it connects (%s)", cn, reason)
+		return false, nil
+	}
+	if !a.hasCapability("secret_rotation") {
+		return false, fmt.Errorf("%s does not support secret rotation", cn)
+	}
+	return true, startSecretRotation(a, reason)
+}
+
+// maybeRotateOnConnect runs a rotation that was forced while the agent was offline.
+func maybeRotateOnConnect(a *AgentConn) {
+	keys, ok := utils.GetAgentKeys(a.CommonName)
+	if !ok || !keys.RotateOnConnect || !a.hasCapability("secret_rotation") {
+		return
+	}
+	if err := startSecretRotation(a, "forced while offline"); err != nil {
+		log.Printf("secret rotation for %s failed: %v", a.CommonName, err)
+	}
+}
+
+// startSecretRotation stores the pending secret before sending it, so a restart
+// between the two never leaves the agent with a secret the gateway forgot.
+// A newer rotation replaces any pending one.
+func startSecretRotation(a *AgentConn, reason string) error {
+	secret, err := newSignatureSecret()
+	if err != nil {
+		return err
+	}
+	graceUntil := time.Now().Add(secretRotationGrace).UTC()
+	rotationID := uuid.NewString()
+
+	var current string
+	keys, ok := utils.UpdateAgentKeys(a.CommonName, func(k *utils.AgentKeys) {
+		current = k.SignatureSecret
+		k.PendingSignatureSecret = secret
+		k.PendingRotationID = rotationID
+		k.PendingSecretUntil = graceUntil
+		k.RotateOnConnect = false
+	})
+	if !ok {
+		return fmt.Errorf("agent keys missing for %s", a.CommonName)
+	}
+	if err := models.SaveAgentKeyRecord(a.CommonName, keys); err != nil {
+		metricsSecretRotation("failed")
+		return fmt.Errorf("persist pending secret: %w", err)
+	}
+
+	msg := SecretRotate{
+		Type:       "secret_rotate",
+		RotationID: rotationID,
+		NewSecret:  secret,
+		GraceUntil: graceUntil.Format(time.RFC3339),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
+		Nonce:      uuid.NewString(),
+	}
+	msg.Signature = utils.HMACSHA256Base64([]byte(current), rotateCanonical(msg))
+	if err := sendControl(a, msg); err != nil {
+		metricsSecretRotation("failed")
+		abortSecretRotation(a.CommonName, rotationID)
+		return err
+	}
+
+	metricsSecretRotation("started")
+	models.RecordAudit(models.AuditEntry{
+		Action:   "secret_rotation_started",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(strings.TrimPrefix(a.CommonName, "Agent_")),
+		Details:  fmt.Sprintf("rotation_id=%s grace_until=%s reason=%s", rotationID, msg.GraceUntil, reason),
+	})
+	return nil
+}
+
+// abortSecretRotation drops a pending secret that never reached the agent and
+// sets RotateOnConnect again, so the rotation is retried on its next connect.
+func abortSecretRotation(cn, rotationID string) {
+	keys, ok := utils.UpdateAgentKeys(cn, func(k *utils.AgentKeys) {
+		if k.PendingRotationID == rotationID {
+			k.PendingSignatureSecret = ""
+			k.PendingRotationID = ""
+			k.PendingSecretUntil = time.Time{}
+		}
+		k.RotateOnConnect = true
+	})
+	if !ok {
+		return
+	}
+	if err := models.SaveAgentKeyRecord(cn, keys); err != nil {
+		log.Printf("restore secret rotation for %s: %v", cn, err)
+	}
+}
+
+// handleSecretRotateAck promotes the pending secret once the agent proves it holds it.
+func handleSecretRotateAck(a *AgentConn, msg []byte) error {
+	var ack SecretRotateAck
+	if err := json.Unmarshal(msg, &ack); err != nil {
+		return err
+	}
+	keys, ok := utils.GetAgentKeys(a.CommonName)
+	if !ok || keys.PendingRotationID == "" || ack.RotationID != keys.PendingRotationID {
+		return fmt.Errorf("no pending rotation %q", ack.RotationID)
+	}
+	if !time.Now().Before(keys.PendingSecretUntil) {
+		metricsSecretRotation("expired")
+		return fmt.Errorf("rotation %s expired", ack.RotationID)
+	}
+	expected := utils.HMACSHA256Base64([]byte(keys.PendingSignatureSecret), rotateAckCanonical(ack.RotationID))
+	if !hmac.Equal([]byte(expected), []byte(ack.Signature)) {
+		metricsSecretRotation("failed")
+		return fmt.Errorf("invalid ack signature")
+	}
+	return completeSecretRotation(a, ack.RotationID, "ack")
+}
+
+// completeSecretRotation retires the old secret. The in-memory keys only change
+// after the database write succeeds; on failure the pending secret stays valid
+// and the next ack or heartbeat retries.
+func completeSecretRotation(a *AgentConn, rotationID, via string) error {
+	keys, ok := utils.GetAgentKeys(a.CommonName)
+	if !ok || keys.PendingRotationID != rotationID {
+		return nil // already promoted
+	}
+	keys.SignatureSecret = keys.PendingSignatureSecret
+	keys.PendingSignatureSecret = ""
+	keys.PendingRotationID = ""
+	keys.PendingSecretUntil = time.Time{}
+	if err := models.SaveAgentKeyRecord(a.CommonName, keys); err != nil {
+		metricsSecretRotation("failed")
+		return fmt.Errorf("persist rotated secret: %w", err)
+	}
+	utils.UpdateAgentKeys(a.CommonName, func(k *utils.AgentKeys) {
+		if k.PendingRotationID != rotationID {
+			return
+		}
+		k.SignatureSecret = keys.SignatureSecret
+		k.PendingSignatureSecret = ""
+		k.PendingRotationID = ""
+		k.PendingSecretUntil = time.Time{}
+	})
+
+	metricsSecretRotation("completed")
+	models.RecordAudit(models.AuditEntry{
+		Action:   "secret_rotation_completed",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(strings.TrimPrefix(a.CommonName, "Agent_")),
+		Details:  fmt.Sprintf("rotation_id=%s via=%s", rotationID, via),
+	})
+	log.Printf("signature secret rotated for %s (%s)", a.CommonName, via)
+	return sendControl(a, SecretRotated{Type: "secret_rotated", RotationID: rotationID})
+}
@@ -0,0 +1,66 @@
+// internal/websocket/security_events.go
+package websocket
+
+import (
+	"log"
+	"time"
+
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Security event types raised on the agent channel.
+const (
+	EventClientCertMissing   = "client_cert_missing"
+	EventUnknownAgent        = "unknown_agent"
+	EventFingerprintMismatch = "cert_fingerprint_mismatch"
+	EventHeartbeatMalformed  = "heartbeat_malformed"
+	EventHeartbeatSignature  = "heartbeat_bad_signature"
+	EventHeartbeatClockSkew  = "heartbeat_clock_skew"
+	EventHeartbeatReplay     = "heartbeat_replay"
+	EventAgentQuarantined    = "agent_quarantined"
+	EventQuarantinedConnect  = "quarantined_connect"
+	EventRevokedCertificate  = "revoked_certificate"
+	EventResultWrongAgent    = "task_result_wrong_agent"
+	EventResultSignature     = "task_result_bad_signature"
+	EventResultUnsigned      = "task_result_unsigned"
+	EventEnvelopeMalformed   = "envelope_malformed"
+	EventEnvelopeSignature   = "envelope_bad_signature"
+	EventEnvelopeReplay      = "envelope_replay"
+	EventEnvelopeDowngrade   = "envelope_downgrade"
+)
+
+// Severities, matching the security_events.severity convention.
+const (
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// RecordSecurityEvent lets other layers (TLS listener, admin API) raise events.
+func RecordSecurityEvent(eventType, severity, agentName, remoteAddr, description string) {
+	recordSecurityEvent(eventType, severity, agentName, remoteAddr, description)
+}
+
+// recordSecurityEvent counts the event in Prometheus and persists it asynchronously,
+// so a slow database never holds up the connection path that detected it.
+func recordSecurityEvent(eventType, severity, agentName, remoteAddr, description string) {
+	metricsSecurityEvent(eventType, severity)
+	log.Printf("security event %s [%s] agent=%s remote=%s: %s", eventType, severity, agentName, remoteAddr, description)
+
+	ev := models.SecurityEvent{
+		EventType:   eventType,
+		Severity:    severity,
+		Description: description,
+		AgentName:   agentName,
+		RemoteAddr:  remoteAddr,
+		Timestamp:   time.Now().UTC(),
+	}
+	go func() {
+		if err := models.InsertSecurityEvent(ev); err != nil {
+			log.Printf("security event persist failed (%s): %v", eventType, err)
+		}
+	}()
+
+	noteSecurityFailure(agentName, remoteAddr, eventType)
+}
@@ -0,0 +1,196 @@
+// internal/websocket/send_lanes.go
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Outbound messages wait in one of three lanes and writePump always drains the
+// highest non-empty lane first:
+//
+//	control      hello_ack, key sets, cert renewal, secret rotation, task_cancel
+//	interactive  tasks
+//	bulk         everything else (raw messages from the API, routed messages)
+//
+// Each lane has its own bound (WS_SEND_QUEUE_CONTROL, WS_SEND_QUEUE for
+// interactive, WS_SEND_QUEUE_BULK), so a burst of bulk traffic never fills the
+// lane cancels and renewals go through. Order is kept within a lane only; a
+// cancel that would overtake its task removes the task from the queue instead
+// (see CancelTask).
+type sendLane int
+
+const (
+	laneControl sendLane = iota
+	laneInteractive
+	laneBulk
+	laneCount
+)
+
+var laneNames = [laneCount]string{"control", "interactive", "bulk"}
+
+func (l sendLane) String() string { return laneNames[l] }
+
+var laneLimits = [laneCount]int{
+	laneLimit("WS_SEND_QUEUE_CONTROL", 32),
+	laneLimit("WS_SEND_QUEUE", 64),
+	laneLimit("WS_SEND_QUEUE_BULK", 256),
+}
+
+// sendHighWater is the lane fill, in percent, at which a connection falling
+// behind is logged (0: never). It is logged again only after the lane has
+// drained below half that mark.
+var sendHighWater = config.Int("WS_SEND_HIGH_WATER_PERCENT", 80)
+
+func laneLimit(env string, def int) int {
+	n := config.Int(env, def)
+	if n < 1 {
+		n = 1
+	} else if n > 1024 {
+		n = 1024 // hard ceiling
+	}
+	return n
+}
+
+// messageLane picks the lane of a message for the agent.
+func messageLane(m models.OfflineMessage) sendLane {
+	if m.TaskID != "" {
+		return laneInteractive
+	}
+	var head struct {
+		Type string `json:"type"`
+	}
+	_ = json.Unmarshal(m.Payload, &head)
+	switch head.Type {
+	case "task_cancel":
+		return laneControl
+	case "task":
+		return laneInteractive
+	}
+	return laneBulk
+}
+
+// queuedFrame is one frame waiting to be written.
+type queuedFrame struct {
+	data   []byte
+	taskID string // task carried, if any
+	seq    uint64 // delivery seq, 0 for bare messages
+}
+
+// sendQueue holds the lanes of one connection.
+type sendQueue struct {
+	mu    sync.Mutex
+	lanes [laneCount][]queuedFrame
+	high  [laneCount]bool // lane is above the high-water mark
+	ready chan struct{}   // a frame was queued
+	room  chan struct{}   // a frame was taken
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{ready: make(chan struct{}, 1), room: make(chan struct{}, 1)}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// push appends f to lane, failing with errSendQueueFull at the lane's bound.
+// It returns the lane's depth when this push took it over the high-water mark.
+func (q *sendQueue) push(lane sendLane, f queuedFrame) (int, error) {
+	q.mu.Lock()
+	if len(q.lanes[lane]) >= laneLimits[lane] {
+		q.mu.Unlock()
+		return 0, errSendQueueFull
+	}
+	q.lanes[lane] = append(q.lanes[lane], f)
+	depth := len(q.lanes[lane])
+	crossed := sendHighWater > 0 && !q.high[lane] && depth*100 >= laneLimits[lane]*sendHighWater
+	if crossed {
+		q.high[lane] = true
+	}
+	q.mu.Unlock()
+	notify(q.ready)
+	if crossed {
+		return depth, nil
+	}
+	return 0, nil
+}
+
+// took re-arms the high-water warning of a lane that has drained. Called with
+// q.mu held.
+func (q *sendQueue) took(lane sendLane) {
+	if q.high[lane] && len(q.lanes[lane])*200 < laneLimits[lane]*sendHighWater {
+		q.high[lane] = false
+	}
+	notify(q.room)
+}
+
+// pop takes the oldest frame of the highest-priority non-empty lane.
+func (q *sendQueue) pop() (queuedFrame, sendLane, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for lane := laneControl; lane < laneCount; lane++ {
+		if len(q.lanes[lane]) == 0 {
+			continue
+		}
+		f := q.lanes[lane][0]
+		q.lanes[lane][0] = queuedFrame{}
+		q.lanes[lane] = q.lanes[lane][1:]
+		q.took(lane)
+		return f, lane, true
+	}
+	return queuedFrame{}, 0, false
+}
+
+// removeTask drops the queued frame carrying taskID, if it is still waiting.
+func (q *sendQueue) removeTask(taskID string) (queuedFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for lane := laneControl; lane < laneCount; lane++ {
+		for i, f := range q.lanes[lane] {
+			if f.taskID == taskID {
+				q.lanes[lane] = append(q.lanes[lane][:i], q.lanes[lane][i+1:]...)
+				q.took(lane)
+				return f, true
+			}
+		}
+	}
+	return queuedFrame{}, false
+}
+
+// dropOldest removes the oldest frame of lane that carries no task; tasks are
+// never dropped, since their requesters wait for a result.
+func (q *sendQueue) dropOldest(lane sendLane) (queuedFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, f := range q.lanes[lane] {
+		if f.taskID == "" {
+			q.lanes[lane] = append(q.lanes[lane][:i], q.lanes[lane][i+1:]...)
+			q.took(lane)
+			return f, true
+		}
+	}
+	return queuedFrame{}, false
+}
+
+// Close stops the writer: it sends a close frame and ends the connection.
+// Safe to call more than once.
+func (a *AgentConn) Close() {
+	a.quitOnce.Do(func() { close(a.quit) })
+}
+
+// dropQueuedTask removes a task that is still waiting in a lane, so it is
+// never written; its delivery leaves the unacked window with it.
+func (a *AgentConn) dropQueuedTask(taskID string) bool {
+	f, ok := a.sendQ.removeTask(taskID)
+	if ok {
+		a.forgetDelivery(f.seq)
+	}
+	return ok
+}
@@ -2,19 +2,27 @@
 package websocket
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
+	"ultahost-ai-gateway/internal/pkg/models"
 	"ultahost-ai-gateway/internal/utils"
 
 	"github.com/google/uuid"
 )
 
+// ErrTaskUnsupported means the agent did not list the task in its hello.
+var ErrTaskUnsupported = errors.New("task not supported by agent")
+
 // TaskRequest is sent to the agent
 type TaskRequest struct {
 	Type      string   `json:"type"`    // "task"
@@ -23,7 +31,11 @@ type TaskRequest struct {
 	Args      []string `json:"args,omitempty"`
 	Timestamp string   `json:"timestamp"` // RFC3339
 	Nonce     string   `json:"nonce"`
-	Signature string   `json:"signature"` // base64 HMAC-SHA256
+	Version   int      `json:"v,omitempty"`        // protocol version of the canonical string; omitted for v1
+	Alg       string   `json:"alg,omitempty"`      // "ed25519"; omitted for HMAC so legacy agents see the v1 shape
+	KeyID     string   `json:"kid,omitempty"`      // gateway signing key for ed25519
+	Deadline  string   `json:"deadline,omitempty"` // RFC3339; v3+, the agent stops the task after it
+	Signature string   `json:"signature"`          // base64 HMAC-SHA256 or Ed25519
 }
 
 // TaskResult is the agent's response (expected JSON shape)
@@ -41,6 +53,12 @@ type TaskResult struct {
 	CgroupUsed   bool   `json:"cgroup_used"`
 	SignatureOK  bool   `json:"signature_ok"`
 	ScriptSHA256 string `json:"script_sha256"`
+	Signature    string `json:"signature,omitempty"` // HMAC over resultCanonical, by the agent
+
+	// Set by the gateway, never taken from the agent: the result signature
+	// verified, and the result arrived after the task's deadline.
+	ResultVerified bool `json:"result_verified"`
+	Late           bool `json:"late,omitempty"`
 }
 
 // canonicalString must exactly match the agent's canonical string for HMAC
@@ -48,85 +66,420 @@ func canonicalString(task string, args []string, nonce, ts string) string {
 	return fmt.Sprintf("v1|%s|%s|%s|%s", task, strings.Join(args, " "), nonce, ts)
 }
 
-// SendSignedTask sends a signed task to the agent and returns the generated taskID.
-// This does not wait for a result.
-func SendSignedTask(vpsId string, task string, args []string) (string, error) {
-	CN := "Agent_" + vpsId
-	keyInfo, exist := utils.GetAgentKeys(CN)
-	if !exist {
-		return "", fmt.Errorf("no key info for %s", CN)
+// canonicalStringV2 is the protocol v2 task format, the oldest one used with the
+// gateway Ed25519 key. Unlike v1 it binds the task ID and key ID (empty for HMAC),
+// and JSON-encodes args so "a b" and ["a","b"] differ.
+func canonicalStringV2(tr TaskRequest) string {
+	args := tr.Args
+	if args == nil {
+		args = []string{}
 	}
+	argsJSON, _ := json.Marshal(args)
+	return fmt.Sprintf("v2|%s|%s|%s|%s|%s|%s", tr.KeyID, tr.TaskID, tr.Task, argsJSON, tr.Nonce, tr.Timestamp)
+}
+
+// canonicalStringV3 extends v2 with the deadline (empty when there is none).
+func canonicalStringV3(tr TaskRequest) string {
+	v2 := canonicalStringV2(tr)
+	return "v3" + strings.TrimPrefix(v2, "v2") + "|" + tr.Deadline
+}
 
-	ts := time.Now().UTC().Format(time.RFC3339)
-	nonce := uuid.NewString()
-	taskID := uuid.NewString()
+// signTask signs tr for the agent's algorithm and negotiated protocol version.
+// The deadline is only sent to agents that sign it (v3+); the gateway still
+// tracks it for the others.
+func signTask(cn string, keyInfo utils.AgentKeys, tr *TaskRequest) error {
+	version := agentProtocolVersion(cn, keyInfo.IdentityToken)
+	if version < ProtocolV3 {
+		tr.Deadline = ""
+	}
+
+	if keyInfo.TaskSigAlgorithm() == utils.TaskSigEd25519 {
+		k, ok := utils.ActiveTaskSigningKey()
+		if !ok {
+			return fmt.Errorf("no active task signing key")
+		}
+		if version < ProtocolV2 {
+			version = ProtocolV2
+		}
+		tr.Version, tr.Alg, tr.KeyID = version, utils.TaskSigEd25519, k.KeyID
+		tr.Signature = k.Sign(protocolRegistry[version].Task(*tr))
+		return nil
+	}
 
-	msg := canonicalString(task, args, nonce, ts)
+	if version > ProtocolV1 {
+		tr.Version = version
+	}
 	mac := hmac.New(sha256.New, []byte(keyInfo.SignatureSecret))
-	mac.Write([]byte(msg))
-	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	mac.Write([]byte(protocolRegistry[version].Task(*tr)))
+	tr.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return nil
+}
+
+// auditTaskDispatch records every task handed to an agent in the audit trail.
+// Args may hold credentials and the trail is permanent, so only their count
+// and a hash of their JSON encoding are kept.
+func auditTaskDispatch(vpsId, taskID, task string, args []string) {
+	encoded, _ := json.Marshal(args)
+	sum := sha256.Sum256(encoded)
+	models.RecordAudit(models.AuditEntry{
+		Action:   "task_dispatched",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(vpsId),
+		Details: fmt.Sprintf("task_id=%s task=%s args=%d args_sha256=%s", taskID, task, len(args),
+			hex.EncodeToString(sum[:])),
+	})
+}
 
+// SendOptions tunes a single task dispatch.
+type SendOptions struct {
+	// TTL bounds how long the task may wait in the offline queue: 0 uses the
+	// task template, then OFFLINE_DEFAULT_TTL_SECONDS; negative never expires.
+	TTL time.Duration
+	// Deadline by which the task must finish; the earliest of this, the
+	// caller's context, the wait timeout and the template's max runtime wins.
+	Deadline time.Time
+	// NoQueue refuses the task with *OperationRunningError instead of queueing
+	// it behind the tasks already running on the agent.
+	NoQueue bool
+	// OnQueued, if set, is called with the 1-based queue position when a
+	// waited task has to wait for a slot on the agent.
+	OnQueued func(position int)
+}
+
+// TaskAdmission tells the caller what became of a fire-and-forget task.
+type TaskAdmission struct {
+	TaskID   string `json:"task_id"`
+	State    string `json:"state"`              // sent, waiting, retrying
+	Position int    `json:"position,omitempty"` // 1-based, waiting only
+}
+
+// newSignedTask builds and signs a task request for the agent.
+func newSignedTask(cn string, keyInfo utils.AgentKeys, taskID, task string, args []string, deadline time.Time) (TaskRequest, []byte, error) {
 	tr := TaskRequest{
 		Type:      "task",
 		TaskID:    taskID,
 		Task:      task,
 		Args:      args,
-		Timestamp: ts,
-		Nonce:     nonce,
-		Signature: sig,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Nonce:     uuid.NewString(),
+	}
+	if !deadline.IsZero() {
+		tr.Deadline = deadline.UTC().Format(time.RFC3339)
+	}
+	if err := signTask(cn, keyInfo, &tr); err != nil {
+		return tr, nil, err
 	}
-
 	payload, err := json.Marshal(tr)
+	return tr, payload, err
+}
+
+// taskDeadline picks the earliest of the candidate deadlines (zero: none).
+func taskDeadline(ctx context.Context, task string, opts SendOptions, wait time.Duration) time.Time {
+	deadline := opts.Deadline
+	earlier := func(t time.Time) {
+		if !t.IsZero() && (deadline.IsZero() || t.Before(deadline)) {
+			deadline = t
+		}
+	}
+	if d, ok := ctx.Deadline(); ok {
+		earlier(d)
+	}
+	if wait > 0 {
+		earlier(time.Now().Add(wait))
+	}
+	if max := taskMaxRuntime(task); max > 0 {
+		earlier(time.Now().Add(max))
+	}
+	return deadline
+}
+
+// taskAttempt is one try at a task; every retry gets a new task ID.
+type taskAttempt struct {
+	vpsId   string
+	taskID  string
+	rootID  string // task ID of the first try; empty on it
+	task    string
+	args    []string
+	attempt int
+}
+
+func newTaskAttempt(vpsId, task string, args []string) taskAttempt {
+	return taskAttempt{vpsId: vpsId, taskID: uuid.NewString(), task: task, args: args, attempt: 1}
+}
+
+// root is the task ID that identifies the task across its attempts.
+func (at taskAttempt) root() string {
+	if at.rootID == "" {
+		return at.taskID
+	}
+	return at.rootID
+}
+
+// next is the following try of the same task.
+func (at taskAttempt) next() taskAttempt {
+	at.rootID, at.taskID = at.root(), uuid.NewString()
+	at.attempt++
+	return at
+}
+
+func (at taskAttempt) record(status string) models.Task {
+	return models.Task{
+		TaskID: at.taskID, VPSID: at.vpsId, TaskName: at.task, Status: status, Attempt: at.attempt, RootTaskID: at.rootID,
+	}
+}
+
+// dispatchTask records a signed task and sends it (or queues it with its TTL).
+// The record exists before the task is on the wire, so even an immediate
+// result finds it. A queued task never outlives its deadline.
+func dispatchTask(at taskAttempt, tr TaskRequest, payload []byte, ttl time.Duration, deadline time.Time) error {
+	m := models.OfflineMessage{Payload: payload, TaskID: tr.TaskID, ExpiresAt: offlineExpiry(ttl)}
+	if !deadline.IsZero() && (m.ExpiresAt.IsZero() || deadline.Before(m.ExpiresAt)) {
+		m.ExpiresAt = deadline.UTC()
+	}
+	rec := at.record(models.TaskStatusSent)
+	rec.ExpiresAt, rec.Deadline = m.ExpiresAt, deadline
+	if err := models.CreateTaskRecord(rec); err != nil {
+		log.Printf("record task %s: %v", tr.TaskID, err)
+	}
+
+	queued, err := sendMessage(at.vpsId, m)
 	if err != nil {
-		return "", err
+		if serr := models.SetTaskStatus(tr.TaskID, models.TaskStatusFailed, "send failed: "+err.Error()); serr != nil {
+			log.Printf("mark task %s failed: %v", tr.TaskID, serr)
+		}
+		return err
 	}
+	if queued {
+		if err := models.AdvanceTaskStatus(tr.TaskID, models.TaskStatusSent, models.TaskStatusQueued); err != nil {
+			log.Printf("mark task %s queued: %v", tr.TaskID, err)
+		}
+	}
+	auditTaskDispatch(at.vpsId, tr.TaskID, tr.Task, tr.Args)
+	return nil
+}
 
-	if err := SendMessage(vpsId, payload); err != nil {
-		return "", err
+// recordWaiting records a task queued behind others on the agent.
+func recordWaiting(at taskAttempt) {
+	if err := models.CreateTaskRecord(at.record(models.TaskStatusWaiting)); err != nil {
+		log.Printf("record task %s: %v", at.taskID, err)
 	}
-	return taskID, nil
 }
 
-// SendSignedTaskAndWait sends a signed task and waits up to `timeout` for a task_result from the agent.
-// Returns the TaskResult or an error on send / timeout.
-func SendSignedTaskAndWait(vpsId string, task string, args []string, timeout time.Duration) (TaskResult, error) {
-	CN := "Agent_" + vpsId
+// dispatchAdmitted signs and sends a task holding a slot on the agent. Keys are
+// looked up again since the task may have waited for the slot.
+func dispatchAdmitted(at taskAttempt, ttl time.Duration, deadline time.Time) error {
+	CN := "Agent_" + at.vpsId
 	keyInfo, exist := utils.GetAgentKeys(CN)
 	if !exist {
-		return TaskResult{}, fmt.Errorf("no key info for %s", CN)
+		releaseTaskSlot(at.taskID)
+		return fmt.Errorf("no key info for %s", CN)
+	}
+	tr, payload, err := newSignedTask(CN, keyInfo, at.taskID, at.task, at.args, deadline)
+	if err == nil {
+		err = dispatchTask(at, tr, payload, ttl, deadline)
+	}
+	if err != nil {
+		releaseTaskSlot(at.taskID)
+		return err
 	}
+	holdTaskSlot(at.taskID, deadline)
+	return nil
+}
 
-	// ts := time.Now().UTC().Format(time.RFC3339)
-	ts := time.Now().UTC().Format(time.RFC3339Nano)
+// SendSignedTask sends a signed task to the agent and returns the generated taskID.
+// This does not wait for a result.
+func SendSignedTask(vpsId string, task string, args []string) (string, error) {
+	adm, err := SendSignedTaskWith(vpsId, task, args, SendOptions{})
+	return adm.TaskID, err
+}
 
-	nonce := uuid.NewString()
-	taskID := uuid.NewString()
+// SendSignedTaskWith is SendSignedTask with per-send options. A task queued
+// behind others on the agent is recorded as waiting and sent once it may run,
+// unless its deadline or offline TTL passes first. If the template has a retry
+// policy, transient send failures and retryable exit codes are tried again in
+// the background (see task_retry.go). The returned admission carries the
+// task's queue position while it waits.
+func SendSignedTaskWith(vpsId string, task string, args []string, opts SendOptions) (TaskAdmission, error) {
+	at := newTaskAttempt(vpsId, task, args)
+	adm, err := sendTask(at, opts)
+	if err != nil {
+		return TaskAdmission{}, err
+	}
+	return adm, nil
+}
 
-	msg := canonicalString(task, args, nonce, ts)
-	mac := hmac.New(sha256.New, []byte(keyInfo.SignatureSecret))
-	mac.Write([]byte(msg))
-	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+// sendTask checks and starts a fire-and-forget task, tracking its retries.
+func sendTask(at taskAttempt, opts SendOptions) (TaskAdmission, error) {
+	adm := TaskAdmission{TaskID: at.taskID}
+	CN := "Agent_" + at.vpsId
+	if _, exist := utils.GetAgentKeys(CN); !exist {
+		return adm, fmt.Errorf("no key info for %s", CN)
+	}
+	if !AgentSupportsTask(at.vpsId, at.task) {
+		return adm, fmt.Errorf("%w: %s", ErrTaskUnsupported, at.task)
+	}
 
-	tr := TaskRequest{
-		Type:      "task",
-		TaskID:    taskID,
-		Task:      task,
-		Args:      args,
-		Timestamp: ts,
-		Nonce:     nonce,
-		Signature: sig,
+	policy := taskRetryPolicy(at.task)
+	if policy.Retries() {
+		// Tracked before dispatch so an immediate result finds it
+		trackRetry(at, time.Time{}, "")
+	}
+	position, err := startTask(at, opts)
+	if err == nil {
+		adm.State, adm.Position = "sent", position
+		if position > 0 {
+			adm.State = "waiting"
+		}
+		return adm, nil
 	}
+	if policy.Retries() && retryableSendError(err) && retryAfterFailure(at, policy, nil, err.Error()) {
+		adm.State = "retrying"
+		return adm, nil
+	}
+	forgetRetry(at)
+	return adm, err
+}
 
-	payload, err := json.Marshal(tr)
+// startTask admits and dispatches one attempt. When it has to wait for a slot
+// on the agent it is recorded as waiting and sent in the background; position
+// is then its place in the queue, else 0.
+func startTask(at taskAttempt, opts SendOptions) (int, error) {
+	ttl := taskOfflineTTL(at.task, opts.TTL)
+	s, position, err := admitTask(at.vpsId, at.taskID, at.task, !opts.NoQueue)
+	if err != nil {
+		return 0, err
+	}
+	if position == 0 {
+		return 0, dispatchAdmitted(at, ttl, taskDeadline(context.Background(), at.task, opts, 0))
+	}
+
+	recordWaiting(at)
+	until := taskDeadline(context.Background(), at.task, opts, 0)
+	if until.IsZero() {
+		until = offlineExpiry(ttl)
+	}
+	go func() {
+		if err := awaitTaskSlot(context.Background(), s, until); err != nil {
+			log.Printf("task %s for Agent_%s not sent: %v", at.taskID, at.vpsId, err)
+			forgetRetry(at)
+			return
+		}
+		err := dispatchAdmitted(at, ttl, taskDeadline(context.Background(), at.task, opts, 0))
+		if err == nil {
+			return
+		}
+		log.Printf("dispatch queued task %s to Agent_%s: %v", at.taskID, at.vpsId, err)
+		if err := models.SetTaskStatus(at.taskID, models.TaskStatusFailed, "dispatch failed: "+err.Error()); err != nil {
+			log.Printf("mark task %s failed: %v", at.taskID, err)
+		}
+		if policy := taskRetryPolicy(at.task); !policy.Retries() || !retryableSendError(err) ||
+			!retryAfterFailure(at, policy, nil, err.Error()) {
+			forgetRetry(at)
+		}
+	}()
+	return position, nil
+}
+
+// SendSignedTaskAndWait sends a signed task and waits up to `timeout` for a task_result from the agent.
+// Returns the TaskResult or an error on send / timeout.
+func SendSignedTaskAndWait(vpsId string, task string, args []string, timeout time.Duration) (TaskResult, error) {
+	return SendSignedTaskAndWaitWith(context.Background(), vpsId, task, args, timeout, SendOptions{})
+}
+
+// SendSignedTaskAndWaitWith is SendSignedTaskAndWait with per-send options. The
+// task's deadline and offline TTL never exceed timeout, which includes any time
+// spent queued behind other tasks on the agent and between retries: nobody
+// collects the result after that. If ctx ends first (e.g. the HTTP client went
+// away) the task is cancelled. Transient failures are retried under the
+// template's retry policy while time remains; a task that fails on its last
+// allowed attempt is dead-lettered.
+func SendSignedTaskAndWaitWith(ctx context.Context, vpsId string, task string, args []string, timeout time.Duration, opts SendOptions) (TaskResult, error) {
+	CN := "Agent_" + vpsId
+	if _, exist := utils.GetAgentKeys(CN); !exist {
+		return TaskResult{}, fmt.Errorf("no key info for %s", CN)
+	}
+	if IsQuarantined(CN) {
+		return TaskResult{}, ErrAgentQuarantined
+	}
+	if !AgentSupportsTask(vpsId, task) {
+		return TaskResult{}, fmt.Errorf("%w: %s", ErrTaskUnsupported, task)
+	}
+
+	policy := taskRetryPolicy(task)
+	waitUntil := time.Now().Add(timeout)
+	at := newTaskAttempt(vpsId, task, args)
+	for {
+		res, err := runTaskAttempt(ctx, at, waitUntil, opts)
+		var exitCode *int
+		switch {
+		case err == nil && (res.ExitCode == 0 || !policy.RetryableExit(res.ExitCode)):
+			return res, nil
+		case err != nil && !retryableSendError(err):
+			return res, err
+		case err == nil:
+			exitCode = &res.ExitCode
+		}
+		if !policy.Retries() {
+			return res, err
+		}
+		reason := failureReason(res, err)
+		if at.attempt >= policy.MaxAttempts {
+			deadLetterTask(at, exitCode, reason)
+			return res, err
+		}
+		delay := policy.Delay(at.attempt)
+		if time.Until(waitUntil) <= delay {
+			return res, err
+		}
+		log.Printf("task %s attempt %d failed (%s); retrying in %s", at.root(), at.attempt, reason, delay)
+		metricsTaskRetry("retried")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return res, err
+		}
+		at = at.next()
+	}
+}
+
+// runTaskAttempt admits, sends and waits for one attempt until waitUntil.
+func runTaskAttempt(ctx context.Context, at taskAttempt, waitUntil time.Time, opts SendOptions) (TaskResult, error) {
+	CN := "Agent_" + at.vpsId
+	keyInfo, exist := utils.GetAgentKeys(CN)
+	if !exist {
+		return TaskResult{}, fmt.Errorf("no key info for %s", CN)
+	}
+	taskID, task := at.taskID, at.task
+	s, position, err := admitTask(at.vpsId, taskID, task, !opts.NoQueue)
 	if err != nil {
 		return TaskResult{}, err
 	}
+	if position > 0 {
+		recordWaiting(at)
+		if opts.OnQueued != nil {
+			opts.OnQueued(position)
+		}
+		if err := awaitTaskSlot(ctx, s, waitUntil); err != nil {
+			return TaskResult{}, err
+		}
+	}
+	timeout := time.Until(waitUntil)
+	deadline := taskDeadline(ctx, task, opts, timeout)
+	ttl := taskOfflineTTL(task, opts.TTL)
+	if ttl == 0 {
+		ttl = defaultOfflineTTL
+	}
+	if ttl <= 0 || ttl > timeout {
+		ttl = timeout
+	}
 
 	// register pending before send so we don't race with an immediate result
 	ch := registerPending(taskID, keyInfo.IdentityToken)
+	routeTask(taskID, CN)
+	defer unrouteTask(taskID)
 
 	// try sending
-	if err := SendMessage(vpsId, payload); err != nil {
+	if err := dispatchAdmitted(at, ttl, deadline); err != nil {
 		// cleanup pending and return
 		unregisterPending(taskID)
 		return TaskResult{}, fmt.Errorf("send message failed: %w", err)
@@ -139,5 +492,11 @@ func SendSignedTaskAndWait(vpsId string, task string, args []string, timeout tim
 	case <-time.After(timeout):
 		unregisterPending(taskID)
 		return TaskResult{}, fmt.Errorf("timeout waiting for task result (task_id=%s)", taskID)
+	case <-ctx.Done():
+		unregisterPending(taskID)
+		if _, err := CancelTask(taskID, "requester went away"); err != nil {
+			log.Printf("cancel task %s: %v", taskID, err)
+		}
+		return TaskResult{}, fmt.Errorf("task %s abandoned: %w", taskID, ctx.Err())
 	}
 }
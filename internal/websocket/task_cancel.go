@@ -0,0 +1,276 @@
+// internal/websocket/task_cancel.go
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+
+	"github.com/google/uuid"
+)
+
+// Cancellation protocol, for agents that list "task_cancel" in their hello:
+//
+//	gateway -> agent  task_cancel      signed like a task (HMAC or Ed25519)
+//	agent   -> gateway task_cancel_ack  cancelled=false if the task already finished
+//
+// A task still in the offline queue is simply removed. The task record becomes
+// "cancelled" only once it is dequeued or the agent confirms.
+var (
+	ErrTaskNotFound      = errors.New("task not found")
+	ErrTaskFinished      = errors.New("task already finished")
+	ErrCancelUnsupported = errors.New("agent does not support task cancellation")
+)
+
+// Outcomes of CancelTask
+const (
+	CancelDequeued  = "cancelled"        // removed before delivery
+	CancelRequested = "cancel_requested" // task_cancel sent, awaiting the agent
+)
+
+// TaskCancel asks the agent to stop a task.
+type TaskCancel struct {
+	Type      string `json:"type"` // "task_cancel"
+	TaskID    string `json:"task_id"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp string `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Alg       string `json:"alg,omitempty"` // "ed25519"; omitted for HMAC
+	KeyID     string `json:"kid,omitempty"`
+	Signature string `json:"signature"`
+}
+
+// TaskCancelAck is the agent's answer to task_cancel.
+type TaskCancelAck struct {
+	Type      string `json:"type"` // "task_cancel_ack"
+	TaskID    string `json:"task_id"`
+	Cancelled bool   `json:"cancelled"`
+	Signature string `json:"signature,omitempty"` // HMAC over cancelAckCanonical; optional when enveloped
+}
+
+func cancelCanonical(c TaskCancel) string {
+	return fmt.Sprintf("cancel-v1|%s|%s|%s|%s", c.KeyID, c.TaskID, c.Nonce, c.Timestamp)
+}
+
+func cancelAckCanonical(taskID string, cancelled bool) string {
+	return fmt.Sprintf("cancel-ack-v1|%s|%t", taskID, cancelled)
+}
+
+// signCancel signs c with the key the agent verifies tasks with.
+func signCancel(keyInfo utils.AgentKeys, c *TaskCancel) error {
+	if keyInfo.TaskSigAlgorithm() == utils.TaskSigEd25519 {
+		k, ok := utils.ActiveTaskSigningKey()
+		if !ok {
+			return fmt.Errorf("no active task signing key")
+		}
+		c.Alg, c.KeyID = utils.TaskSigEd25519, k.KeyID
+		c.Signature = k.Sign(cancelCanonical(*c))
+		return nil
+	}
+	c.Signature = utils.HMACSHA256Base64([]byte(keyInfo.SignatureSecret), cancelCanonical(*c))
+	return nil
+}
+
+// agentCancels reports whether the agent agreed to task_cancel, live or in its last hello.
+func agentCancels(vpsId string) bool {
+	info, ok := AgentInfo(vpsId)
+	if !ok {
+		return false
+	}
+	for _, c := range info.Capabilities {
+		if c == "task_cancel" {
+			return true
+		}
+	}
+	return false
+}
+
+// CancelTask stops a dispatched task: it is dropped from the offline queue or
+// the send lanes if still there, otherwise a signed task_cancel is sent (or
+// queued) for the agent.
+func CancelTask(taskID, reason string) (string, error) {
+	rec, ok, err := models.GetTaskRecord(taskID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrTaskNotFound
+	}
+	if models.TaskFinished(rec.Status) {
+		// A failed attempt may still have a retry scheduled
+		if r, ok, err := models.TaskRetryByTask(taskID); err == nil && ok && !r.NextAttemptAt.IsZero() {
+			stopRetries(taskID)
+			metricsTaskCancel("dequeued")
+			return CancelDequeued, nil
+		}
+		return "", ErrTaskFinished
+	}
+	if rec.Status == models.TaskStatusWaiting {
+		// Not signed or sent yet: leaving the agent's queue is enough
+		withdrawWaitingTask(taskID)
+		if !finishCancelled(rec, "cancelled while waiting for other operations: "+reason) {
+			return "", ErrTaskFinished
+		}
+		metricsTaskCancel("dequeued")
+		return CancelDequeued, nil
+	}
+	cn := "Agent_" + rec.VPSID
+	keyInfo, ok := utils.GetAgentKeys(cn)
+	if !ok {
+		return "", fmt.Errorf("no key info for %s", cn)
+	}
+
+	removed, err := offlineStore.RemoveTask(keyInfo.IdentityToken, taskID)
+	if err != nil {
+		log.Printf("remove queued task %s: %v", taskID, err)
+	}
+	if a, ok := PoolGet(keyInfo.IdentityToken); ok && !removed && a.dropQueuedTask(taskID) {
+		// Still in a send lane: the cancel would overtake it
+		removed = true
+	}
+	if removed {
+		if !finishCancelled(rec, "cancelled before delivery: "+reason) {
+			return "", ErrTaskFinished
+		}
+		metricsTaskCancel("dequeued")
+		return CancelDequeued, nil
+	}
+
+	if !agentCancels(rec.VPSID) {
+		return "", ErrCancelUnsupported
+	}
+	msg := TaskCancel{
+		Type:      "task_cancel",
+		TaskID:    taskID,
+		Reason:    reason,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Nonce:     uuid.NewString(),
+	}
+	if err := signCancel(keyInfo, &msg); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	if _, err := sendMessage(rec.VPSID, models.OfflineMessage{Payload: payload, ExpiresAt: offlineExpiry(0)}); err != nil {
+		metricsTaskCancel("failed")
+		return "", err
+	}
+
+	metricsTaskCancel("requested")
+	models.RecordAudit(models.AuditEntry{
+		Action:   "task_cancel_requested",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(rec.VPSID),
+		Details:  fmt.Sprintf("task_id=%s reason=%s", taskID, reason),
+	})
+	return CancelRequested, nil
+}
+
+// cancelsQueuedTask handles a task_cancel forwarded by the node that issued it:
+// if its task still waits in a's send lanes the cancel would overtake it, so
+// the task is dropped and recorded cancelled instead, and the cancel is not
+// sent. It reports whether that happened.
+func cancelsQueuedTask(a *AgentConn, payload []byte) bool {
+	var c TaskCancel
+	if err := json.Unmarshal(payload, &c); err != nil || c.Type != "task_cancel" || c.TaskID == "" {
+		return false
+	}
+	if !a.dropQueuedTask(c.TaskID) {
+		return false
+	}
+	rec, ok, err := models.GetTaskRecord(c.TaskID)
+	if err != nil || !ok {
+		log.Printf("record of dropped task %s: %v", c.TaskID, err)
+		rec = models.Task{TaskID: c.TaskID, VPSID: strings.TrimPrefix(a.CommonName, "Agent_")}
+	}
+	finishCancelled(rec, "cancelled before delivery: "+c.Reason)
+	metricsTaskCancel("dequeued")
+	return true
+}
+
+// handleTaskCancelAck records the agent's answer to task_cancel.
+func handleTaskCancelAck(a *AgentConn, msg []byte, enveloped bool) error {
+	var ack TaskCancelAck
+	if err := json.Unmarshal(msg, &ack); err != nil {
+		return fmt.Errorf("invalid task_cancel_ack: %w", err)
+	}
+	rec, ok, err := models.GetTaskRecord(ack.TaskID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("task %s: %w", ack.TaskID, ErrTaskNotFound)
+	}
+	remote := a.Conn.RemoteAddr().String()
+	if "Agent_"+rec.VPSID != a.CommonName {
+		recordSecurityEvent(EventResultWrongAgent, SeverityHigh, a.CommonName, remote,
+			"task_cancel_ack for task "+ack.TaskID+" owned by another agent")
+		return fmt.Errorf("task %s: %w", ack.TaskID, errResultWrongAgent)
+	}
+	if !enveloped {
+		keys, _ := utils.GetAgentKeys(a.CommonName)
+		if _, ok := matchSecret(keys, cancelAckCanonical(ack.TaskID, ack.Cancelled), ack.Signature); !ok {
+			recordSecurityEvent(EventResultSignature, SeverityHigh, a.CommonName, remote,
+				"task_cancel_ack signature mismatch for task "+ack.TaskID)
+			return fmt.Errorf("task %s: %w", ack.TaskID, errResultSignature)
+		}
+	}
+
+	if models.TaskFinished(rec.Status) {
+		// Late or replayed: the recorded outcome stands
+		log.Printf("task_cancel_ack for finished task %s (%s) from %s ignored", ack.TaskID, rec.Status, a.CommonName)
+		return nil
+	}
+	if !ack.Cancelled {
+		metricsTaskCancel("too_late")
+		log.Printf("task %s on %s could not be cancelled; its result follows", ack.TaskID, a.CommonName)
+		return nil
+	}
+	if finishCancelled(rec, "cancelled by agent") {
+		metricsTaskCancel("confirmed")
+	}
+	return nil
+}
+
+// finishCancelled records the cancellation and releases whoever waits for the
+// task. A task that reached a final status meanwhile keeps it (and its retry
+// state); it reports whether the cancellation was recorded.
+func finishCancelled(rec models.Task, detail string) bool {
+	changed, err := models.CancelTaskRecord(rec.TaskID, detail)
+	if err != nil {
+		log.Printf("mark task %s cancelled: %v", rec.TaskID, err)
+	}
+	releaseTaskSlot(rec.TaskID)
+	if err == nil && !changed {
+		log.Printf("task %s already finished; cancellation not recorded", rec.TaskID)
+		return false
+	}
+	stopRetries(rec.TaskID)
+	models.RecordAudit(models.AuditEntry{
+		Action:   "task_cancelled",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(rec.VPSID),
+		Details:  fmt.Sprintf("task_id=%s detail=%s", rec.TaskID, detail),
+	})
+
+	stderr := "task cancelled: " + detail
+	if failPendingTask(rec.TaskID, stderr) {
+		return true
+	}
+	if route, ok := remoteTaskRoute(rec.TaskID); ok {
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		tr := TaskResult{TaskID: rec.TaskID, Task: rec.TaskName, ExitCode: -1, Stderr: stderr, StartedAt: now, FinishedAt: now}
+		if err := forwardTaskResult(route, tr); err != nil {
+			log.Printf("forward cancellation of %s: %v", rec.TaskID, err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+// internal/websocket/task_deadline.go
+package websocket
+
+import (
+	"log"
+	"time"
+
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Every task carries a deadline: the earliest of the send option, the caller's
+// context, the wait timeout and the template's max_runtime_seconds. v3 agents
+// receive it signed and stop the task when it passes; for older agents the
+// gateway only tracks it. Results received after it are accepted but flagged
+// late on the result and the task record.
+
+// taskMaxRuntime is the template's runtime limit for task (0: none).
+func taskMaxRuntime(task string) time.Duration {
+	max, ok, err := models.TaskTemplateMaxRuntime(task)
+	if err != nil {
+		log.Printf("max runtime of %s: %v", task, err)
+		return 0
+	}
+	if !ok {
+		return 0
+	}
+	return max
+}
+
+// markLateResult flags tr when it arrived after the deadline of its task.
+func markLateResult(tr *TaskResult, now time.Time) {
+	rec, ok, err := models.GetTaskRecord(tr.TaskID)
+	if err != nil {
+		log.Printf("deadline of task %s: %v", tr.TaskID, err)
+		return
+	}
+	if !ok || rec.Deadline.IsZero() || !now.After(rec.Deadline) {
+		return
+	}
+	tr.Late = true
+	metricsLateResult()
+	log.Printf("task %s result arrived %s after its deadline", tr.TaskID, now.Sub(rec.Deadline).Round(time.Second))
+}
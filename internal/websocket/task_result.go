@@ -0,0 +1,164 @@
+// internal/websocket/task_result.go
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+	"ultahost-ai-gateway/internal/utils"
+)
+
+// RESULT_SIGNATURE_REQUIRED=1 rejects unsigned results. Off by default so agents
+// that predate result signing keep working; their results are delivered with
+// ResultVerified=false. A present but invalid signature is always rejected.
+var resultSignatureRequired = config.Int("RESULT_SIGNATURE_REQUIRED", 0) == 1
+
+var (
+	errResultUnknownTask = errors.New("unknown task_id")
+	errResultWrongAgent  = errors.New("result from an agent the task was not sent to")
+	errResultSignature   = errors.New("invalid result signature")
+	errResultUnsigned    = errors.New("unsigned result")
+)
+
+// resultCanonical is what agents sign (HMAC-SHA256 with their signature secret).
+// Output is hashed so the canonical string stays small and unambiguous.
+func resultCanonical(tr TaskResult) string {
+	stdout := sha256.Sum256([]byte(tr.Stdout))
+	stderr := sha256.Sum256([]byte(tr.Stderr))
+	return fmt.Sprintf("result-v1|%s|%s|%d|%s|%s|%s|%s",
+		tr.TaskID, tr.Task, tr.ExitCode,
+		hex.EncodeToString(stdout[:]), hex.EncodeToString(stderr[:]),
+		tr.StartedAt, tr.FinishedAt)
+}
+
+// handleTaskResult checks that the result comes from the identity the task was
+// sent to and carries a valid agent signature (its own or its envelope's) before
+// waking the waiter.
+func handleTaskResult(a *AgentConn, msg []byte, enveloped bool) error {
+	var tr TaskResult
+	if err := json.Unmarshal(msg, &tr); err != nil {
+		return fmt.Errorf("invalid task_result: %w", err)
+	}
+	tr.ResultVerified, tr.Late = false, false
+
+	route, waited, err := verifyTaskResult(a, &tr, enveloped)
+	if err != nil {
+		metricsTaskResult(resultOutcome(err))
+		remote := a.Conn.RemoteAddr().String()
+		switch {
+		case errors.Is(err, errResultWrongAgent):
+			recordSecurityEvent(EventResultWrongAgent, SeverityHigh, a.CommonName, remote,
+				"task_result for task "+tr.TaskID+" owned by another agent")
+		case errors.Is(err, errResultSignature):
+			recordSecurityEvent(EventResultSignature, SeverityHigh, a.CommonName, remote,
+				"task_result signature mismatch for task "+tr.TaskID)
+		case errors.Is(err, errResultUnsigned):
+			recordSecurityEvent(EventResultUnsigned, SeverityMedium, a.CommonName, remote,
+				"unsigned task_result for task "+tr.TaskID+" rejected")
+		}
+		return fmt.Errorf("task %s: %w", tr.TaskID, err)
+	}
+
+	if tr.ResultVerified {
+		metricsTaskResult("verified")
+	} else {
+		metricsTaskResult("unsigned")
+	}
+	markLateResult(&tr, time.Now())
+	recordTaskResult(tr)
+	if route != nil {
+		// Waited on by another gateway node
+		if err := forwardTaskResult(*route, tr); err != nil {
+			return fmt.Errorf("task %s: forward result: %w", tr.TaskID, err)
+		}
+		return nil
+	}
+	if !waited {
+		// The waiter gave up (typically at the deadline); the record keeps the result
+		log.Printf("task %s: result recorded, nobody waiting", tr.TaskID)
+		return nil
+	}
+	if !resolvePending(tr.TaskID, tr) {
+		return fmt.Errorf("task %s: %w", tr.TaskID, errResultUnknownTask)
+	}
+	return nil
+}
+
+// verifyTaskResult returns the route of a task waited on by another node, or
+// nil when the waiter is local. waited is false for a task still open in the
+// task records whose waiter already gave up.
+func verifyTaskResult(a *AgentConn, tr *TaskResult, enveloped bool) (route *models.TaskRoute, waited bool, err error) {
+	if owner, ok := pendingOwner(tr.TaskID); ok {
+		if owner != a.IdentityToken {
+			return nil, false, errResultWrongAgent
+		}
+		waited = true
+	} else if r, ok := remoteTaskRoute(tr.TaskID); ok {
+		if r.CommonName != a.CommonName {
+			return nil, false, errResultWrongAgent
+		}
+		route, waited = &r, true
+	} else {
+		rec, ok, err := models.GetTaskRecord(tr.TaskID)
+		if err != nil || !ok || models.TaskFinished(rec.Status) {
+			return nil, false, errResultUnknownTask
+		}
+		if "Agent_"+rec.VPSID != a.CommonName {
+			return nil, false, errResultWrongAgent
+		}
+	}
+
+	if tr.Signature == "" {
+		if enveloped {
+			// The envelope is signed with the same secret and covers the whole payload.
+			tr.ResultVerified = true
+			return route, waited, nil
+		}
+		if resultSignatureRequired {
+			return nil, false, errResultUnsigned
+		}
+		return route, waited, nil
+	}
+	keys, ok := utils.GetAgentKeys(a.CommonName)
+	if !ok {
+		return nil, false, errResultSignature
+	}
+	if _, ok := matchSecret(keys, protocolRegistry[a.ProtocolVersion()].Result(*tr), tr.Signature); !ok {
+		return nil, false, errResultSignature
+	}
+	tr.ResultVerified = true
+	return route, waited, nil
+}
+
+// recordTaskResult stores an accepted result on the task record.
+func recordTaskResult(tr TaskResult) {
+	status := models.TaskStatusSuccess
+	if tr.ExitCode != 0 {
+		status = models.TaskStatusFailed
+	}
+	started, _ := time.Parse(time.RFC3339Nano, tr.StartedAt)
+	finished, _ := time.Parse(time.RFC3339Nano, tr.FinishedAt)
+	err := models.CompleteTaskRecord(models.Task{
+		TaskID: tr.TaskID, Status: status, ExitCode: tr.ExitCode, Stdout: tr.Stdout, Stderr: tr.Stderr,
+		StartedAt: started, FinishedAt: finished, DurationSec: tr.DurationSec, Late: tr.Late,
+	})
+	if err != nil {
+		log.Printf("record result of task %s: %v", tr.TaskID, err)
+	}
+	releaseTaskSlot(tr.TaskID)
+	retryAfterResult(tr)
+}
+
+func resultOutcome(err error) string {
+	if errors.Is(err, errResultUnknownTask) {
+		return "unknown"
+	}
+	return "rejected"
+}
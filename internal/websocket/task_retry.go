@@ -0,0 +1,260 @@
+// internal/websocket/task_retry.go
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Retries follow the task template's policy (retry_max_attempts,
+// retry_backoff_seconds doubled per attempt up to retry_max_backoff_seconds,
+// retry_exit_codes). Transient send failures (backpressure, full queues) are
+// always retryable; agent failures only for the listed exit codes. Waited-on
+// tasks retry in the caller; fire-and-forget tasks are tracked in task_retries
+// and re-sent by the retry worker, so retries survive a gateway restart. A task
+// that fails on its last attempt goes to task_dead_letters, from where an
+// operator can re-drive it. An attempt that is out holds a lease of
+// TASK_RETRY_LEASE_SECONDS, renewed while its task record is still active; once
+// it lapses the attempt is presumed lost (e.g. the node died mid-resend) and
+// counts as failed.
+var (
+	taskRetryPoll  = time.Duration(config.Int("TASK_RETRY_POLL_SECONDS", 5)) * time.Second
+	taskRetryLease = time.Duration(config.Int("TASK_RETRY_LEASE_SECONDS", 600)) * time.Second
+)
+
+const taskRetryBatch = 32
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrDeadLetterRedriven = errors.New("dead letter already re-driven")
+)
+
+// retryableSendError reports whether a failed send may succeed later.
+func retryableSendError(err error) bool {
+	return errors.Is(err, errBackpressure) || errors.Is(err, errSendQueueFull) ||
+		errors.Is(err, errDeliveryWindowFull) || errors.Is(err, ErrTaskQueueFull)
+}
+
+func taskRetryPolicy(task string) models.RetryPolicy {
+	p, err := models.TaskTemplateRetryPolicy(task)
+	if err != nil {
+		log.Printf("retry policy of %s: %v", task, err)
+	}
+	return p
+}
+
+func failureReason(res TaskResult, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("exit code %d: %s", res.ExitCode, res.Stderr)
+}
+
+// trackRetry stores the retry state of a fire-and-forget task; next is zero
+// while the attempt is out, which then holds a lease.
+func trackRetry(at taskAttempt, next time.Time, lastError string) {
+	var lease time.Time
+	if next.IsZero() {
+		lease = time.Now().Add(taskRetryLease).UTC()
+	}
+	if err := models.SaveTaskRetry(models.TaskRetry{
+		RootTaskID: at.root(), TaskID: at.taskID, VPSID: at.vpsId, TaskName: at.task, Args: at.args,
+		Attempt: at.attempt, NextAttemptAt: next, LeaseUntil: lease, LastError: lastError,
+	}); err != nil {
+		log.Printf("track retries of task %s: %v", at.root(), err)
+	}
+}
+
+func forgetRetry(at taskAttempt) {
+	if err := models.DeleteTaskRetry(at.root()); err != nil {
+		log.Printf("forget retries of task %s: %v", at.root(), err)
+	}
+}
+
+// retryAfterFailure schedules the next attempt of a tracked task, or
+// dead-letters it when the policy is used up. It reports whether a retry is
+// scheduled.
+func retryAfterFailure(at taskAttempt, p models.RetryPolicy, exitCode *int, reason string) bool {
+	if at.attempt >= p.MaxAttempts {
+		deadLetterTask(at, exitCode, reason)
+		return false
+	}
+	delay := p.Delay(at.attempt)
+	trackRetry(at, time.Now().Add(delay).UTC(), reason)
+	metricsTaskRetry("scheduled")
+	log.Printf("task %s attempt %d failed (%s); retrying in %s", at.root(), at.attempt, reason, delay)
+	return true
+}
+
+// deadLetterTask parks a task that failed on its last allowed attempt.
+func deadLetterTask(at taskAttempt, exitCode *int, reason string) {
+	forgetRetry(at)
+	id, err := models.InsertDeadLetter(models.DeadLetter{
+		RootTaskID: at.root(), TaskID: at.taskID, VPSID: at.vpsId, TaskName: at.task, Args: at.args,
+		Attempts: at.attempt, ExitCode: exitCode, LastError: reason,
+	})
+	if err != nil {
+		log.Printf("dead-letter task %s: %v", at.root(), err)
+		return
+	}
+	metricsTaskRetry("dead_lettered")
+	models.RecordAudit(models.AuditEntry{
+		Action:   "task_dead_lettered",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(at.vpsId),
+		Details:  fmt.Sprintf("dead_letter=%d task_id=%s task=%s attempts=%d error=%s", id, at.root(), at.task, at.attempt, reason),
+	})
+}
+
+// retryAfterResult continues the retries of a tracked task once its current
+// attempt reports back.
+func retryAfterResult(tr TaskResult) {
+	r, ok, err := models.TaskRetryByTask(tr.TaskID)
+	if err != nil {
+		log.Printf("retries of task %s: %v", tr.TaskID, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	at := attemptFromRetry(r)
+	p := taskRetryPolicy(at.task)
+	if tr.ExitCode == 0 || !p.RetryableExit(tr.ExitCode) {
+		forgetRetry(at)
+		return
+	}
+	code := tr.ExitCode
+	retryAfterFailure(at, p, &code, failureReason(tr, nil))
+}
+
+// stopRetries drops the retry state of a cancelled or expired attempt.
+func stopRetries(taskID string) {
+	r, ok, err := models.TaskRetryByTask(taskID)
+	if err != nil {
+		log.Printf("retries of task %s: %v", taskID, err)
+		return
+	}
+	if ok {
+		forgetRetry(attemptFromRetry(r))
+	}
+}
+
+func attemptFromRetry(r models.TaskRetry) taskAttempt {
+	at := taskAttempt{vpsId: r.VPSID, taskID: r.TaskID, rootID: r.RootTaskID, task: r.TaskName, args: r.Args, attempt: r.Attempt}
+	if at.rootID == at.taskID {
+		at.rootID = ""
+	}
+	return at
+}
+
+// StartTaskRetryWorker re-sends fire-and-forget tasks whose backoff has passed.
+func StartTaskRetryWorker() {
+	go func() {
+		ticker := time.NewTicker(taskRetryPoll)
+		defer ticker.Stop()
+		for range ticker.C {
+			due, err := models.ClaimDueTaskRetries(taskRetryBatch, taskRetryLease)
+			if err != nil {
+				log.Printf("claim task retries: %v", err)
+			}
+			for _, r := range due {
+				resendTask(attemptFromRetry(r).next())
+			}
+
+			lapsed, err := models.ClaimLapsedTaskRetries(taskRetryBatch, taskRetryLease)
+			if err != nil {
+				log.Printf("claim lapsed task retries: %v", err)
+			}
+			for _, r := range lapsed {
+				reclaimRetry(r)
+			}
+		}
+	}()
+}
+
+// reclaimRetry settles a tracked task whose attempt outlived its lease. An
+// attempt whose record is still active keeps the renewed lease; one that
+// finished without the retry state following (or was never recorded) is
+// settled now, a lost or failed one counting as a failed attempt.
+func reclaimRetry(r models.TaskRetry) {
+	at := attemptFromRetry(r)
+	rec, ok, err := models.GetTaskRecord(at.taskID)
+	if err != nil {
+		log.Printf("record of task %s: %v", at.taskID, err)
+		return
+	}
+	if ok && !models.TaskFinished(rec.Status) {
+		return
+	}
+	metricsTaskRetry("reclaimed")
+	if ok && rec.Status != models.TaskStatusFailed {
+		forgetRetry(at)
+		return
+	}
+	reason := "attempt lost: lease expired"
+	if ok {
+		reason = "attempt failed: lease expired before its retry was scheduled"
+	}
+	retryAfterFailure(at, taskRetryPolicy(at.task), nil, reason)
+}
+
+// resendTask starts the next attempt of a tracked task.
+func resendTask(at taskAttempt) {
+	trackRetry(at, time.Time{}, "")
+	metricsTaskRetry("retried")
+	_, err := startTask(at, SendOptions{})
+	if err == nil {
+		return
+	}
+	p := taskRetryPolicy(at.task)
+	if retryableSendError(err) {
+		retryAfterFailure(at, p, nil, err.Error())
+		return
+	}
+	// Cannot be sent at all any more (unknown agent, task no longer supported)
+	deadLetterTask(at, nil, err.Error())
+}
+
+// RedriveDeadLetter sends a dead-lettered task again as a new task with a
+// fresh retry budget and returns its task ID.
+func RedriveDeadLetter(id int64) (string, error) {
+	d, ok, err := models.GetDeadLetter(id)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrDeadLetterNotFound
+	}
+	if !d.RedrivenAt.IsZero() {
+		return "", ErrDeadLetterRedriven
+	}
+
+	at := newTaskAttempt(d.VPSID, d.TaskName, d.Args)
+	claimed, err := models.MarkDeadLetterRedriven(id, at.taskID)
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		return "", ErrDeadLetterRedriven
+	}
+	if _, err := sendTask(at, SendOptions{}); err != nil {
+		if rerr := models.ResetDeadLetterRedrive(id); rerr != nil {
+			log.Printf("reset re-drive of dead letter %d: %v", id, rerr)
+		}
+		return "", err
+	}
+
+	metricsTaskRetry("redriven")
+	models.RecordAudit(models.AuditEntry{
+		Action:   "task_redriven",
+		Entity:   "vps",
+		EntityID: models.AuditEntityID(d.VPSID),
+		Details:  fmt.Sprintf("dead_letter=%d task_id=%s task=%s", id, at.taskID, d.TaskName),
+	})
+	return at.taskID, nil
+}
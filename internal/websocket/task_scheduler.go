@@ -0,0 +1,478 @@
+// internal/websocket/task_scheduler.go
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"ultahost-ai-gateway/internal/config"
+	"ultahost-ai-gateway/internal/pkg/models"
+)
+
+// Tasks are admitted per agent before they are signed: at most
+// AGENT_MAX_CONCURRENT_TASKS run at once (0: unlimited), and tasks whose
+// templates share a lock_name (e.g. "package_manager") never overlap. Excess
+// tasks wait in FIFO order, at most AGENT_TASK_QUEUE_LIMIT per agent. A slot is
+// held until the task finishes (result, cancel, expiry, lost agent) or its
+// deadline passes; tasks without a deadline give it up after
+// TASK_SLOT_MAX_HOLD_SECONDS. On a cluster each running slot is also leased in
+// task_slots, so the limits hold across nodes; a node's queue polls every
+// TASK_SLOT_POLL_SECONDS for slots freed elsewhere.
+var (
+	maxConcurrentTasks = config.Int("AGENT_MAX_CONCURRENT_TASKS", 2)
+	taskQueueLimit     = config.Int("AGENT_TASK_QUEUE_LIMIT", 16)
+	taskSlotMaxHold    = time.Duration(config.Int("TASK_SLOT_MAX_HOLD_SECONDS", 3600)) * time.Second
+	taskSlotPoll       = time.Duration(config.Int("TASK_SLOT_POLL_SECONDS", 2)) * time.Second
+)
+
+var (
+	ErrTaskQueueFull = errors.New("too many tasks queued for this agent")
+	errTaskWithdrawn = errors.New("task withdrawn while waiting for the agent")
+)
+
+// OperationRunningError refuses a task that could not start right away and
+// was not allowed to queue.
+type OperationRunningError struct {
+	VPSID   string
+	Running []string // tasks holding the slots or the lock it needs
+	Waiting int      // tasks already queued on the agent
+}
+
+func (e *OperationRunningError) Error() string {
+	return fmt.Sprintf("another operation is running on VPS %s (%s)", e.VPSID, strings.Join(e.Running, ", "))
+}
+
+// taskSlot is one task admitted to an agent, running or waiting.
+type taskSlot struct {
+	vpsId     string
+	taskID    string
+	task      string
+	lock      string
+	queuedAt  time.Time
+	startedAt time.Time
+	ready     chan struct{} // closed when the task may run
+	withdrawn chan struct{} // closed when it leaves the queue without running
+	timer     *time.Timer   // releases a running slot at the deadline
+}
+
+// agentTasks holds the slots of one agent. Its mutex is held across the
+// Postgres lease calls, so a slow claim only stalls that agent; schedMu guards
+// the two maps alone and is always taken last.
+type agentTasks struct {
+	mu      sync.Mutex
+	vpsId   string
+	running []*taskSlot
+	waiting []*taskSlot
+	gone    bool // dropped from schedAgents; look the agent up again
+}
+
+var (
+	schedMu     sync.Mutex
+	schedAgents = map[string]*agentTasks{} // vpsId -> tasks
+	schedSlots  = map[string]*taskSlot{}   // taskID -> slot
+)
+
+// lockAgentTasks returns the agent's slots, locked, creating them if needed.
+func lockAgentTasks(vpsId string) *agentTasks {
+	for {
+		schedMu.Lock()
+		at, ok := schedAgents[vpsId]
+		if !ok {
+			at = &agentTasks{vpsId: vpsId}
+			schedAgents[vpsId] = at
+		}
+		schedMu.Unlock()
+		at.mu.Lock()
+		if !at.gone {
+			return at
+		}
+		at.mu.Unlock()
+	}
+}
+
+// lockSlot returns a tracked slot with its agent locked, or nil if the task
+// holds none.
+func lockSlot(taskID string) (*taskSlot, *agentTasks) {
+	schedMu.Lock()
+	s, ok := schedSlots[taskID]
+	schedMu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	at := lockAgentTasks(s.vpsId)
+	schedMu.Lock()
+	still := schedSlots[taskID] == s
+	schedMu.Unlock()
+	if !still {
+		at.unlock()
+		return nil, nil
+	}
+	return s, at
+}
+
+// unlock releases at, forgetting the agent once it has no tasks left.
+func (at *agentTasks) unlock() {
+	if len(at.running) == 0 && len(at.waiting) == 0 {
+		schedMu.Lock()
+		if schedAgents[at.vpsId] == at {
+			delete(schedAgents, at.vpsId)
+		}
+		schedMu.Unlock()
+		at.gone = true
+	}
+	at.mu.Unlock()
+}
+
+func trackSlot(s *taskSlot) {
+	schedMu.Lock()
+	schedSlots[s.taskID] = s
+	schedMu.Unlock()
+}
+
+// QueuedTask is a snapshot of one admitted task.
+type QueuedTask struct {
+	TaskID    string    `json:"task_id"`
+	Task      string    `json:"task"`
+	Lock      string    `json:"lock,omitempty"`
+	State     string    `json:"state"`              // running, waiting
+	Position  int       `json:"position,omitempty"` // 1-based, waiting only
+	QueuedAt  time.Time `json:"queued_at"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+}
+
+// taskLock resolves the lock name of a task template.
+func taskLock(task string) string {
+	lock, err := models.TaskTemplateLock(task)
+	if err != nil {
+		log.Printf("lock name of %s: %v", task, err)
+	}
+	return lock
+}
+
+// canStart reports whether a task with lock may run next to the running tasks,
+// given the waiting tasks ahead of it.
+func (at *agentTasks) canStart(lock string, ahead []*taskSlot) bool {
+	if maxConcurrentTasks > 0 && len(at.running) >= maxConcurrentTasks {
+		return false
+	}
+	if lock == "" {
+		return true
+	}
+	for _, s := range at.running {
+		if s.lock == lock {
+			return false
+		}
+	}
+	for _, s := range ahead {
+		if s.lock == lock {
+			return false
+		}
+	}
+	return true
+}
+
+// leaseSlot claims the cluster-wide lease of a task about to start, returning
+// the tasks of other nodes in its way. Always granted on a single node; a
+// failed claim counts as refused so limits are never exceeded.
+func leaseSlot(s *taskSlot) (bool, []string) {
+	if !clustered() {
+		return true, nil
+	}
+	ok, holders, err := models.ClaimTaskSlot(models.TaskSlotLease{
+		TaskID:    s.taskID,
+		VPSID:     s.vpsId,
+		Task:      s.task,
+		LockName:  s.lock,
+		NodeID:    config.AppConfig.NodeID,
+		ExpiresAt: time.Now().Add(taskSlotMaxHold),
+	}, maxConcurrentTasks)
+	if err != nil {
+		log.Printf("lease slot for task %s: %v", s.taskID, err)
+		return false, nil
+	}
+	return ok, holders
+}
+
+// dropSlotLease gives up the cluster-wide lease of a task, if any.
+func dropSlotLease(taskID string) {
+	if !clustered() {
+		return
+	}
+	if err := models.DeleteTaskSlot(taskID); err != nil {
+		log.Printf("drop slot lease of task %s: %v", taskID, err)
+	}
+}
+
+// blocking names the running tasks that keep a task with lock from starting.
+func (at *agentTasks) blocking(lock string) []string {
+	full := maxConcurrentTasks > 0 && len(at.running) >= maxConcurrentTasks
+	var out []string
+	for _, s := range at.running {
+		if full || (lock != "" && s.lock == lock) {
+			out = append(out, s.task)
+		}
+	}
+	if len(out) == 0 {
+		for _, s := range at.waiting {
+			out = append(out, s.task)
+		}
+	}
+	return out
+}
+
+// admitTask starts the task on the agent, or queues it when queue is set. The
+// returned position is 0 for a task that may run now.
+func admitTask(vpsId, taskID, task string, queue bool) (*taskSlot, int, error) {
+	s := &taskSlot{
+		vpsId:     vpsId,
+		taskID:    taskID,
+		task:      task,
+		lock:      taskLock(task),
+		queuedAt:  time.Now(),
+		ready:     make(chan struct{}),
+		withdrawn: make(chan struct{}),
+	}
+
+	at := lockAgentTasks(vpsId)
+	defer at.unlock()
+	var running []string
+	if at.canStart(s.lock, at.waiting) {
+		ok, holders := leaseSlot(s)
+		if ok {
+			s.startedAt = s.queuedAt
+			close(s.ready)
+			at.running = append(at.running, s)
+			trackSlot(s)
+			metricsTaskAdmission("started")
+			return s, 0, nil
+		}
+		running = holders
+	} else {
+		running = at.blocking(s.lock)
+	}
+	if !queue {
+		metricsTaskAdmission("busy")
+		return nil, 0, &OperationRunningError{VPSID: vpsId, Running: running, Waiting: len(at.waiting)}
+	}
+	if len(at.waiting) >= taskQueueLimit {
+		metricsTaskAdmission("queue_full")
+		return nil, 0, ErrTaskQueueFull
+	}
+	at.waiting = append(at.waiting, s)
+	trackSlot(s)
+	metricsTaskAdmission("queued")
+	return s, len(at.waiting), nil
+}
+
+// awaitTaskSlot blocks until the waiting task s may run. It gives up, leaving
+// the queue and closing the task record, when ctx ends, until passes (zero: no
+// limit) or the task is withdrawn or cancelled.
+func awaitTaskSlot(ctx context.Context, s *taskSlot, until time.Time) error {
+	var expired <-chan time.Time
+	if !until.IsZero() {
+		t := time.NewTimer(time.Until(until))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-s.ready:
+		// Another node may have cancelled the record meanwhile
+		if rec, ok, err := models.GetTaskRecord(s.taskID); err == nil && ok && models.TaskFinished(rec.Status) {
+			releaseTaskSlot(s.taskID)
+			return fmt.Errorf("task %s: %w", s.taskID, errTaskWithdrawn)
+		}
+		return nil
+	case <-s.withdrawn:
+		return fmt.Errorf("task %s: %w", s.taskID, errTaskWithdrawn)
+	case <-expired:
+		releaseTaskSlot(s.taskID)
+		metricsTaskAdmission("timeout")
+		abandonWaitingTask(s.taskID, models.TaskStatusExpired, "expired waiting for other operations on the agent")
+		return fmt.Errorf("task %s: timeout waiting for other operations on the agent", s.taskID)
+	case <-ctx.Done():
+		releaseTaskSlot(s.taskID)
+		abandonWaitingTask(s.taskID, models.TaskStatusCancelled, "requester went away while queued")
+		return fmt.Errorf("task %s abandoned while queued: %w", s.taskID, ctx.Err())
+	}
+}
+
+func abandonWaitingTask(taskID, status, detail string) {
+	if err := models.SetTaskStatus(taskID, status, detail); err != nil {
+		log.Printf("mark task %s %s: %v", taskID, status, err)
+	}
+}
+
+// holdTaskSlot releases the slot of a dispatched task at its deadline, so a
+// task that never reports back cannot block the agent for good.
+func holdTaskSlot(taskID string, deadline time.Time) {
+	hold := taskSlotMaxHold
+	if !deadline.IsZero() {
+		hold = time.Until(deadline)
+	}
+	s, at := lockSlot(taskID)
+	if s == nil {
+		return
+	}
+	defer at.unlock()
+	if s.timer == nil {
+		s.timer = time.AfterFunc(hold, func() { releaseTaskSlot(taskID) })
+		if clustered() {
+			if err := models.ExtendTaskSlot(taskID, time.Now().Add(hold)); err != nil {
+				log.Printf("extend slot lease of task %s: %v", taskID, err)
+			}
+		}
+	}
+}
+
+// releaseTaskSlot frees the slot of a finished task, or drops a waiting one,
+// and starts whatever can run next. The cluster lease is dropped even when
+// another node holds the slot, e.g. for a result that arrived here.
+func releaseTaskSlot(taskID string) {
+	s, at := lockSlot(taskID)
+	dropSlotLease(taskID)
+	if s == nil {
+		return
+	}
+	defer at.unlock()
+	at.drop(s)
+}
+
+// withdrawWaitingTask drops a task that is still waiting for a slot.
+func withdrawWaitingTask(taskID string) bool {
+	s, at := lockSlot(taskID)
+	if s == nil {
+		return false
+	}
+	defer at.unlock()
+	if slotIndex(at.waiting, s) < 0 {
+		return false
+	}
+	at.drop(s)
+	metricsTaskAdmission("withdrawn")
+	return true
+}
+
+// drop removes s from the agent and starts whatever can run next. Called with
+// at locked.
+func (at *agentTasks) drop(s *taskSlot) {
+	schedMu.Lock()
+	delete(schedSlots, s.taskID)
+	schedMu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if i := slotIndex(at.waiting, s); i >= 0 {
+		at.waiting = append(at.waiting[:i], at.waiting[i+1:]...)
+		close(s.withdrawn)
+	} else if i := slotIndex(at.running, s); i >= 0 {
+		at.running = append(at.running[:i], at.running[i+1:]...)
+	}
+	at.promote()
+}
+
+// promote starts waiting tasks in order while they fit. Called with at locked.
+func (at *agentTasks) promote() {
+	for i := 0; i < len(at.waiting); {
+		s := at.waiting[i]
+		if !at.canStart(s.lock, at.waiting[:i]) {
+			i++
+			continue
+		}
+		if ok, _ := leaseSlot(s); !ok {
+			i++
+			continue
+		}
+		at.waiting = append(at.waiting[:i], at.waiting[i+1:]...)
+		s.startedAt = time.Now()
+		at.running = append(at.running, s)
+		close(s.ready)
+		metricsTaskAdmission("started")
+	}
+}
+
+// startTaskSlotPoller starts waiting tasks once other nodes free their slots.
+func startTaskSlotPoller() {
+	go func() {
+		t := time.NewTicker(taskSlotPoll)
+		defer t.Stop()
+		for range t.C {
+			schedMu.Lock()
+			agents := make([]*agentTasks, 0, len(schedAgents))
+			for _, at := range schedAgents {
+				agents = append(agents, at)
+			}
+			schedMu.Unlock()
+			for _, at := range agents {
+				at.mu.Lock()
+				if !at.gone && len(at.waiting) > 0 {
+					at.promote()
+				}
+				at.mu.Unlock()
+			}
+		}
+	}()
+}
+
+func slotIndex(slots []*taskSlot, s *taskSlot) int {
+	for i, x := range slots {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// AgentTaskQueue lists the tasks running or waiting on an agent, running
+// first, then waiting in queue order. Clustered, the listing comes from the
+// shared slot leases and task records so it covers every node.
+func AgentTaskQueue(vpsId string) ([]QueuedTask, error) {
+	if clustered() {
+		return clusterTaskQueue(vpsId)
+	}
+	schedMu.Lock()
+	at, ok := schedAgents[vpsId]
+	schedMu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	out := make([]QueuedTask, 0, len(at.running)+len(at.waiting))
+	for _, s := range at.running {
+		out = append(out, QueuedTask{TaskID: s.taskID, Task: s.task, Lock: s.lock, State: "running",
+			QueuedAt: s.queuedAt, StartedAt: s.startedAt})
+	}
+	for i, s := range at.waiting {
+		out = append(out, QueuedTask{TaskID: s.taskID, Task: s.task, Lock: s.lock, State: "waiting",
+			Position: i + 1, QueuedAt: s.queuedAt})
+	}
+	return out, nil
+}
+
+// clusterTaskQueue builds the listing from task_slots (running) and the
+// waiting task records.
+func clusterTaskQueue(vpsId string) ([]QueuedTask, error) {
+	leases, err := models.ListTaskSlots(vpsId)
+	if err != nil {
+		return nil, err
+	}
+	waiting, err := models.ListWaitingTasks(vpsId)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]QueuedTask, 0, len(leases)+len(waiting))
+	for _, l := range leases {
+		out = append(out, QueuedTask{TaskID: l.TaskID, Task: l.Task, Lock: l.LockName, State: "running",
+			QueuedAt: l.StartedAt, StartedAt: l.StartedAt})
+	}
+	for i, t := range waiting {
+		out = append(out, QueuedTask{TaskID: t.TaskID, Task: t.TaskName, Lock: taskLock(t.TaskName), State: "waiting",
+			Position: i + 1, QueuedAt: t.CreatedAt})
+	}
+	return out, nil
+}
@@ -0,0 +1,77 @@
+// internal/websocket/task_signing.go
+package websocket
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"ultahost-ai-gateway/internal/utils"
+)
+
+// TaskSigningKeys announces the gateway's Ed25519 task-signing keys to an agent.
+// Signatures maps each published key ID to its signature over taskKeysCanonical,
+// so an agent that missed a rotation can authenticate the update with any key it
+// already trusts. Only the mTLS channel carries it; agents must not accept keys
+// that no trusted key has signed.
+type TaskSigningKeys struct {
+	Type       string                      `json:"type"` // "task_signing_keys"
+	Keys       []utils.PublishedSigningKey `json:"keys"`
+	ActiveKID  string                      `json:"active_kid"`
+	Timestamp  string                      `json:"timestamp"`
+	Signatures map[string]string           `json:"signatures"`
+}
+
+func taskKeysCanonical(m TaskSigningKeys) string {
+	parts := make([]string, 0, len(m.Keys))
+	for _, k := range m.Keys {
+		parts = append(parts, k.KeyID+":"+k.PublicKey+":"+k.RetiredAt)
+	}
+	return "task-keys-v1|" + m.ActiveKID + "|" + strings.Join(parts, ",") + "|" + m.Timestamp
+}
+
+func buildTaskSigningKeys() (TaskSigningKeys, bool) {
+	active, ok := utils.ActiveTaskSigningKey()
+	if !ok {
+		return TaskSigningKeys{}, false
+	}
+	m := TaskSigningKeys{
+		Type:      "task_signing_keys",
+		Keys:      utils.PublishedTaskSigningKeys(),
+		ActiveKID: active.KeyID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	m.Signatures = utils.SignWithPublishedTaskKeys(taskKeysCanonical(m))
+	return m, true
+}
+
+// sendTaskSigningKeys refreshes an Ed25519 agent's key set. Sent on connect
+// before the offline flush, so queued tasks signed with a newer key verify.
+func sendTaskSigningKeys(a *AgentConn) bool {
+	keys, ok := utils.GetAgentKeys(a.CommonName)
+	if !ok || keys.TaskSigAlgorithm() != utils.TaskSigEd25519 || !a.hasCapability("ed25519_tasks") {
+		return false
+	}
+	m, ok := buildTaskSigningKeys()
+	if !ok {
+		return false
+	}
+	if err := sendControl(a, m); err != nil {
+		log.Printf("task_signing_keys to %s failed: %v", a.CommonName, err)
+		return false
+	}
+	return true
+}
+
+// BroadcastTaskSigningKeys pushes the current key set to every connected Ed25519 agent
+// and returns how many received it.
+func BroadcastTaskSigningKeys() int {
+	n := 0
+	PoolRange(func(_ string, a *AgentConn) bool {
+		if sendTaskSigningKeys(a) {
+			n++
+		}
+		return true
+	})
+	return n
+}
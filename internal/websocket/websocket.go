@@ -1,38 +1,82 @@
 package websocket
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
+	"ultahost-ai-gateway/internal/pkg/models"
 	"ultahost-ai-gateway/internal/utils"
 )
 
+// errBackpressure: the agent's send queue was full and it was disconnected
+// (WS_BACKPRESSURE_POLICY=disconnect).
+var errBackpressure = errors.New("agent disconnected: backpressure")
+
+// SendMessage delivers payload to the agent, queueing it for the default TTL
+// while the agent is offline.
 func SendMessage(vpsId string, payload []byte) error {
+	return SendMessageTTL(vpsId, payload, 0)
+}
+
+// SendMessageTTL is SendMessage with the offline-queue lifetime chosen by the
+// caller: 0 uses OFFLINE_DEFAULT_TTL_SECONDS, a negative ttl never expires.
+func SendMessageTTL(vpsId string, payload []byte, ttl time.Duration) error {
+	_, err := sendMessage(vpsId, models.OfflineMessage{Payload: payload, ExpiresAt: offlineExpiry(ttl)})
+	return err
+}
+
+// sendMessage reports whether m went to the offline queue rather than a connection.
+func sendMessage(vpsId string, m models.OfflineMessage) (queued bool, err error) {
 	CN := "Agent_" + vpsId
 	keyInfo, exist := utils.GetAgentKeys(CN)
 	if !exist {
-		return fmt.Errorf("no keys")
+		return false, fmt.Errorf("no keys")
+	}
+
+	// Quarantined: hold in the offline buffer until an admin releases the identity
+	if IsQuarantined(CN) {
+		if dropped := OfflineEnqueue(keyInfo.IdentityToken, m); dropped > 0 {
+			metricsDropped(dropped)
+		}
+		metricsOfflineBuffered(1)
+		return true, nil
 	}
 
 	// Try live connection first
 	if a, ok := PoolGet(keyInfo.IdentityToken); ok {
-		select {
-		case a.Send <- payload:
-			metricsEnqueued(1)
-			return nil
-		default:
-			// Backpressure policy: disconnect or drop
-			metricsDropped(1)
-			close(a.Send)
-			_ = a.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			return fmt.Errorf("agent disconnected: backpressure")
+		queued, err := deliverLive(a, m)
+		if !errors.Is(err, errDeliveryClosed) {
+			return queued, err
 		}
+		// Connection is going away: queue below
+	}
+
+	// Held by another gateway node
+	if forwarded, err := forwardToOwner(CN, m); forwarded {
+		return false, err
 	}
 
 	// Offline: buffer
-	dropped := OfflineEnqueue(keyInfo.IdentityToken, payload)
+	dropped := OfflineEnqueue(keyInfo.IdentityToken, m)
 	if dropped > 0 {
 		metricsDropped(dropped)
 	}
 	metricsOfflineBuffered(1)
+	return true, nil
+}
+
+// sendControl marshals a gateway control message onto the control lane of a
+// live connection. Unlike SendMessage it never buffers offline and never
+// disconnects on a full queue.
+func sendControl(a *AgentConn, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := enqueueFrame(a, laneControl, queuedFrame{data: payload}, 0); err != nil {
+		metricsDropped(1)
+		return err
+	}
 	return nil
 }